@@ -3,14 +3,80 @@ package backend
 import (
 	"context"
 	"errors"
+	"time"
 )
 
-var ErrNoBackends = errors.New("no backends")
+var (
+	ErrNoBackends       = errors.New("no backends")
+	ErrBackendNotFound  = errors.New("backend not in backends list")
+	ErrBackendExists    = errors.New("backend already in backends list")
+	ErrFrontendNotFound = errors.New("frontend not found")
+	ErrFrontendExists   = errors.New("frontend already exists")
+)
 
 type RoutesBackend interface {
 	Healthcheck(ctx context.Context) error
-	Backends(ctx context.Context, host string) (string, []string, map[int]struct{}, error)
-	MarkDead(ctx context.Context, host string, backend string, backendIdx int, backendLen int, deadTTL int) error
-	StartMonitor(ctx context.Context) error
+	Frontend(ctx context.Context, host string) (*Frontend, error)
+	RegexFrontends(ctx context.Context) ([]string, error)
+	MarkDead(ctx context.Context, host string, backend string, deadTTL int) error
+	StartMonitor(ctx context.Context, opts MonitorOptions) error
 	StopMonitor()
+	// StartRoutesWatcher calls fn with the host of every changed frontend,
+	// or with an empty host if every frontend may have changed.
+	StartRoutesWatcher(ctx context.Context, fn func(host string)) error
+	StopRoutesWatcher()
+}
+
+// RateLimiter is implemented by backends able to share rate limits between
+// every roxxy instance using them.
+type RateLimiter interface {
+	// RateLimit takes a request from the rate limit of key in host, allowing
+	// rate requests per second with bursts of up to burst requests.
+	RateLimit(ctx context.Context, host, key string, rate float64, burst int, now time.Time) (RateLimitResult, error)
+}
+
+// RateLimitResult is the outcome of a rate limited request. Remaining is the
+// number of requests allowed right away after this one, RetryAfter the time
+// until a rejected request would be allowed and Reset the time until the
+// whole burst is available again.
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+// MonitorOptions configures the active health checks started by
+// StartMonitor. Backends marked as dead are always checked until they are
+// reachable again. With Interval set, every backend of every frontend is also
+// checked continuously: it's marked as dead after Fall consecutive failed
+// checks and revived after Rise consecutive successful ones. At most
+// Concurrency checks run at the same time.
+type MonitorOptions struct {
+	Interval    time.Duration
+	Rise        int
+	Fall        int
+	Concurrency int
+}
+
+func (o *MonitorOptions) setDefaults() {
+	if o.Concurrency <= 0 {
+		o.Concurrency = 5
+	}
+	if o.Rise <= 0 {
+		o.Rise = 2
+	}
+	if o.Fall <= 0 {
+		o.Fall = 3
+	}
+}
+
+// deadTTL is the time a backend failing continuous checks is marked as dead
+// for, refreshed on every failed check.
+func (o MonitorOptions) deadTTL() time.Duration {
+	ttl := 3 * o.Interval
+	if ttl < 30*time.Second {
+		ttl = 30 * time.Second
+	}
+	return ttl
 }
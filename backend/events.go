@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	BackendDead  = "dead"
+	BackendAlive = "alive"
+
+	defaultWebhookRetries = 3
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+// BackendEvent is emitted every time a backend is marked as dead or revived.
+// Backends and DeadBackends count the backends of the frontend after the
+// change, allowing alerts when a frontend loses most of its backends.
+type BackendEvent struct {
+	Type         string    `json:"type"`
+	Host         string    `json:"host"`
+	Backend      string    `json:"backend"`
+	Time         time.Time `json:"time"`
+	Backends     int       `json:"backends"`
+	DeadBackends int       `json:"deadBackends"`
+}
+
+// EventOptions configures the delivery of backend events. Events are always
+// logged, and published to the backend-events channel by the redis backend.
+// Each webhook receives events as a JSON POST, failed deliveries are retried
+// WebhookRetries times with an exponential backoff.
+type EventOptions struct {
+	WebhookURLs    []string
+	WebhookRetries int
+	WebhookTimeout time.Duration
+}
+
+func (o *EventOptions) setDefaults() {
+	if o.WebhookRetries <= 0 {
+		o.WebhookRetries = defaultWebhookRetries
+	}
+	if o.WebhookTimeout <= 0 {
+		o.WebhookTimeout = defaultWebhookTimeout
+	}
+}
+
+// eventNotifier logs backend events and delivers them to webhooks, publish
+// sends them to backend specific consumers like a redis channel.
+type eventNotifier struct {
+	opts       EventOptions
+	publish    func(ctx context.Context, data []byte) error
+	httpClient *http.Client
+	backoff    time.Duration
+	pending    sync.WaitGroup
+}
+
+func newEventNotifier(opts EventOptions, publish func(ctx context.Context, data []byte) error) *eventNotifier {
+	opts.setDefaults()
+	return &eventNotifier{
+		opts:       opts,
+		publish:    publish,
+		httpClient: &http.Client{Timeout: opts.WebhookTimeout},
+		backoff:    time.Second,
+	}
+}
+
+func (n *eventNotifier) notify(ctx context.Context, event BackendEvent) {
+	if n == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	log.Printf("backend %q of %q is %s, %d of %d backends dead", event.Backend, event.Host, event.Type, event.DeadBackends, event.Backends)
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("unable to encode backend event: %v", err)
+		return
+	}
+	if n.publish != nil {
+		err = n.publish(ctx, data)
+		if err != nil {
+			log.Printf("unable to publish backend event: %v", err)
+		}
+	}
+	for _, url := range n.opts.WebhookURLs {
+		n.pending.Add(1)
+		go func(url string) {
+			defer n.pending.Done()
+			n.deliver(url, data)
+		}(url)
+	}
+}
+
+// wait blocks until every pending webhook delivery is done.
+func (n *eventNotifier) wait() {
+	if n == nil {
+		return
+	}
+	n.pending.Wait()
+}
+
+// deliver posts data to a webhook, it runs detached from the request that
+// triggered the event so a slow webhook never delays the proxy.
+func (n *eventNotifier) deliver(url string, data []byte) {
+	backoff := n.backoff
+	var err error
+	for attempt := 0; attempt <= n.opts.WebhookRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = n.post(url, data)
+		if err == nil {
+			return
+		}
+	}
+	log.Printf("unable to deliver backend event to %q: %v", url, err)
+}
+
+func (n *eventNotifier) post(url string, data []byte) error {
+	rsp, err := n.httpClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", rsp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type EventsSuite struct{}
+
+var _ = check.Suite(&EventsSuite{})
+
+func (s *EventsSuite) TestNotifyWebhookRetries(c *check.C) {
+	var calls int32
+	events := make(chan BackendEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		c.Check(req.Method, check.Equals, http.MethodPost)
+		c.Check(req.Header.Get("Content-Type"), check.Equals, "application/json")
+		var event BackendEvent
+		c.Check(json.NewDecoder(req.Body).Decode(&event), check.IsNil)
+		events <- event
+	}))
+	defer srv.Close()
+	n := newEventNotifier(EventOptions{WebhookURLs: []string{srv.URL}}, nil)
+	n.backoff = time.Millisecond
+	now := time.Now().UTC()
+	n.notify(context.Background(), BackendEvent{Type: BackendDead, Host: "f1.com", Backend: "srv1", Time: now, Backends: 2, DeadBackends: 1})
+	select {
+	case event := <-events:
+		c.Assert(event.Time.Equal(now), check.Equals, true)
+		event.Time = now
+		c.Assert(event, check.DeepEquals, BackendEvent{Type: BackendDead, Host: "f1.com", Backend: "srv1", Time: now, Backends: 2, DeadBackends: 1})
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for webhook")
+	}
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(3))
+}
+
+func (s *EventsSuite) TestNotifyWebhookGivesUp(c *check.C) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	n := newEventNotifier(EventOptions{WebhookURLs: []string{srv.URL}, WebhookRetries: 2}, nil)
+	n.backoff = time.Millisecond
+	n.deliver(srv.URL, []byte("{}"))
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(3))
+}
@@ -0,0 +1,559 @@
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var fileReloadInterval = time.Second
+
+// fileConfig is the document read by the file backend. Both YAML and JSON
+// are accepted as JSON documents are also valid YAML.
+type fileConfig struct {
+	Frontends map[string]fileFrontend `yaml:"frontends"`
+	Regex     []string                `yaml:"regex"`
+}
+
+type fileFrontend struct {
+	Backends    []string         `yaml:"backends"`
+	Weights     map[string]int   `yaml:"weights"`
+	Options     fileOptions      `yaml:"options"`
+	Healthcheck *fileHealthcheck `yaml:"healthcheck"`
+}
+
+type fileOptions struct {
+	LoadBalancer    string            `yaml:"lb"`
+	HashKey         string            `yaml:"hash-key"`
+	Sticky          bool              `yaml:"sticky"`
+	StickyCookie    string            `yaml:"sticky-cookie"`
+	StickyTTL       time.Duration     `yaml:"sticky-ttl"`
+	RateLimit       float64           `yaml:"rate-limit"`
+	RateLimitBurst  int               `yaml:"rate-limit-burst"`
+	RateLimitKey    string            `yaml:"rate-limit-key"`
+	DialTimeout     time.Duration     `yaml:"dial-timeout"`
+	RequestTimeout  time.Duration     `yaml:"timeout"`
+	RequestHeaders  map[string]string `yaml:"headers"`
+	ResponseHeaders map[string]string `yaml:"response-headers"`
+}
+
+type fileHealthcheck struct {
+	Type        string            `yaml:"type"`
+	Path        string            `yaml:"path"`
+	Method      string            `yaml:"method"`
+	Headers     map[string]string `yaml:"headers"`
+	Body        string            `yaml:"body"`
+	BodyRegex   string            `yaml:"body-regex"`
+	Status      int               `yaml:"status"`
+	SNI         string            `yaml:"sni"`
+	CA          string            `yaml:"ca"`
+	Timeout     time.Duration     `yaml:"timeout"`
+	GRPCService string            `yaml:"grpc-service"`
+}
+
+type fileBackend struct {
+	path    string
+	mu      sync.RWMutex
+	config  *fileConfig
+	modTime time.Time
+	size    int64
+	deadMu  sync.Mutex
+	dead    map[string]map[string]time.Time
+	// monitorMu guards monitor, started and stopped while requests mark
+	// backends as dead.
+	monitorMu sync.Mutex
+	monitor   *fileMonitor
+	watchMu   sync.Mutex
+	watchFn   func(host string)
+	events    *eventNotifier
+}
+
+func NewFileBackend(ctx context.Context, path string, events EventOptions) (RoutesBackend, error) {
+	b := &fileBackend{
+		path:   path,
+		dead:   make(map[string]map[string]time.Time),
+		events: newEventNotifier(events, nil),
+	}
+	_, err := b.reload()
+	if err != nil {
+		return nil, err
+	}
+	go b.watch(ctx)
+	return b, nil
+}
+
+func loadFileConfig(path string) (*fileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config fileConfig
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Frontends == nil {
+		config.Frontends = make(map[string]fileFrontend)
+	}
+	return &config, nil
+}
+
+// reload reads the routes file again if it changed since the last load. The
+// new config is only swapped in after being fully parsed, readers never see a
+// partially loaded file.
+func (b *fileBackend) reload() (bool, error) {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return false, err
+	}
+	b.mu.RLock()
+	unchanged := b.config != nil && info.ModTime().Equal(b.modTime) && info.Size() == b.size
+	b.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	config, err := loadFileConfig(b.path)
+	if err != nil {
+		return false, err
+	}
+	b.mu.Lock()
+	oldConfig := b.config
+	b.config = config
+	b.modTime = info.ModTime()
+	b.size = info.Size()
+	b.mu.Unlock()
+	if oldConfig != nil {
+		for host, frontend := range config.Frontends {
+			if !reflect.DeepEqual(oldConfig.Frontends[host], frontend) {
+				b.notify(host)
+			}
+		}
+		for host := range oldConfig.Frontends {
+			if _, ok := config.Frontends[host]; !ok {
+				b.notify(host)
+			}
+		}
+	}
+	return true, nil
+}
+
+func (b *fileBackend) notify(host string) {
+	b.watchMu.Lock()
+	fn := b.watchFn
+	b.watchMu.Unlock()
+	if fn != nil {
+		fn(host)
+	}
+}
+
+func (b *fileBackend) watch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(fileReloadInterval):
+		}
+		reloaded, err := b.reload()
+		if err != nil {
+			log.Printf("unable to reload routes from %q, keeping previous routes: %v", b.path, err)
+			continue
+		}
+		if reloaded {
+			log.Printf("routes reloaded from %q", b.path)
+		}
+	}
+}
+
+func (b *fileBackend) frontend(host string) (fileFrontend, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	frontend, ok := b.config.Frontends[host]
+	return frontend, ok
+}
+
+func (b *fileBackend) Healthcheck(ctx context.Context) error {
+	_, err := os.Stat(b.path)
+	return err
+}
+
+func (b *fileBackend) Frontend(ctx context.Context, host string) (*Frontend, error) {
+	frontend, ok := b.frontend(host)
+	if !ok || len(frontend.Backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	deadMap := map[int]struct{}{}
+	var deadUntil time.Time
+	now := time.Now()
+	b.deadMu.Lock()
+	for i, backend := range frontend.Backends {
+		if reviveAt, isDead := b.dead[host][backend]; isDead && now.Before(reviveAt) {
+			deadMap[i] = struct{}{}
+			if deadUntil.IsZero() || reviveAt.Before(deadUntil) {
+				deadUntil = reviveAt
+			}
+		}
+	}
+	b.deadMu.Unlock()
+	weights := make([]int, len(frontend.Backends))
+	for i, backend := range frontend.Backends {
+		weights[i] = frontend.Weights[backend]
+	}
+	result := newFrontend(host, frontend.Backends, weights, deadMap, FrontendOptions{
+		LoadBalancer:    frontend.Options.LoadBalancer,
+		HashKey:         frontend.Options.HashKey,
+		Sticky:          frontend.Options.Sticky,
+		StickyCookie:    frontend.Options.StickyCookie,
+		StickyTTL:       frontend.Options.StickyTTL,
+		RateLimit:       frontend.Options.RateLimit,
+		RateLimitBurst:  frontend.Options.RateLimitBurst,
+		RateLimitKey:    frontend.Options.RateLimitKey,
+		DialTimeout:     frontend.Options.DialTimeout,
+		RequestTimeout:  frontend.Options.RequestTimeout,
+		RequestHeaders:  frontend.Options.RequestHeaders,
+		ResponseHeaders: frontend.Options.ResponseHeaders,
+	})
+	result.DeadUntil = deadUntil
+	return result, nil
+}
+
+func (b *fileBackend) RegexFrontends(ctx context.Context) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	patterns := make([]string, len(b.config.Regex))
+	copy(patterns, b.config.Regex)
+	return patterns, nil
+}
+
+// addDead marks backend as dead for ttl, never shortening a later expiry.
+// Each backend expires on its own.
+func (b *fileBackend) addDead(host, backend string, ttl time.Duration) {
+	now := time.Now()
+	reviveAt := now.Add(ttl)
+	b.deadMu.Lock()
+	dead, ok := b.dead[host]
+	if !ok {
+		dead = make(map[string]time.Time)
+		b.dead[host] = dead
+	}
+	for member, memberReviveAt := range dead {
+		if !now.Before(memberReviveAt) {
+			delete(dead, member)
+		}
+	}
+	current, isDead := dead[backend]
+	if !isDead || current.Before(reviveAt) {
+		dead[backend] = reviveAt
+	}
+	deadCount := len(dead)
+	b.deadMu.Unlock()
+	b.notify(host)
+	if !isDead {
+		b.events.notify(context.Background(), b.event(BackendDead, host, backend, now, deadCount))
+	}
+}
+
+func (b *fileBackend) event(kind, host, backend string, now time.Time, deadCount int) BackendEvent {
+	frontend, _ := b.frontend(host)
+	return BackendEvent{
+		Type:         kind,
+		Host:         host,
+		Backend:      backend,
+		Time:         now,
+		Backends:     len(frontend.Backends),
+		DeadBackends: deadCount,
+	}
+}
+
+func (b *fileBackend) isDead(host, backend string) bool {
+	b.deadMu.Lock()
+	defer b.deadMu.Unlock()
+	reviveAt, isDead := b.dead[host][backend]
+	return isDead && time.Now().Before(reviveAt)
+}
+
+func (b *fileBackend) removeDead(host, backend string) {
+	now := time.Now()
+	b.deadMu.Lock()
+	dead := b.dead[host]
+	reviveAt, wasDead := dead[backend]
+	delete(dead, backend)
+	deadCount := 0
+	for _, memberReviveAt := range dead {
+		if now.Before(memberReviveAt) {
+			deadCount++
+		}
+	}
+	if dead != nil && len(dead) == 0 {
+		delete(b.dead, host)
+	}
+	b.deadMu.Unlock()
+	b.notify(host)
+	if wasDead && now.Before(reviveAt) {
+		b.events.notify(context.Background(), b.event(BackendAlive, host, backend, now, deadCount))
+	}
+}
+
+func (b *fileBackend) MarkDead(ctx context.Context, host string, backend string, deadTTL int) error {
+	b.addDead(host, backend, time.Duration(deadTTL)*time.Second)
+	b.monitorMu.Lock()
+	monitor := b.monitor
+	b.monitorMu.Unlock()
+	if monitor != nil {
+		monitor.add(host, backend, time.Duration(deadTTL)*time.Second)
+	}
+	return nil
+}
+
+// StartMonitor starts the healthcheck monitor, stopping the one started
+// before, if any.
+func (b *fileBackend) StartMonitor(ctx context.Context, opts MonitorOptions) error {
+	monitor := newFileMonitor(ctx, b, opts)
+	b.monitorMu.Lock()
+	previous := b.monitor
+	b.monitor = monitor
+	b.monitorMu.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+	return nil
+}
+
+func (b *fileBackend) StopMonitor() {
+	b.monitorMu.Lock()
+	monitor := b.monitor
+	b.monitor = nil
+	b.monitorMu.Unlock()
+	if monitor != nil {
+		monitor.stop()
+	}
+}
+
+func (b *fileBackend) StartRoutesWatcher(ctx context.Context, fn func(host string)) error {
+	b.watchMu.Lock()
+	b.watchFn = fn
+	b.watchMu.Unlock()
+	return nil
+}
+
+func (b *fileBackend) StopRoutesWatcher() {
+	b.watchMu.Lock()
+	b.watchFn = nil
+	b.watchMu.Unlock()
+}
+
+func (f fileFrontend) hcData() hcData {
+	if f.Healthcheck == nil {
+		return hcData{}
+	}
+	return hcData{
+		probe:       f.Healthcheck.Type,
+		path:        f.Healthcheck.Path,
+		method:      f.Healthcheck.Method,
+		headers:     f.Healthcheck.Headers,
+		body:        f.Healthcheck.Body,
+		bodyRegex:   f.Healthcheck.BodyRegex,
+		status:      f.Healthcheck.Status,
+		sni:         f.Healthcheck.SNI,
+		ca:          f.Healthcheck.CA,
+		timeout:     f.Healthcheck.Timeout,
+		grpcService: f.Healthcheck.GRPCService,
+	}
+}
+
+// fileMonitor mirrors redisMonitor for a single roxxy instance: every backend
+// marked as dead is checked each second until it's reachable again and, with
+// an interval set, every backend is checked continuously.
+type fileMonitor struct {
+	ctx      context.Context
+	mu       sync.Mutex
+	reserved map[string]struct{}
+	counters map[string]*checkCounters
+	opts     MonitorOptions
+	wg       sync.WaitGroup
+	quit     chan struct{}
+	limiter  chan struct{}
+	backend  *fileBackend
+}
+
+func newFileMonitor(ctx context.Context, backend *fileBackend, opts MonitorOptions) *fileMonitor {
+	opts.setDefaults()
+	m := &fileMonitor{
+		ctx:      ctx,
+		reserved: make(map[string]struct{}),
+		counters: make(map[string]*checkCounters),
+		opts:     opts,
+		quit:     make(chan struct{}),
+		limiter:  make(chan struct{}, opts.Concurrency),
+		backend:  backend,
+	}
+	if opts.Interval > 0 {
+		m.wg.Add(1)
+		go m.schedule()
+	}
+	return m
+}
+
+// add watches a backend marked as dead for deadTTL, keeping it dead for
+// deadTTL after every failed check until it's reachable again.
+func (m *fileMonitor) add(host, backend string, deadTTL time.Duration) {
+	localKey := host + "-" + backend
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.quit:
+		return
+	default:
+	}
+	if _, ok := m.reserved[localKey]; ok {
+		return
+	}
+	m.reserved[localKey] = struct{}{}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.watch(host, backend, deadTTL)
+		m.mu.Lock()
+		delete(m.reserved, localKey)
+		m.mu.Unlock()
+	}()
+}
+
+func (m *fileMonitor) watch(host, backend string, deadTTL time.Duration) {
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-time.After(time.Second):
+		}
+		frontend, ok := m.backend.frontend(host)
+		if !ok {
+			return
+		}
+		found := false
+		for i := range frontend.Backends {
+			if frontend.Backends[i] == backend {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+		select {
+		case <-m.quit:
+			return
+		case m.limiter <- struct{}{}:
+		}
+		isOk := m.check(frontend.hcData(), backend)
+		<-m.limiter
+		if isOk {
+			m.backend.removeDead(host, backend)
+			return
+		}
+		m.backend.addDead(host, backend, deadTTL)
+	}
+}
+
+func (m *fileMonitor) check(hc hcData, backend string) bool {
+	monitorChecksInFlight.Inc()
+	defer monitorChecksInFlight.Dec()
+	return hc.check(m.ctx, backend)
+}
+
+func (m *fileMonitor) schedule() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-time.After(m.opts.Interval):
+		}
+		m.checkAll()
+	}
+}
+
+func (m *fileMonitor) checkAll() {
+	m.backend.mu.RLock()
+	frontends := m.backend.config.Frontends
+	m.backend.mu.RUnlock()
+	seen := make(map[string]struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for host, frontend := range frontends {
+		hc := frontend.hcData()
+		for _, backend := range frontend.Backends {
+			localKey := host + "-" + backend
+			m.mu.Lock()
+			_, watching := m.reserved[localKey]
+			m.mu.Unlock()
+			if watching {
+				continue
+			}
+			seen[localKey] = struct{}{}
+			select {
+			case <-m.quit:
+				return
+			case m.limiter <- struct{}{}:
+			}
+			wg.Add(1)
+			go func(host, backend string) {
+				defer wg.Done()
+				isOk := m.check(hc, backend)
+				<-m.limiter
+				m.record(host, backend, isOk)
+			}(host, backend)
+		}
+	}
+	wg.Wait()
+	m.mu.Lock()
+	for localKey := range m.counters {
+		if _, ok := seen[localKey]; !ok {
+			delete(m.counters, localKey)
+		}
+	}
+	m.mu.Unlock()
+}
+
+// record updates the consecutive results of backend, marking it as dead after
+// Fall failures and reviving it after Rise successes.
+func (m *fileMonitor) record(host, backend string, isOk bool) {
+	localKey := host + "-" + backend
+	m.mu.Lock()
+	counters := m.counters[localKey]
+	if counters == nil {
+		counters = &checkCounters{}
+		m.counters[localKey] = counters
+	}
+	if isOk {
+		counters.successes++
+		counters.failures = 0
+	} else {
+		counters.failures++
+		counters.successes = 0
+	}
+	markDead := !isOk && counters.failures >= m.opts.Fall
+	revive := isOk && counters.successes >= m.opts.Rise
+	m.mu.Unlock()
+	if markDead {
+		m.backend.addDead(host, backend, m.opts.deadTTL())
+	} else if revive && m.backend.isDead(host, backend) {
+		m.backend.removeDead(host, backend)
+	}
+}
+
+func (m *fileMonitor) stop() {
+	m.mu.Lock()
+	select {
+	case <-m.quit:
+	default:
+		close(m.quit)
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
@@ -0,0 +1,496 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type FileSuite struct {
+	path   string
+	ctx    context.Context
+	cancel context.CancelFunc
+	be     RoutesBackend
+}
+
+var _ = check.Suite(&FileSuite{})
+
+func (s *FileSuite) SetUpTest(c *check.C) {
+	dir, err := ioutil.TempDir("", "routes")
+	c.Assert(err, check.IsNil)
+	s.path = filepath.Join(dir, "routes.yaml")
+	s.writeRoutes(c, `
+frontends:
+  f1.com:
+    backends:
+      - srv1
+      - srv2
+  empty.com:
+`)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.be, err = NewFileBackend(s.ctx, s.path, EventOptions{})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *FileSuite) TearDownTest(c *check.C) {
+	s.cancel()
+	os.RemoveAll(filepath.Dir(s.path))
+}
+
+func (s *FileSuite) writeRoutes(c *check.C, data string) {
+	tmpPath := s.path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, []byte(data), 0o666)
+	c.Assert(err, check.IsNil)
+	err = os.Rename(tmpPath, s.path)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *FileSuite) TestNewFileBackendInvalidFile(c *check.C) {
+	_, err := NewFileBackend(s.ctx, filepath.Join(filepath.Dir(s.path), "missing.yaml"), EventOptions{})
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	s.writeRoutes(c, "frontends: [")
+	_, err = NewFileBackend(s.ctx, s.path, EventOptions{})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *FileSuite) TestBackends(c *check.C) {
+	ctx := context.Background()
+	frontend, err := s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.ID, check.Equals, "f1.com")
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv1", "srv2"})
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{})
+}
+
+func (s *FileSuite) TestBackendsNotFound(c *check.C) {
+	ctx := context.Background()
+	_, err := s.be.Frontend(ctx, "unknown.com")
+	c.Assert(err, check.Equals, ErrNoBackends)
+	_, err = s.be.Frontend(ctx, "empty.com")
+	c.Assert(err, check.Equals, ErrNoBackends)
+}
+
+func (s *FileSuite) TestBackendsJSON(c *check.C) {
+	s.writeRoutes(c, `{"frontends": {"f2.com": {"id": "f2", "backends": ["srv3"]}}}`)
+	be, err := NewFileBackend(s.ctx, s.path, EventOptions{})
+	c.Assert(err, check.IsNil)
+	frontend, err := be.Frontend(context.Background(), "f2.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.ID, check.Equals, "f2.com")
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv3"})
+}
+
+func (s *FileSuite) TestBackendsWithWeights(c *check.C) {
+	s.writeRoutes(c, `
+frontends:
+  f1.com:
+    backends:
+      - srv1
+      - srv2
+    weights:
+      srv1: 3
+`)
+	be, err := NewFileBackend(s.ctx, s.path, EventOptions{})
+	c.Assert(err, check.IsNil)
+	frontend, err := be.Frontend(context.Background(), "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Weights(), check.DeepEquals, []int{3, 1})
+	frontend, err = s.be.Frontend(context.Background(), "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Weights(), check.DeepEquals, []int{1, 1})
+}
+
+func (s *FileSuite) TestRegexFrontends(c *check.C) {
+	s.writeRoutes(c, `
+regex:
+  - ^tenant-1
+  - ^tenant-
+frontends:
+  ^tenant-1:
+    backends:
+      - srv1
+`)
+	be, err := NewFileBackend(s.ctx, s.path, EventOptions{})
+	c.Assert(err, check.IsNil)
+	patterns, err := be.RegexFrontends(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(patterns, check.DeepEquals, []string{"^tenant-1", "^tenant-"})
+	frontend, err := be.Frontend(context.Background(), "^tenant-1")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv1"})
+}
+
+func (s *FileSuite) TestBackendsWithDead(c *check.C) {
+	ctx := context.Background()
+	err := s.be.MarkDead(ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	err = s.be.MarkDead(ctx, "f1.com", "srv2", 30)
+	c.Assert(err, check.IsNil)
+	frontend, err := s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv1", "srv2"})
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{0: {}, 1: {}})
+}
+
+func (s *FileSuite) TestBackendsWithDeadReordered(c *check.C) {
+	ctx := context.Background()
+	be := s.be.(*fileBackend)
+	err := be.MarkDead(ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	s.writeRoutes(c, `
+frontends:
+  f1.com:
+    backends:
+      - srv2
+      - srv1
+`)
+	future := time.Now().Add(time.Minute)
+	err = os.Chtimes(s.path, future, future)
+	c.Assert(err, check.IsNil)
+	_, err = be.reload()
+	c.Assert(err, check.IsNil)
+	frontend, err := be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{1: {}})
+}
+
+func (s *FileSuite) TestMarkDeadExpires(c *check.C) {
+	ctx := context.Background()
+	be := s.be.(*fileBackend)
+	be.addDead("f1.com", "srv2", 100*time.Millisecond)
+	be.addDead("f1.com", "srv1", 30*time.Second)
+	frontend, err := be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{0: {}, 1: {}})
+	time.Sleep(150 * time.Millisecond)
+	frontend, err = be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{0: {}})
+	be.addDead("f1.com", "srv1", 100*time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	frontend, err = be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{0: {}})
+}
+
+func (s *FileSuite) TestReload(c *check.C) {
+	ctx := s.ctx
+	oldInterval := fileReloadInterval
+	fileReloadInterval = 50 * time.Millisecond
+	defer func() { fileReloadInterval = oldInterval }()
+	be, err := NewFileBackend(ctx, s.path, EventOptions{})
+	c.Assert(err, check.IsNil)
+	s.writeRoutes(c, `
+frontends:
+  f1.com:
+    backends:
+      - srv3
+`)
+	// Make sure the modification time changes even on filesystems with
+	// coarse timestamps.
+	future := time.Now().Add(time.Minute)
+	err = os.Chtimes(s.path, future, future)
+	c.Assert(err, check.IsNil)
+	timeout := time.After(5 * time.Second)
+	for {
+		frontend, err := be.Frontend(ctx, "f1.com")
+		c.Assert(err, check.IsNil)
+		if len(frontend.URLs()) == 1 {
+			c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv3"})
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for routes reload")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (s *FileSuite) TestReloadInvalidKeepsRoutes(c *check.C) {
+	ctx := context.Background()
+	be := s.be.(*fileBackend)
+	s.writeRoutes(c, "frontends: [")
+	future := time.Now().Add(time.Minute)
+	err := os.Chtimes(s.path, future, future)
+	c.Assert(err, check.IsNil)
+	_, err = be.reload()
+	c.Assert(err, check.NotNil)
+	frontend, err := be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv1", "srv2"})
+}
+
+func (s *FileSuite) TestStartMonitorDeadAndBack(c *check.C) {
+	ctx := s.ctx
+	var callCount int32
+	rsp := int32(500)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&callCount, 1)
+		rw.WriteHeader(int(atomic.LoadInt32(&rsp)))
+	}))
+	defer srv.Close()
+	s.writeRoutes(c, `
+frontends:
+  f1.com:
+    backends:
+      - `+srv.URL+`
+    healthcheck:
+      status: 200
+`)
+	be, err := NewFileBackend(ctx, s.path, EventOptions{})
+	c.Assert(err, check.IsNil)
+	err = be.StartMonitor(ctx, MonitorOptions{})
+	c.Assert(err, check.IsNil)
+	defer be.StopMonitor()
+	err = be.MarkDead(ctx, "f1.com", srv.URL, 30)
+	c.Assert(err, check.IsNil)
+	timeout := time.After(10 * time.Second)
+	for atomic.LoadInt32(&callCount) == 0 {
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for healthcheck call")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	frontend, err := be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{0: {}})
+	atomic.StoreInt32(&rsp, 200)
+	for {
+		frontend, err = be.Frontend(ctx, "f1.com")
+		c.Assert(err, check.IsNil)
+		if len(frontend.Dead) == 0 {
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for backend to be alive")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (s *FileSuite) TestStartMonitorStopsPrevious(c *check.C) {
+	ctx := s.ctx
+	s.writeRoutes(c, `
+frontends:
+  f1.com:
+    backends:
+      - srv1
+`)
+	be, err := NewFileBackend(ctx, s.path, EventOptions{})
+	c.Assert(err, check.IsNil)
+	err = be.StartMonitor(ctx, MonitorOptions{})
+	c.Assert(err, check.IsNil)
+	first := be.(*fileBackend).monitor
+	err = be.StartMonitor(ctx, MonitorOptions{})
+	c.Assert(err, check.IsNil)
+	select {
+	case <-first.quit:
+	default:
+		c.Fatal("previous monitor still running")
+	}
+	be.StopMonitor()
+	c.Assert(be.(*fileBackend).monitor, check.IsNil)
+	err = be.MarkDead(ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *FileSuite) TestStartMonitorKeepsDeadTTL(c *check.C) {
+	ctx := s.ctx
+	var callCount int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&callCount, 1)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	s.writeRoutes(c, `
+frontends:
+  f1.com:
+    backends:
+      - `+srv.URL+`
+    healthcheck:
+      status: 200
+`)
+	be, err := NewFileBackend(ctx, s.path, EventOptions{})
+	c.Assert(err, check.IsNil)
+	err = be.StartMonitor(ctx, MonitorOptions{})
+	c.Assert(err, check.IsNil)
+	defer be.StopMonitor()
+	err = be.MarkDead(ctx, "f1.com", srv.URL, 3600)
+	c.Assert(err, check.IsNil)
+	timeout := time.After(10 * time.Second)
+	for atomic.LoadInt32(&callCount) < 2 {
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for healthcheck calls")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	fb := be.(*fileBackend)
+	fb.deadMu.Lock()
+	reviveAt := fb.dead["f1.com"][srv.URL]
+	fb.deadMu.Unlock()
+	c.Assert(reviveAt.After(time.Now().Add(59*time.Minute)), check.Equals, true)
+}
+
+func (s *FileSuite) TestStartRoutesWatcher(c *check.C) {
+	ctx := context.Background()
+	var hosts []string
+	err := s.be.StartRoutesWatcher(ctx, func(host string) {
+		hosts = append(hosts, host)
+	})
+	c.Assert(err, check.IsNil)
+	err = s.be.MarkDead(ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.DeepEquals, []string{"f1.com"})
+	s.writeRoutes(c, `
+frontends:
+  f1.com:
+    backends:
+      - srv1
+      - srv2
+  f2.com:
+    backends:
+      - srv3
+`)
+	future := time.Now().Add(time.Minute)
+	err = os.Chtimes(s.path, future, future)
+	c.Assert(err, check.IsNil)
+	_, err = s.be.(*fileBackend).reload()
+	c.Assert(err, check.IsNil)
+	sort.Strings(hosts)
+	c.Assert(hosts, check.DeepEquals, []string{"empty.com", "f1.com", "f2.com"})
+	s.be.StopRoutesWatcher()
+	err = s.be.MarkDead(ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.HasLen, 3)
+}
+
+func (s *FileSuite) TestStartMonitorInterval(c *check.C) {
+	ctx := s.ctx
+	rsp := int32(500)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(int(atomic.LoadInt32(&rsp)))
+	}))
+	defer srv.Close()
+	s.writeRoutes(c, `
+frontends:
+  f1.com:
+    backends:
+      - `+srv.URL+`
+    healthcheck:
+      status: 200
+`)
+	be, err := NewFileBackend(ctx, s.path, EventOptions{})
+	c.Assert(err, check.IsNil)
+	err = be.StartMonitor(ctx, MonitorOptions{Interval: 50 * time.Millisecond, Rise: 2, Fall: 2})
+	c.Assert(err, check.IsNil)
+	defer be.StopMonitor()
+	waitDead := func(expected int) {
+		timeout := time.After(10 * time.Second)
+		for {
+			frontend, bErr := be.Frontend(ctx, "f1.com")
+			c.Assert(bErr, check.IsNil)
+			if len(frontend.Dead) == expected {
+				return
+			}
+			select {
+			case <-timeout:
+				c.Fatalf("timeout waiting for %d dead backends", expected)
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+	waitDead(1)
+	atomic.StoreInt32(&rsp, 200)
+	waitDead(0)
+}
+
+func (s *FileSuite) TestMarkDeadEmitsEvents(c *check.C) {
+	events := make(chan BackendEvent, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var event BackendEvent
+		c.Check(json.NewDecoder(req.Body).Decode(&event), check.IsNil)
+		event.Time = time.Time{}
+		events <- event
+	}))
+	defer srv.Close()
+	be, err := NewFileBackend(s.ctx, s.path, EventOptions{WebhookURLs: []string{srv.URL}})
+	c.Assert(err, check.IsNil)
+	err = be.MarkDead(s.ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	err = be.MarkDead(s.ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	be.(*fileBackend).removeDead("f1.com", "srv1")
+	be.(*fileBackend).removeDead("f1.com", "srv1")
+	var received []BackendEvent
+	for len(received) < 2 {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-time.After(5 * time.Second):
+			c.Fatal("timeout waiting for webhook")
+		}
+	}
+	sort.Slice(received, func(i, j int) bool { return received[i].Type < received[j].Type })
+	c.Assert(received, check.DeepEquals, []BackendEvent{
+		{Type: BackendAlive, Host: "f1.com", Backend: "srv1", Backends: 2, DeadBackends: 0},
+		{Type: BackendDead, Host: "f1.com", Backend: "srv1", Backends: 2, DeadBackends: 1},
+	})
+	select {
+	case event := <-events:
+		c.Fatalf("unexpected event %#v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (s *FileSuite) TestFrontendOptions(c *check.C) {
+	s.writeRoutes(c, `
+frontends:
+  f1.com:
+    backends:
+      - srv1
+    options:
+      lb: consistent-hash
+      hash-key: cookie:session
+      sticky: true
+      sticky-cookie: srv
+      dial-timeout: 2s
+      timeout: 30s
+      headers:
+        X-Tenant: t1
+      response-headers:
+        X-Frame-Options: DENY
+`)
+	be, err := NewFileBackend(s.ctx, s.path, EventOptions{})
+	c.Assert(err, check.IsNil)
+	frontend, err := be.Frontend(s.ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend, check.DeepEquals, &Frontend{
+		Version:  FrontendVersion,
+		ID:       "f1.com",
+		Backends: []Backend{{URL: "srv1", Weight: 1}},
+		Dead:     map[int]struct{}{},
+		Options: FrontendOptions{
+			LoadBalancer:    LoadBalancerConsistentHash,
+			HashKey:         "cookie:session",
+			Sticky:          true,
+			StickyCookie:    "srv",
+			DialTimeout:     2 * time.Second,
+			RequestTimeout:  30 * time.Second,
+			RequestHeaders:  map[string]string{"X-Tenant": "t1"},
+			ResponseHeaders: map[string]string{"X-Frame-Options": "DENY"},
+		},
+	})
+}
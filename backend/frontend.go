@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FrontendVersion is the version of the Frontend struct returned by
+// RoutesBackend implementations, increased whenever a change to its fields
+// would be misread by older consumers.
+const FrontendVersion = 1
+
+const (
+	// LoadBalancerRoundRobin ignores backend weights.
+	LoadBalancerRoundRobin = "round-robin"
+	// LoadBalancerWeighted uses smooth weighted round robin, the default.
+	LoadBalancerWeighted = "weighted"
+	// LoadBalancerLeastConn picks the backend with the fewest requests in
+	// flight relative to its weight.
+	LoadBalancerLeastConn = "least-conn"
+	// LoadBalancerConsistentHash sends requests with the same hash key to
+	// the same backend.
+	LoadBalancerConsistentHash = "consistent-hash"
+	// LoadBalancerP2C picks the faster of two random backends, comparing
+	// their peak EWMA latency and requests in flight.
+	LoadBalancerP2C = "p2c"
+)
+
+const responseHeaderPrefix = "response-header:"
+
+// Frontend is the routing table entry of a host: its backends, which of them
+// are dead and per frontend options. DeadUntil is when the first of the dead
+// backends is revived, zero if none is dead.
+type Frontend struct {
+	Version   int
+	ID        string
+	Backends  []Backend
+	Dead      map[int]struct{}
+	DeadUntil time.Time
+	Options   FrontendOptions
+}
+
+// Backend is a backend of a frontend, Weight is at least 1.
+type Backend struct {
+	URL    string
+	Weight int
+}
+
+// FrontendOptions override the proxy behavior for a single frontend, zero
+// values keep the global settings. RequestHeaders are added to requests sent
+// to the backends and ResponseHeaders to responses sent to clients. HashKey
+// is the part of the request hashed by the consistent-hash load balancer:
+// ip, path, header:<name> or cookie:<name>. With Sticky clients are sent
+// back to the backend named by the StickyCookie cookie set on their first
+// response, for StickyTTL or the browser session when zero. RateLimit
+// allows that many requests per second from each client, told apart by
+// RateLimitKey, with bursts of up to RateLimitBurst requests.
+type FrontendOptions struct {
+	LoadBalancer    string
+	HashKey         string
+	Sticky          bool
+	StickyCookie    string
+	StickyTTL       time.Duration
+	RateLimit       float64
+	RateLimitBurst  int
+	RateLimitKey    string
+	DialTimeout     time.Duration
+	RequestTimeout  time.Duration
+	RequestHeaders  map[string]string
+	ResponseHeaders map[string]string
+}
+
+func newFrontend(id string, urls []string, weights []int, dead map[int]struct{}, opts FrontendOptions) *Frontend {
+	backends := make([]Backend, len(urls))
+	for i, url := range urls {
+		backends[i] = Backend{URL: url, Weight: 1}
+		if i < len(weights) && weights[i] > 1 {
+			backends[i].Weight = weights[i]
+		}
+	}
+	return &Frontend{
+		Version:  FrontendVersion,
+		ID:       id,
+		Backends: backends,
+		Dead:     dead,
+		Options:  opts,
+	}
+}
+
+// URLs returns the URL of every backend.
+func (f *Frontend) URLs() []string {
+	urls := make([]string, len(f.Backends))
+	for i, backend := range f.Backends {
+		urls[i] = backend.URL
+	}
+	return urls
+}
+
+// Weights returns the weight of every backend.
+func (f *Frontend) Weights() []int {
+	weights := make([]int, len(f.Backends))
+	for i, backend := range f.Backends {
+		weights[i] = backend.Weight
+	}
+	return weights
+}
+
+// parseFrontendOptions reads the fields of an options:<host> hash. Headers
+// are set with header:<name> and response-header:<name> fields.
+func parseFrontendOptions(fields map[string]string) FrontendOptions {
+	opts := FrontendOptions{
+		LoadBalancer:   fields["lb"],
+		HashKey:        fields["hash-key"],
+		StickyCookie:   fields["sticky-cookie"],
+		StickyTTL:      parseDuration(fields["sticky-ttl"]),
+		RateLimitKey:   fields["rate-limit-key"],
+		DialTimeout:    parseDuration(fields["dial-timeout"]),
+		RequestTimeout: parseDuration(fields["timeout"]),
+	}
+	opts.Sticky, _ = strconv.ParseBool(fields["sticky"])
+	opts.RateLimit, _ = strconv.ParseFloat(fields["rate-limit"], 64)
+	opts.RateLimitBurst, _ = strconv.Atoi(fields["rate-limit-burst"])
+	for field, value := range fields {
+		switch {
+		case strings.HasPrefix(field, headerFieldPrefix):
+			if opts.RequestHeaders == nil {
+				opts.RequestHeaders = make(map[string]string)
+			}
+			opts.RequestHeaders[field[len(headerFieldPrefix):]] = value
+		case strings.HasPrefix(field, responseHeaderPrefix):
+			if opts.ResponseHeaders == nil {
+				opts.ResponseHeaders = make(map[string]string)
+			}
+			opts.ResponseHeaders[field[len(responseHeaderPrefix):]] = value
+		}
+	}
+	return opts
+}
+
+// parseWeights returns the weight of each backend, backends without a valid
+// weight have the default weight of 1. A nil slice is returned if no weights
+// are set.
+func parseWeights(backends []string, weightMap map[string]string) []int {
+	if len(weightMap) == 0 {
+		return nil
+	}
+	weights := make([]int, len(backends))
+	for i, backend := range backends {
+		weights[i], _ = strconv.Atoi(weightMap[backend])
+		if weights[i] < 1 {
+			weights[i] = 1
+		}
+	}
+	return weights
+}
@@ -0,0 +1,300 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	defaultHealthcheckTimeout = 15 * time.Second
+	headerFieldPrefix         = "header:"
+	maxHealthcheckBody        = 1 << 20
+
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+	grpcServing         = 1
+)
+
+// hcData configures how the backends of a frontend are checked. probe is one
+// of http (the default), https, tcp or grpc.
+type hcData struct {
+	probe       string
+	path        string
+	method      string
+	headers     map[string]string
+	body        string
+	bodyRegex   string
+	status      int
+	sni         string
+	ca          string
+	timeout     time.Duration
+	grpcService string
+}
+
+// parseHcData reads the fields of a healthcheck:<host> hash, headers are set
+// with header:<name> fields.
+func parseHcData(fields map[string]string) hcData {
+	status, _ := strconv.Atoi(fields["status"])
+	hc := hcData{
+		probe:       fields["type"],
+		path:        fields["path"],
+		method:      fields["method"],
+		body:        fields["body"],
+		bodyRegex:   fields["body-regex"],
+		status:      status,
+		sni:         fields["sni"],
+		ca:          fields["ca"],
+		timeout:     parseDuration(fields["timeout"]),
+		grpcService: fields["grpc-service"],
+	}
+	for field, value := range fields {
+		if !strings.HasPrefix(field, headerFieldPrefix) {
+			continue
+		}
+		if hc.headers == nil {
+			hc.headers = make(map[string]string)
+		}
+		hc.headers[field[len(headerFieldPrefix):]] = value
+	}
+	return hc
+}
+
+// parseDuration accepts durations like 5s as well as a number of seconds.
+func parseDuration(value string) time.Duration {
+	if timeout, err := time.ParseDuration(value); err == nil {
+		return timeout
+	}
+	seconds, _ := strconv.Atoi(value)
+	return time.Duration(seconds) * time.Second
+}
+
+func (hc hcData) check(ctx context.Context, backend string) bool {
+	timeout := hc.timeout
+	if timeout <= 0 {
+		timeout = defaultHealthcheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if !strings.HasPrefix(backend, "http") {
+		backend = "http://" + backend
+	}
+	u, err := url.Parse(backend)
+	if err != nil {
+		return false
+	}
+	switch hc.probe {
+	case "", "http":
+		err = hc.checkHTTP(ctx, u)
+	case "https":
+		u.Scheme = "https"
+		err = hc.checkHTTP(ctx, u)
+	case "tcp":
+		err = hc.checkTCP(ctx, u)
+	case "grpc":
+		err = hc.checkGRPC(ctx, u)
+	default:
+		err = fmt.Errorf("unknown healthcheck type %q", hc.probe)
+	}
+	return err == nil
+}
+
+func (hc hcData) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: hc.sni}
+	if hc.ca != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(hc.ca)) {
+			return nil, errors.New("invalid healthcheck ca")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (hc hcData) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range hc.headers {
+		if strings.EqualFold(name, "host") {
+			req.Host = value
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+	return req, nil
+}
+
+func (hc hcData) checkHTTP(ctx context.Context, u *url.URL) error {
+	tlsConfig, err := hc.tlsConfig()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       (&net.Dialer{}).DialContext,
+			DisableKeepAlives: true,
+			TLSClientConfig:   tlsConfig,
+		},
+	}
+	method := hc.method
+	if method == "" {
+		method = http.MethodGet
+	}
+	url := fmt.Sprintf("%s/%s", strings.TrimRight(u.String(), "/"), strings.TrimLeft(hc.path, "/"))
+	req, err := hc.newRequest(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if hc.status != 0 && rsp.StatusCode != hc.status {
+		return fmt.Errorf("unexpected status %d", rsp.StatusCode)
+	}
+	if hc.body == "" && hc.bodyRegex == "" {
+		return nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxHealthcheckBody))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(data), hc.body) {
+		return errors.New("body mismatch")
+	}
+	if hc.bodyRegex != "" {
+		re, err := regexp.Compile(hc.bodyRegex)
+		if err != nil {
+			return err
+		}
+		if !re.Match(data) {
+			return errors.New("body mismatch")
+		}
+	}
+	return nil
+}
+
+func (hc hcData) checkTCP(ctx context.Context, u *url.URL) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", hostPort(u))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkGRPC implements the gRPC health checking protocol, using TLS for
+// https backends and cleartext HTTP/2 otherwise.
+func (hc hcData) checkGRPC(ctx context.Context, u *url.URL) error {
+	tlsConfig, err := hc.tlsConfig()
+	if err != nil {
+		return err
+	}
+	transport := &http2.Transport{TLSClientConfig: tlsConfig}
+	if u.Scheme != "https" {
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+	}
+	defer transport.CloseIdleConnections()
+	var msg []byte
+	if hc.grpcService != "" {
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, hc.grpcService)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+	target := url.URL{Scheme: u.Scheme, Host: hostPort(u), Path: grpcHealthCheckPath}
+	req, err := hc.newRequest(ctx, http.MethodPost, target.String(), strings.NewReader(string(frame)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	rsp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", rsp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxHealthcheckBody))
+	if err != nil {
+		return err
+	}
+	grpcStatus := rsp.Trailer.Get("Grpc-Status")
+	if grpcStatus == "" {
+		grpcStatus = rsp.Header.Get("Grpc-Status")
+	}
+	if grpcStatus != "0" {
+		return fmt.Errorf("unexpected grpc status %q", grpcStatus)
+	}
+	status, err := grpcHealthStatus(data)
+	if err != nil {
+		return err
+	}
+	if status != grpcServing {
+		return fmt.Errorf("unexpected serving status %d", status)
+	}
+	return nil
+}
+
+// grpcHealthStatus decodes the status of a framed HealthCheckResponse.
+func grpcHealthStatus(data []byte) (uint64, error) {
+	if len(data) < 5 || data[0] != 0 {
+		return 0, errors.New("invalid grpc response")
+	}
+	size := binary.BigEndian.Uint32(data[1:5])
+	msg := data[5:]
+	if uint32(len(msg)) < size {
+		return 0, errors.New("invalid grpc response")
+	}
+	msg = msg[:size]
+	var status uint64
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if num == 1 && typ == protowire.VarintType {
+			status, n = protowire.ConsumeVarint(msg)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return status, nil
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
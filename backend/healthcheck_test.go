@@ -0,0 +1,148 @@
+package backend
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+	"gopkg.in/check.v1"
+)
+
+type HealthcheckSuite struct{}
+
+var _ = check.Suite(&HealthcheckSuite{})
+
+func (s *HealthcheckSuite) TestParseHcData(c *check.C) {
+	hc := parseHcData(map[string]string{
+		"type":         "grpc",
+		"path":         "/health",
+		"method":       "HEAD",
+		"header:Host":  "f1.com",
+		"body-regex":   "^ok$",
+		"status":       "204",
+		"sni":          "f1.internal",
+		"timeout":      "2s",
+		"grpc-service": "svc",
+	})
+	c.Assert(hc, check.DeepEquals, hcData{
+		probe:       "grpc",
+		path:        "/health",
+		method:      "HEAD",
+		headers:     map[string]string{"Host": "f1.com"},
+		bodyRegex:   "^ok$",
+		status:      204,
+		sni:         "f1.internal",
+		timeout:     2 * time.Second,
+		grpcService: "svc",
+	})
+	c.Assert(parseHcData(map[string]string{"timeout": "3"}).timeout, check.Equals, 3*time.Second)
+}
+
+func (s *HealthcheckSuite) TestCheckHTTPMethodAndHeaders(c *check.C) {
+	var method, host, token string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		method, host, token = req.Method, req.Host, req.Header.Get("X-Token")
+		rw.Write([]byte("status: ok, version: 42"))
+	}))
+	defer srv.Close()
+	hc := hcData{
+		method:    "POST",
+		headers:   map[string]string{"Host": "f1.com", "X-Token": "abc"},
+		bodyRegex: `version: \d+`,
+	}
+	c.Assert(hc.check(context.Background(), srv.URL), check.Equals, true)
+	c.Assert(method, check.Equals, "POST")
+	c.Assert(host, check.Equals, "f1.com")
+	c.Assert(token, check.Equals, "abc")
+	hc.bodyRegex = `version: [a-z]+`
+	c.Assert(hc.check(context.Background(), srv.URL), check.Equals, false)
+}
+
+func (s *HealthcheckSuite) TestCheckHTTPTimeout(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer srv.Close()
+	hc := hcData{timeout: 50 * time.Millisecond}
+	c.Assert(hc.check(context.Background(), srv.URL), check.Equals, false)
+}
+
+func (s *HealthcheckSuite) TestCheckHTTPSWithCAAndSNI(c *check.C) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	backend := strings.Replace(srv.URL, "https://", "http://", 1)
+	hc := hcData{probe: "https"}
+	c.Assert(hc.check(context.Background(), backend), check.Equals, false)
+	hc.ca = string(ca)
+	hc.sni = "example.com"
+	c.Assert(hc.check(context.Background(), backend), check.Equals, true)
+	hc.sni = "other.com"
+	c.Assert(hc.check(context.Background(), backend), check.Equals, false)
+}
+
+func (s *HealthcheckSuite) TestCheckTCP(c *check.C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	addr := l.Addr().String()
+	hc := hcData{probe: "tcp"}
+	c.Assert(hc.check(context.Background(), "http://"+addr), check.Equals, true)
+	l.Close()
+	c.Assert(hc.check(context.Background(), "http://"+addr), check.Equals, false)
+}
+
+func (s *HealthcheckSuite) TestCheckUnknownType(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+	hc := hcData{probe: "udp"}
+	c.Assert(hc.check(context.Background(), srv.URL), check.Equals, false)
+}
+
+func (s *HealthcheckSuite) TestCheckGRPC(c *check.C) {
+	statuses := map[string]uint64{"": grpcServing, "svc": grpcServing, "down": 2}
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != grpcHealthCheckPath || req.Header.Get("Content-Type") != "application/grpc" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		frame, err := ioutil.ReadAll(req.Body)
+		c.Check(err, check.IsNil)
+		msg := frame[5:]
+		var service string
+		if len(msg) > 0 {
+			_, _, n := protowire.ConsumeTag(msg)
+			service, _ = protowire.ConsumeString(msg[n:])
+		}
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Trailer", "Grpc-Status")
+		status, ok := statuses[service]
+		if !ok {
+			rw.Header().Set("Grpc-Status", "5")
+			return
+		}
+		rsp := protowire.AppendTag(nil, 1, protowire.VarintType)
+		rsp = protowire.AppendVarint(rsp, status)
+		out := make([]byte, 5, 5+len(rsp))
+		binary.BigEndian.PutUint32(out[1:], uint32(len(rsp)))
+		rw.Write(append(out, rsp...))
+		rw.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer srv.Close()
+	hc := hcData{probe: "grpc"}
+	c.Assert(hc.check(context.Background(), srv.URL), check.Equals, true)
+	hc.grpcService = "svc"
+	c.Assert(hc.check(context.Background(), srv.URL), check.Equals, true)
+	hc.grpcService = "down"
+	c.Assert(hc.check(context.Background(), srv.URL), check.Equals, false)
+	hc.grpcService = "unknown"
+	c.Assert(hc.check(context.Background(), srv.URL), check.Equals, false)
+}
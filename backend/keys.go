@@ -0,0 +1,214 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+)
+
+// redisKeys builds the names of the keys used by the redis backend. When
+// running against a Redis Cluster the host is wrapped in a hash tag so every
+// key belonging to a frontend lands on the same slot, allowing pipelines and
+// transactions touching more than one of them. prefix namespaces every key
+// and channel, allowing several roxxy fleets to share the same Redis.
+//
+// With legacyDead the dead backends are also written in the format of older
+// roxxy versions, allowing them to run alongside newer ones.
+type redisKeys struct {
+	hashTag    bool
+	prefix     string
+	legacyDead bool
+}
+
+const (
+	frontendKeyPrefix     = "frontend:"
+	deadBackendsKeyPrefix = "dead-backends:"
+	deadKeyPrefix         = "dead:"
+	weightKeyPrefix       = "weight:"
+	optionsKeyPrefix      = "options:"
+	tlsKeyPrefix          = "tls:"
+	// reservationKeyPrefix replaces the dead:<host>:<backend> reservations
+	// of older roxxy versions.
+	reservationKeyPrefix = "reservation:"
+)
+
+func (k redisKeys) host(host string) string {
+	if k.hashTag {
+		return "{" + host + "}"
+	}
+	return host
+}
+
+func (k redisKeys) frontend(host string) string {
+	return k.prefix + frontendKeyPrefix + k.host(host)
+}
+
+// deadBackends is the sorted set of the dead backends of host.
+func (k redisKeys) deadBackends(host string) string {
+	return k.prefix + deadBackendsKeyPrefix + k.host(host)
+}
+
+// dead is the set of the list indexes of the dead backends of host, written
+// by older roxxy versions.
+func (k redisKeys) dead(host string) string {
+	return k.prefix + deadKeyPrefix + k.host(host)
+}
+
+func (k redisKeys) weight(host string) string {
+	return k.prefix + weightKeyPrefix + k.host(host)
+}
+
+func (k redisKeys) options(host string) string {
+	return k.prefix + optionsKeyPrefix + k.host(host)
+}
+
+// regexFrontends is the sorted set of regular expressions matched against
+// hosts without a frontend of their own, scored by priority.
+func (k redisKeys) regexFrontends() string {
+	return k.prefix + "frontends:regex"
+}
+
+func (k redisKeys) healthcheck(host string) string {
+	return k.prefix + "healthcheck:" + k.host(host)
+}
+
+// monitors is the sorted set of the roxxy instances running continuous
+// health checks, scored by their last heartbeat in unix milliseconds.
+func (k redisKeys) monitors() string {
+	return k.prefix + "monitors"
+}
+
+// reservation is the key held by the roxxy instance checking backend. It
+// doesn't share the dead prefix, its renewals would be taken as changes to
+// the dead backends of host by keyspace notifications.
+func (k redisKeys) reservation(host, backend string) string {
+	return k.prefix + reservationKeyPrefix + k.host(host) + ":" + backend
+}
+
+// legacyReservation is the reservation key of older roxxy versions. It's
+// read so instances of both versions don't check the same backend, and
+// written as well with legacyDead.
+func (k redisKeys) legacyReservation(host, backend string) string {
+	return k.prefix + deadKeyPrefix + k.host(host) + ":" + backend
+}
+
+// rateLimit is the key holding the rate limit state of a client of host,
+// expiring once its whole burst is available again.
+func (k redisKeys) rateLimit(host, key string) string {
+	return k.prefix + "ratelimit:" + k.host(host) + ":" + key
+}
+
+// frontendPattern matches the frontend keys of every host.
+func (k redisKeys) frontendPattern() string {
+	return escapePattern(k.prefix) + frontendKeyPrefix + "*"
+}
+
+// tls is the key holding the certificate and key of serverName, read by the
+// redis certificate loader. It's never hash tagged.
+func (k redisKeys) tls(serverName string) string {
+	return k.prefix + tlsKeyPrefix + serverName
+}
+
+// tlsPattern matches the tls keys of every server name.
+func (k redisKeys) tlsPattern() string {
+	return escapePattern(k.prefix) + tlsKeyPrefix + "*"
+}
+
+func (k redisKeys) deadChannel() string {
+	return k.prefix + "dead"
+}
+
+// deadMessage is the message published to the dead channel when backend is
+// marked as dead. With legacyDead and a known idx it also holds the list index
+// of backend and the number of backends, required by older roxxy versions.
+func (k redisKeys) deadMessage(host, backend string, idx, backends int) string {
+	msg := host + ";" + backend
+	if !k.legacyDead || idx < 0 {
+		return msg
+	}
+	return fmt.Sprintf("%s;%d;%d", msg, idx, backends)
+}
+
+// routesChannel is the channel where the host of a frontend is published
+// every time roxxy changes its backends or dead backends. An empty host is
+// published when the regex frontends change, as any host may be affected.
+func (k redisKeys) routesChannel() string {
+	return k.prefix + "routes"
+}
+
+// eventsChannel is the channel where backend events are published as JSON.
+func (k redisKeys) eventsChannel() string {
+	return k.prefix + "backend-events"
+}
+
+// keyspacePatterns are the keyspace notification channels for changes made
+// by other clients to frontend, dead, weight, options and regex frontends
+// keys, they are only published if notify-keyspace-events is enabled in
+// redis.
+func (k redisKeys) keyspacePatterns(db int) []string {
+	prefix := fmt.Sprintf("__keyspace@%d__:", db) + escapePattern(k.prefix)
+	return []string{
+		prefix + frontendKeyPrefix + "*",
+		prefix + deadBackendsKeyPrefix + "*",
+		prefix + deadKeyPrefix + "*",
+		prefix + weightKeyPrefix + "*",
+		prefix + optionsKeyPrefix + "*",
+		fmt.Sprintf("__keyspace@%d__:", db) + escapePattern(k.regexFrontends()),
+	}
+}
+
+// isRegexKeyspaceChannel returns whether a keyspace notification channel
+// references the regex frontends key.
+func (k redisKeys) isRegexKeyspaceChannel(channel string) bool {
+	idx := strings.Index(channel, "__:")
+	return idx != -1 && channel[idx+3:] == k.regexFrontends()
+}
+
+// hostFromKeyspaceChannel returns the host of the frontend, dead, weight or
+// options key referenced by a keyspace notification channel.
+func (k redisKeys) hostFromKeyspaceChannel(channel string) string {
+	idx := strings.Index(channel, "__:")
+	if idx == -1 {
+		return ""
+	}
+	return k.hostFromKey(channel[idx+3:])
+}
+
+// hostFromKey returns the host of a frontend, dead, weight or options key.
+func (k redisKeys) hostFromKey(key string) string {
+	if !strings.HasPrefix(key, k.prefix) {
+		return ""
+	}
+	key = key[len(k.prefix):]
+	var host string
+	switch {
+	case strings.HasPrefix(key, frontendKeyPrefix):
+		host = key[len(frontendKeyPrefix):]
+	case strings.HasPrefix(key, deadBackendsKeyPrefix):
+		host = key[len(deadBackendsKeyPrefix):]
+	case strings.HasPrefix(key, deadKeyPrefix):
+		host = key[len(deadKeyPrefix):]
+	case strings.HasPrefix(key, weightKeyPrefix):
+		host = key[len(weightKeyPrefix):]
+	case strings.HasPrefix(key, optionsKeyPrefix):
+		host = key[len(optionsKeyPrefix):]
+	default:
+		return ""
+	}
+	if k.hashTag && strings.HasPrefix(host, "{") && strings.HasSuffix(host, "}") {
+		host = host[1 : len(host)-1]
+	}
+	return host
+}
+
+// escapePattern escapes the glob characters of s, so it is matched literally
+// by SCAN and PSUBSCRIBE patterns.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -2,8 +2,11 @@ package backend
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"strconv"
 	"strings"
 	"time"
@@ -12,19 +15,38 @@ import (
 )
 
 type redisBackend struct {
-	readClient  *redis.Client
-	writeClient *redis.Client
+	readClient  redis.UniversalClient
+	writeClient redis.UniversalClient
+	keys        redisKeys
+	db          int
 	monitor     *redisMonitor
+	watcher     *redisRoutesWatcher
+	events      *eventNotifier
 }
 
+// RedisOptions configures a connection to redis. KeyPrefix is prepended to
+// every key and channel used by roxxy, it must be the same for the read and
+// write connections. With LegacyDeadBackends dead backends are also written
+// in the format read by older roxxy versions, for rolling upgrades.
 type RedisOptions struct {
-	Network       string
-	Host          string
-	Port          int
-	SentinelAddrs string
-	SentinelName  string
-	Password      string
-	DB            int
+	Network                 string
+	Host                    string
+	Port                    int
+	SentinelAddrs           string
+	SentinelName            string
+	ClusterAddrs            string
+	ClusterReadFromReplicas bool
+	Username                string
+	Password                string
+	PasswordFile            string
+	DB                      int
+	TLS                     bool
+	TLSCAFile               string
+	TLSCertFile             string
+	TLSKeyFile              string
+	TLSServerName           string
+	KeyPrefix               string
+	LegacyDeadBackends      bool
 }
 
 const (
@@ -37,7 +59,89 @@ const (
 	maxRetries   = 1
 )
 
-func (opts RedisOptions) Client() (*redis.Client, error) {
+func splitAddrs(addrs string) ([]string, bool) {
+	addresses := strings.Split(addrs, ",")
+	for i := range addresses {
+		addresses[i] = strings.TrimSpace(addresses[i])
+		if addresses[i] == "" {
+			return nil, false
+		}
+	}
+	return addresses, true
+}
+
+func (opts RedisOptions) isCluster() bool {
+	return opts.ClusterAddrs != ""
+}
+
+func (opts RedisOptions) password() (string, error) {
+	if opts.PasswordFile == "" {
+		return opts.Password, nil
+	}
+	data, err := ioutil.ReadFile(opts.PasswordFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (opts RedisOptions) tlsConfig() (*tls.Config, error) {
+	if !opts.TLS && opts.TLSCAFile == "" && opts.TLSCertFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: opts.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.TLSCAFile != "" {
+		data, err := ioutil.ReadFile(opts.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in redis CA file %q", opts.TLSCAFile)
+		}
+	}
+	if opts.TLSCertFile != "" || opts.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (opts RedisOptions) Client() (redis.UniversalClient, error) {
+	password, err := opts.password()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if opts.isCluster() {
+		addresses, ok := splitAddrs(opts.ClusterAddrs)
+		if !ok {
+			return nil, errors.New("redis cluster address cannot be empty")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        addresses,
+			ReadOnly:     opts.ClusterReadFromReplicas,
+			Username:     opts.Username,
+			Password:     password,
+			TLSConfig:    tlsConfig,
+			MaxRetries:   maxRetries,
+			DialTimeout:  dialTimeout,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			PoolSize:     poolSize,
+			PoolTimeout:  poolTimeout,
+			IdleTimeout:  idleTimeout,
+		}), nil
+	}
 	if opts.SentinelAddrs == "" {
 		if opts.Host == "" {
 			opts.Host = "127.0.0.1"
@@ -54,7 +158,9 @@ func (opts RedisOptions) Client() (*redis.Client, error) {
 		return redis.NewClient(&redis.Options{
 			Network:      opts.Network,
 			Addr:         addr,
-			Password:     opts.Password,
+			Username:     opts.Username,
+			Password:     password,
+			TLSConfig:    tlsConfig,
 			DB:           opts.DB,
 			MaxRetries:   maxRetries,
 			DialTimeout:  dialTimeout,
@@ -65,12 +171,9 @@ func (opts RedisOptions) Client() (*redis.Client, error) {
 			IdleTimeout:  idleTimeout,
 		}), nil
 	}
-	addresses := strings.Split(opts.SentinelAddrs, ",")
-	for i := range addresses {
-		addresses[i] = strings.TrimSpace(addresses[i])
-		if addresses[i] == "" {
-			return nil, errors.New("redis sentinel address connot be empty")
-		}
+	addresses, ok := splitAddrs(opts.SentinelAddrs)
+	if !ok {
+		return nil, errors.New("redis sentinel address connot be empty")
 	}
 	if opts.SentinelName == "" {
 		return nil, errors.New("redis sentinel name cannot be empty")
@@ -78,7 +181,9 @@ func (opts RedisOptions) Client() (*redis.Client, error) {
 	return redis.NewFailoverClient(&redis.FailoverOptions{
 		MasterName:    opts.SentinelName,
 		SentinelAddrs: addresses,
-		Password:      opts.Password,
+		Username:      opts.Username,
+		Password:      password,
+		TLSConfig:     tlsConfig,
 		DB:            opts.DB,
 		MaxRetries:    maxRetries,
 		DialTimeout:   dialTimeout,
@@ -90,7 +195,10 @@ func (opts RedisOptions) Client() (*redis.Client, error) {
 	}), nil
 }
 
-func NewRedisBackend(ctx context.Context, readOpts, writeOpts RedisOptions) (RoutesBackend, error) {
+func NewRedisBackend(ctx context.Context, readOpts, writeOpts RedisOptions, events EventOptions) (RoutesBackend, error) {
+	if readOpts.KeyPrefix != writeOpts.KeyPrefix {
+		return nil, fmt.Errorf("read key prefix %q differs from write key prefix %q", readOpts.KeyPrefix, writeOpts.KeyPrefix)
+	}
 	rClient, err := readOpts.Client()
 	if err != nil {
 		return nil, err
@@ -107,54 +215,127 @@ func NewRedisBackend(ctx context.Context, readOpts, writeOpts RedisOptions) (Rou
 	if err != nil {
 		return nil, err
 	}
-	return &redisBackend{
+	b := &redisBackend{
 		readClient:  rClient,
 		writeClient: wClient,
-	}, nil
+		keys: redisKeys{
+			hashTag:    readOpts.isCluster() || writeOpts.isCluster(),
+			prefix:     writeOpts.KeyPrefix,
+			legacyDead: writeOpts.LegacyDeadBackends,
+		},
+		db: writeOpts.DB,
+	}
+	b.events = newEventNotifier(events, func(ctx context.Context, data []byte) error {
+		return b.writeClient.Publish(ctx, b.keys.eventsChannel(), data).Err()
+	})
+	return b, nil
 }
 
 func (b *redisBackend) Healthcheck(ctx context.Context) error {
 	return b.readClient.Ping(ctx).Err()
 }
 
-func (b *redisBackend) Backends(ctx context.Context, host string) (string, []string, map[int]struct{}, error) {
+func (b *redisBackend) Frontend(ctx context.Context, host string) (*Frontend, error) {
 	pipe := b.readClient.Pipeline()
 	defer pipe.Close()
-	rangeVal := pipe.LRange(ctx, "frontend:"+host, 0, -1)
-	membersVal := pipe.SMembers(ctx, "dead:"+host)
+	rangeVal := pipe.LRange(ctx, b.keys.frontend(host), 0, -1)
+	now := time.Now()
+	deadVal := queueDead(ctx, pipe, b.keys, host, now)
+	weightsVal := pipe.HGetAll(ctx, b.keys.weight(host))
+	optionsVal := pipe.HGetAll(ctx, b.keys.options(host))
 	_, err := pipe.Exec(ctx)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
 	}
-	deadMap := map[int]struct{}{}
-	for _, item := range membersVal.Val() {
-		intVal, _ := strconv.ParseInt(item, 10, 32)
-		deadMap[int(intVal)] = struct{}{}
+	var members []string
+	var deadUntil time.Time
+	for member, reviveAt := range deadVal.until(now) {
+		members = append(members, member)
+		if deadUntil.IsZero() || reviveAt.Before(deadUntil) {
+			deadUntil = reviveAt
+		}
 	}
 	backends := rangeVal.Val()
 	if len(backends) < 2 {
-		return "", nil, nil, ErrNoBackends
+		return nil, ErrNoBackends
+	}
+	backends = backends[1:]
+	deadMap := deadIndexes(backends, members)
+	weights := parseWeights(backends, weightsVal.Val())
+	frontend := newFrontend(host, backends, weights, deadMap, parseFrontendOptions(optionsVal.Val()))
+	if len(deadMap) > 0 {
+		frontend.DeadUntil = deadUntil
 	}
-	return host, backends[1:], deadMap, nil
+	return frontend, nil
 }
 
-func (b *redisBackend) MarkDead(ctx context.Context, host string, backend string, backendIdx int, backendLen int, deadTTL int) error {
+// deadIndexes returns the indexes of the dead backends. Members are backend
+// URLs, numeric members are list indexes written by older roxxy versions.
+func deadIndexes(backends []string, members []string) map[int]struct{} {
+	deadMap := map[int]struct{}{}
+	if len(members) == 0 {
+		return deadMap
+	}
+	dead := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		dead[member] = struct{}{}
+	}
+	for i, backend := range backends {
+		if _, ok := dead[backend]; ok {
+			deadMap[i] = struct{}{}
+			continue
+		}
+		if _, ok := dead[strconv.Itoa(i)]; ok {
+			deadMap[i] = struct{}{}
+		}
+	}
+	return deadMap
+}
+
+func (b *redisBackend) RegexFrontends(ctx context.Context) ([]string, error) {
+	return b.readClient.ZRange(ctx, b.keys.regexFrontends(), 0, -1).Result()
+}
+
+func (b *redisBackend) MarkDead(ctx context.Context, host string, backend string, deadTTL int) error {
 	pipe := b.writeClient.Pipeline()
 	defer pipe.Close()
-	deadKey := "dead:" + host
-	pipe.SAdd(ctx, deadKey, backendIdx)
-	pipe.Expire(ctx, deadKey, time.Duration(deadTTL)*time.Second)
+	now := time.Now()
+	reviveAt := now.Add(time.Duration(deadTTL) * time.Second)
+	changed, legacy := queueMarkDead(ctx, pipe, b.keys, host, backend, now, reviveAt)
+	pipe.Publish(ctx, b.keys.routesChannel(), host)
+	backends := pipe.LLen(ctx, b.keys.frontend(host))
+	deadArgs := deadMembersArgs(now)
+	dead := pipe.ZCount(ctx, b.keys.deadBackends(host), deadArgs.Min, deadArgs.Max)
 	_, err := pipe.Exec(ctx)
 	if err != nil {
 		return err
 	}
-	deadMsg := fmt.Sprintf("%s;%s;%d;%d", host, backend, backendIdx, backendLen)
-	return b.writeClient.Publish(ctx, "dead", deadMsg).Err()
+	if n, _ := changed.Int64(); n > 0 {
+		b.events.notify(ctx, BackendEvent{
+			Type:         BackendDead,
+			Host:         host,
+			Backend:      backend,
+			Time:         now,
+			Backends:     frontendBackends(backends.Val()),
+			DeadBackends: int(dead.Val()),
+		})
+	}
+	idx, n := legacyIndex(legacy)
+	return b.writeClient.Publish(ctx, b.keys.deadChannel(), b.keys.deadMessage(host, backend, idx, n)).Err()
 }
 
-func (b *redisBackend) StartMonitor(ctx context.Context) error {
+// frontendBackends returns the number of backends of a frontend list with
+// length n, its first entry is the frontend id.
+func frontendBackends(n int64) int {
+	if n < 1 {
+		return 0
+	}
+	return int(n - 1)
+}
+
+func (b *redisBackend) StartMonitor(ctx context.Context, opts MonitorOptions) error {
 	var err error
-	b.monitor, err = newRedisMonitor(ctx, b.writeClient)
+	b.monitor, err = newRedisMonitor(ctx, b.writeClient, b.keys, opts, b.events)
 	return err
 }
 
@@ -163,3 +344,15 @@ func (b *redisBackend) StopMonitor() {
 		b.monitor.stop()
 	}
 }
+
+func (b *redisBackend) StartRoutesWatcher(ctx context.Context, fn func(host string)) error {
+	var err error
+	b.watcher, err = newRedisRoutesWatcher(ctx, b.writeClient, b.keys, b.db, fn)
+	return err
+}
+
+func (b *redisBackend) StopRoutesWatcher() {
+	if b.watcher != nil {
+		b.watcher.stop()
+	}
+}
@@ -2,7 +2,15 @@ package backend
 
 import (
 	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"gopkg.in/check.v1"
@@ -24,12 +32,19 @@ func (s *S) SetUpTest(c *check.C) {
 	s.redisConn = redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 1})
 	val := s.redisConn.Keys(ctx, "frontend:*").Val()
 	val = append(val, s.redisConn.Keys(ctx, "dead:*").Val()...)
+	val = append(val, s.redisConn.Keys(ctx, "dead-backends:*").Val()...)
+	val = append(val, s.redisConn.Keys(ctx, "weight:*").Val()...)
+	val = append(val, s.redisConn.Keys(ctx, "options:*").Val()...)
+	val = append(val, s.redisConn.Keys(ctx, "healthcheck:*").Val()...)
+	val = append(val, s.redisConn.Keys(ctx, "reservation:*").Val()...)
+	val = append(val, s.redisConn.Keys(ctx, "staging:*").Val()...)
+	val = append(val, "frontends:regex", "monitors")
 	var err error
 	if len(val) > 0 {
 		err = s.redisConn.Del(ctx, val...).Err()
 		c.Assert(err, check.IsNil)
 	}
-	s.be, err = NewRedisBackend(ctx, RedisOptions{DB: 1}, RedisOptions{DB: 1})
+	s.be, err = NewRedisBackend(ctx, RedisOptions{DB: 1}, RedisOptions{DB: 1}, EventOptions{})
 	c.Assert(err, check.IsNil)
 }
 
@@ -41,48 +56,493 @@ func (s *S) TestBackends(c *check.C) {
 	ctx := context.Background()
 	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2").Err()
 	c.Assert(err, check.IsNil)
-	key, backends, deadMap, err := s.be.Backends(ctx, "f1.com")
+	frontend, err := s.be.Frontend(ctx, "f1.com")
 	c.Assert(err, check.IsNil)
-	c.Assert(key, check.Equals, "f1.com")
-	c.Assert(backends, check.DeepEquals, []string{"srv1", "srv2"})
-	c.Assert(deadMap, check.DeepEquals, map[int]struct{}{})
+	c.Assert(frontend.ID, check.Equals, "f1.com")
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv1", "srv2"})
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{})
 }
 
 func (s *S) TestBackendsIgnoresName(c *check.C) {
 	ctx := context.Background()
 	err := s.redisConn.RPush(ctx, "frontend:f1.com", "xxxxxxx", "srv1", "srv2").Err()
 	c.Assert(err, check.IsNil)
-	key, backends, deadMap, err := s.be.Backends(ctx, "f1.com")
+	frontend, err := s.be.Frontend(ctx, "f1.com")
 	c.Assert(err, check.IsNil)
-	c.Assert(key, check.Equals, "f1.com")
-	c.Assert(backends, check.DeepEquals, []string{"srv1", "srv2"})
-	c.Assert(deadMap, check.DeepEquals, map[int]struct{}{})
+	c.Assert(frontend.ID, check.Equals, "f1.com")
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv1", "srv2"})
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{})
 }
 
 func (s *S) TestBackendsWithDead(c *check.C) {
 	ctx := context.Background()
 	err := s.redisConn.RPush(ctx, "frontend:f1.com", "xxxxxxx", "srv1", "srv2").Err()
 	c.Assert(err, check.IsNil)
-	err = s.be.MarkDead(ctx, "f1.com", "srv1", 0, 2, 30)
+	err = s.be.MarkDead(ctx, "f1.com", "srv1", 30)
 	c.Assert(err, check.IsNil)
-	err = s.be.MarkDead(ctx, "f1.com", "srv2", 1, 2, 30)
+	err = s.be.MarkDead(ctx, "f1.com", "srv2", 30)
 	c.Assert(err, check.IsNil)
-	key, backends, deadMap, err := s.be.Backends(ctx, "f1.com")
+	frontend, err := s.be.Frontend(ctx, "f1.com")
 	c.Assert(err, check.IsNil)
-	c.Assert(key, check.Equals, "f1.com")
-	c.Assert(backends, check.DeepEquals, []string{"srv1", "srv2"})
-	c.Assert(deadMap, check.DeepEquals, map[int]struct{}{0: {}, 1: {}})
+	c.Assert(frontend.ID, check.Equals, "f1.com")
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv1", "srv2"})
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{0: {}, 1: {}})
+}
+
+func (s *S) TestBackendsWithDeadReordered(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2", "srv3").Err()
+	c.Assert(err, check.IsNil)
+	err = s.be.MarkDead(ctx, "f1.com", "srv2", 30)
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.LRem(ctx, "frontend:f1.com", 1, "srv1").Err()
+	c.Assert(err, check.IsNil)
+	frontend, err := s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv2", "srv3"})
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{0: {}})
+}
+
+func (s *S) TestBackendsWithLegacyDeadIndexes(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2", "srv3").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.SAdd(ctx, "dead:f1.com", "1", "7", "srv3").Err()
+	c.Assert(err, check.IsNil)
+	frontend, err := s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{1: {}, 2: {}})
+}
+
+func (s *S) TestFrontendOptions(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.HSet(ctx, "options:f1.com",
+		"lb", "consistent-hash",
+		"hash-key", "header:X-User",
+		"sticky", "true",
+		"sticky-ttl", "1h",
+		"rate-limit", "0.5",
+		"rate-limit-burst", "10",
+		"rate-limit-key", "header:X-Api-Key",
+		"dial-timeout", "2s",
+		"timeout", "30",
+		"header:X-Tenant", "t1",
+		"response-header:X-Frame-Options", "DENY",
+	).Err()
+	c.Assert(err, check.IsNil)
+	frontend, err := s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend, check.DeepEquals, &Frontend{
+		Version:  FrontendVersion,
+		ID:       "f1.com",
+		Backends: []Backend{{URL: "srv1", Weight: 1}},
+		Dead:     map[int]struct{}{},
+		Options: FrontendOptions{
+			LoadBalancer:    LoadBalancerConsistentHash,
+			HashKey:         "header:X-User",
+			Sticky:          true,
+			StickyTTL:       time.Hour,
+			RateLimit:       0.5,
+			RateLimitBurst:  10,
+			RateLimitKey:    "header:X-Api-Key",
+			DialTimeout:     2 * time.Second,
+			RequestTimeout:  30 * time.Second,
+			RequestHeaders:  map[string]string{"X-Tenant": "t1"},
+			ResponseHeaders: map[string]string{"X-Frame-Options": "DENY"},
+		},
+	})
+}
+
+func (s *S) TestRateLimit(c *check.C) {
+	ctx := context.Background()
+	limiter, ok := s.be.(RateLimiter)
+	c.Assert(ok, check.Equals, true)
+	now := time.Now()
+	for i := 2; i >= 0; i-- {
+		result, err := limiter.RateLimit(ctx, "f1.com", "client1", 2, 3, now)
+		c.Assert(err, check.IsNil)
+		c.Assert(result.Allowed, check.Equals, true)
+		c.Assert(result.Remaining, check.Equals, i)
+	}
+	result, err := limiter.RateLimit(ctx, "f1.com", "client1", 2, 3, now.Add(100*time.Millisecond))
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, RateLimitResult{
+		RetryAfter: 400 * time.Millisecond,
+		Reset:      1400 * time.Millisecond,
+	})
+	result, err = limiter.RateLimit(ctx, "f1.com", "client2", 2, 3, now)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Allowed, check.Equals, true)
+	result, err = limiter.RateLimit(ctx, "f1.com", "client1", 2, 3, now.Add(500*time.Millisecond))
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, RateLimitResult{Allowed: true, Reset: 1500 * time.Millisecond})
+	ttl, err := s.redisConn.PTTL(ctx, "ratelimit:f1.com:client1").Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl > 0, check.Equals, true)
+}
+
+func (s *S) TestBackendsWithWeights(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2", "srv3").Err()
+	c.Assert(err, check.IsNil)
+	frontend, err := s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Weights(), check.DeepEquals, []int{1, 1, 1})
+	err = s.redisConn.HSet(ctx, "weight:f1.com", "srv1", "3", "srv2", "invalid").Err()
+	c.Assert(err, check.IsNil)
+	frontend, err = s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv1", "srv2", "srv3"})
+	c.Assert(frontend.Weights(), check.DeepEquals, []int{3, 1, 1})
+}
+
+func (s *S) TestRegexFrontends(c *check.C) {
+	ctx := context.Background()
+	patterns, err := s.be.RegexFrontends(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(patterns, check.HasLen, 0)
+	err = s.redisConn.ZAdd(ctx, "frontends:regex",
+		&redis.Z{Score: 20, Member: "^b"},
+		&redis.Z{Score: 10, Member: "^a"},
+	).Err()
+	c.Assert(err, check.IsNil)
+	patterns, err = s.be.RegexFrontends(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(patterns, check.DeepEquals, []string{"^a", "^b"})
 }
 
 func (s *S) TestMarkDead(c *check.C) {
 	ctx := context.Background()
 	pubsub := s.redisConn.Subscribe(ctx, "dead")
-	err := s.be.MarkDead(ctx, "f1.com", "url1", 0, 2, 30)
+	defer pubsub.Close()
+	_, err := pubsub.Receive(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.be.MarkDead(ctx, "f1.com", "url1", 30)
+	c.Assert(err, check.IsNil)
+	members, err := s.redisConn.ZRange(ctx, "dead-backends:f1.com", 0, -1).Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(members, check.DeepEquals, []string{"url1"})
+	c.Assert(s.reviveIn(c, "dead-backends:f1.com", "url1") > 29*time.Second, check.Equals, true)
+	ttl, err := s.redisConn.PTTL(ctx, "dead-backends:f1.com").Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl > 29*time.Second && ttl <= 30*time.Second, check.Equals, true)
+	msg, err := pubsub.ReceiveMessage(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(msg.Payload, check.Equals, "f1.com;url1")
+}
+
+func (s *S) TestMarkDeadPublishesEvent(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2").Err()
+	c.Assert(err, check.IsNil)
+	pubsub := s.redisConn.Subscribe(ctx, "backend-events")
+	defer pubsub.Close()
+	_, err = pubsub.Receive(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.be.MarkDead(ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	err = s.be.MarkDead(ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	err = s.be.MarkDead(ctx, "f1.com", "srv2", 30)
+	c.Assert(err, check.IsNil)
+	for _, expected := range []BackendEvent{
+		{Type: BackendDead, Host: "f1.com", Backend: "srv1", Backends: 2, DeadBackends: 1},
+		{Type: BackendDead, Host: "f1.com", Backend: "srv2", Backends: 2, DeadBackends: 2},
+	} {
+		msg, err := pubsub.ReceiveMessage(ctx)
+		c.Assert(err, check.IsNil)
+		var event BackendEvent
+		err = json.Unmarshal([]byte(msg.Payload), &event)
+		c.Assert(err, check.IsNil)
+		c.Assert(event.Time.IsZero(), check.Equals, false)
+		event.Time = time.Time{}
+		c.Assert(event, check.DeepEquals, expected)
+	}
+}
+
+func (s *S) reviveIn(c *check.C, key, member string) time.Duration {
+	score, err := s.redisConn.ZScore(context.Background(), key, member).Result()
+	c.Assert(err, check.IsNil)
+	return time.Until(time.Unix(0, int64(score)*int64(time.Millisecond)))
+}
+
+func (s *S) TestMarkDeadPerBackendExpiry(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2", "srv3").Err()
+	c.Assert(err, check.IsNil)
+	err = s.be.MarkDead(ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	err = s.be.MarkDead(ctx, "f1.com", "srv2", 60)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.reviveIn(c, "dead-backends:f1.com", "srv1") <= 30*time.Second, check.Equals, true)
+	c.Assert(s.reviveIn(c, "dead-backends:f1.com", "srv2") > 59*time.Second, check.Equals, true)
+	ttl, err := s.redisConn.PTTL(ctx, "dead-backends:f1.com").Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl > 59*time.Second, check.Equals, true)
+	err = s.be.MarkDead(ctx, "f1.com", "srv2", 30)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.reviveIn(c, "dead-backends:f1.com", "srv2") > 59*time.Second, check.Equals, true)
+	past := float64(unixMilli(time.Now().Add(-time.Second)))
+	err = s.redisConn.ZAdd(ctx, "dead-backends:f1.com", &redis.Z{Score: past, Member: "srv1"}).Err()
+	c.Assert(err, check.IsNil)
+	frontend, err := s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{1: {}})
+	c.Assert(time.Until(frontend.DeadUntil) > 59*time.Second, check.Equals, true)
+	err = s.be.MarkDead(ctx, "f1.com", "srv3", 30)
+	c.Assert(err, check.IsNil)
+	members, err := s.redisConn.ZRange(ctx, "dead-backends:f1.com", 0, -1).Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(members, check.DeepEquals, []string{"srv3", "srv2"})
+	frontend, err = s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(time.Until(frontend.DeadUntil) <= 30*time.Second, check.Equals, true)
+}
+
+func (s *S) TestMarkDeadKeepsLegacySet(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.SAdd(ctx, "dead:f1.com", "0").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.Expire(ctx, "dead:f1.com", 10*time.Second).Err()
+	c.Assert(err, check.IsNil)
+	frontend, err := s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{0: {}})
+	c.Assert(time.Until(frontend.DeadUntil) <= 10*time.Second, check.Equals, true)
+	err = s.be.MarkDead(ctx, "f1.com", "srv2", 30)
 	c.Assert(err, check.IsNil)
 	members, err := s.redisConn.SMembers(ctx, "dead:f1.com").Result()
 	c.Assert(err, check.IsNil)
 	c.Assert(members, check.DeepEquals, []string{"0"})
+	frontend, err = s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{0: {}, 1: {}})
+	c.Assert(time.Until(frontend.DeadUntil) <= 10*time.Second, check.Equals, true)
+}
+
+func (s *S) TestMarkDeadLegacyDeadBackends(c *check.C) {
+	ctx := context.Background()
+	opts := RedisOptions{DB: 1, LegacyDeadBackends: true}
+	be, err := NewRedisBackend(ctx, opts, opts, EventOptions{})
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2").Err()
+	c.Assert(err, check.IsNil)
+	pubsub := s.redisConn.Subscribe(ctx, "dead")
+	defer pubsub.Close()
+	_, err = pubsub.Receive(ctx)
+	c.Assert(err, check.IsNil)
+	err = be.MarkDead(ctx, "f1.com", "srv2", 30)
+	c.Assert(err, check.IsNil)
+	members, err := s.redisConn.SMembers(ctx, "dead:f1.com").Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(members, check.DeepEquals, []string{"1"})
+	ttl, err := s.redisConn.PTTL(ctx, "dead:f1.com").Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl > 29*time.Second && ttl <= 30*time.Second, check.Equals, true)
+	c.Assert(s.reviveIn(c, "dead-backends:f1.com", "srv2") > 29*time.Second, check.Equals, true)
+	msg, err := pubsub.ReceiveMessage(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(msg.Payload, check.Equals, "f1.com;srv2;1;2")
+	err = be.MarkDead(ctx, "f1.com", "srv3", 30)
+	c.Assert(err, check.IsNil)
+	msg, err = pubsub.ReceiveMessage(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(msg.Payload, check.Equals, "f1.com;srv3")
+}
+
+func (s *S) TestStartRoutesWatcher(c *check.C) {
+	ctx := context.Background()
+	hosts := make(chan string, 10)
+	err := s.be.StartRoutesWatcher(ctx, func(host string) {
+		hosts <- host
+	})
+	c.Assert(err, check.IsNil)
+	defer s.be.StopRoutesWatcher()
+	err = s.be.MarkDead(ctx, "f1.com", "url1", 30)
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.Publish(ctx, "__keyspace@1__:frontend:f2.com", "rpush").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.Publish(ctx, "__keyspace@1__:dead:f3.com", "expired").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.Publish(ctx, "__keyspace@1__:frontends:regex", "zadd").Err()
+	c.Assert(err, check.IsNil)
+	for _, expected := range []string{"f1.com", "f2.com", "f3.com", ""} {
+		select {
+		case host := <-hosts:
+			c.Assert(host, check.Equals, expected)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timeout waiting for %s", expected)
+		}
+	}
+}
+
+func (s *S) TestRoutesWatcherReconnect(c *check.C) {
+	ctx := context.Background()
+	proxy := newRedisProxy(c)
+	defer proxy.close()
+	client := redis.NewClient(&redis.Options{Addr: proxy.listener.Addr().String(), DB: 1})
+	defer client.Close()
+	hosts := make(chan string, 10)
+	w, err := newRedisRoutesWatcher(ctx, client, redisKeys{}, 1, func(host string) {
+		hosts <- host
+	})
+	c.Assert(err, check.IsNil)
+	defer w.stop()
+	proxy.breakConns()
+	select {
+	case host := <-hosts:
+		c.Assert(host, check.Equals, "")
+	case <-time.After(10 * time.Second):
+		c.Fatal("timeout waiting for invalidation after reconnect")
+	}
+}
+
+func (s *S) TestRedisOptionsClientCluster(c *check.C) {
+	opts := RedisOptions{
+		ClusterAddrs:            "10.0.0.1:6379, 10.0.0.2:6379",
+		ClusterReadFromReplicas: true,
+		Password:                "secret",
+	}
+	client, err := opts.Client()
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	clusterClient, ok := client.(*redis.ClusterClient)
+	c.Assert(ok, check.Equals, true)
+	clusterOpts := clusterClient.Options()
+	c.Assert(clusterOpts.Addrs, check.DeepEquals, []string{"10.0.0.1:6379", "10.0.0.2:6379"})
+	c.Assert(clusterOpts.ReadOnly, check.Equals, true)
+	c.Assert(clusterOpts.Password, check.Equals, "secret")
+}
+
+func (s *S) TestRedisOptionsClientClusterEmptyAddr(c *check.C) {
+	opts := RedisOptions{ClusterAddrs: "10.0.0.1:6379,,"}
+	_, err := opts.Client()
+	c.Assert(err, check.ErrorMatches, "redis cluster address cannot be empty")
+}
+
+func (s *S) TestRedisKeys(c *check.C) {
+	keys := redisKeys{}
+	c.Assert(keys.frontend("f1.com"), check.Equals, "frontend:f1.com")
+	c.Assert(keys.dead("f1.com"), check.Equals, "dead:f1.com")
+	c.Assert(keys.deadBackends("f1.com"), check.Equals, "dead-backends:f1.com")
+	c.Assert(keys.healthcheck("f1.com"), check.Equals, "healthcheck:f1.com")
+	c.Assert(keys.reservation("f1.com", "srv1"), check.Equals, "reservation:f1.com:srv1")
+	c.Assert(keys.hostFromKeyspaceChannel("__keyspace@0__:frontend:f1.com"), check.Equals, "f1.com")
+	c.Assert(keys.hostFromKeyspaceChannel("__keyspace@0__:dead:f1.com:8080"), check.Equals, "f1.com:8080")
+	c.Assert(keys.hostFromKeyspaceChannel("__keyspace@0__:dead-backends:f1.com:8080"), check.Equals, "f1.com:8080")
+	c.Assert(keys.hostFromKeyspaceChannel("__keyspace@0__:options:f1.com"), check.Equals, "f1.com")
+	c.Assert(keys.hostFromKeyspaceChannel("__keyspace@0__:tls:f1.com"), check.Equals, "")
+	c.Assert(keys.hostFromKeyspaceChannel("__keyspace@0__:reservation:f1.com:srv1"), check.Equals, "")
+	keys = redisKeys{hashTag: true}
+	c.Assert(keys.frontend("f1.com"), check.Equals, "frontend:{f1.com}")
+	c.Assert(keys.dead("f1.com"), check.Equals, "dead:{f1.com}")
+	c.Assert(keys.deadBackends("f1.com"), check.Equals, "dead-backends:{f1.com}")
+	c.Assert(keys.healthcheck("f1.com"), check.Equals, "healthcheck:{f1.com}")
+	c.Assert(keys.reservation("f1.com", "srv1"), check.Equals, "reservation:{f1.com}:srv1")
+	c.Assert(keys.hostFromKeyspaceChannel("__keyspace@0__:frontend:{f1.com}"), check.Equals, "f1.com")
+	keys = redisKeys{prefix: "staging:"}
+	c.Assert(keys.frontend("f1.com"), check.Equals, "staging:frontend:f1.com")
+	c.Assert(keys.dead("f1.com"), check.Equals, "staging:dead:f1.com")
+	c.Assert(keys.reservation("f1.com", "srv1"), check.Equals, "staging:reservation:f1.com:srv1")
+	c.Assert(keys.regexFrontends(), check.Equals, "staging:frontends:regex")
+	c.Assert(keys.deadChannel(), check.Equals, "staging:dead")
+	c.Assert(keys.routesChannel(), check.Equals, "staging:routes")
+	c.Assert(keys.eventsChannel(), check.Equals, "staging:backend-events")
+	c.Assert(keys.hostFromKeyspaceChannel("__keyspace@0__:staging:frontend:f1.com"), check.Equals, "f1.com")
+	c.Assert(keys.hostFromKeyspaceChannel("__keyspace@0__:frontend:f1.com"), check.Equals, "")
+	c.Assert(keys.keyspacePatterns(0)[0], check.Equals, "__keyspace@0__:staging:frontend:*")
+	c.Assert(redisKeys{prefix: "env[1]:"}.frontendPattern(), check.Equals, `env\[1\]:frontend:*`)
+}
+
+func (s *S) TestKeyPrefix(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "staging:frontend:f1.com", "staging", "srv1").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.RPush(ctx, "frontend:f1.com", "production", "srv2").Err()
+	c.Assert(err, check.IsNil)
+	opts := RedisOptions{DB: 1, KeyPrefix: "staging:"}
+	be, err := NewRedisBackend(ctx, opts, opts, EventOptions{})
+	c.Assert(err, check.IsNil)
+	pubsub := s.redisConn.Subscribe(ctx, "staging:dead")
+	defer pubsub.Close()
+	_, err = pubsub.Receive(ctx)
+	c.Assert(err, check.IsNil)
+	frontend, err := be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv1"})
+	err = be.MarkDead(ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	members, err := s.redisConn.ZRange(ctx, "staging:dead-backends:f1.com", 0, -1).Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(members, check.DeepEquals, []string{"srv1"})
+	c.Assert(s.redisConn.Exists(ctx, "dead-backends:f1.com").Val(), check.Equals, int64(0))
 	msg, err := pubsub.ReceiveMessage(ctx)
 	c.Assert(err, check.IsNil)
-	c.Assert(msg.Payload, check.Equals, "f1.com;url1;0;2")
+	c.Assert(msg.Payload, check.Equals, "f1.com;srv1")
+}
+
+func (s *S) TestKeyPrefixMismatch(c *check.C) {
+	_, err := NewRedisBackend(context.Background(), RedisOptions{DB: 1, KeyPrefix: "a:"}, RedisOptions{DB: 1}, EventOptions{})
+	c.Assert(err, check.ErrorMatches, `read key prefix "a:" differs from write key prefix ""`)
+}
+
+func (s *S) TestRedisOptionsClientPasswordFile(c *check.C) {
+	dir, err := ioutil.TempDir("", "redis-options")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	err = ioutil.WriteFile(passwordFile, []byte("secret\n"), 0o600)
+	c.Assert(err, check.IsNil)
+	opts := RedisOptions{Username: "roxxy", Password: "ignored", PasswordFile: passwordFile}
+	client, err := opts.Client()
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	clientOpts := client.(*redis.Client).Options()
+	c.Assert(clientOpts.Username, check.Equals, "roxxy")
+	c.Assert(clientOpts.Password, check.Equals, "secret")
+	c.Assert(clientOpts.TLSConfig, check.IsNil)
+	opts.PasswordFile = filepath.Join(dir, "missing")
+	_, err = opts.Client()
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestRedisOptionsClientTLS(c *check.C) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "redis-options")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	err = ioutil.WriteFile(caFile, caData, 0o600)
+	c.Assert(err, check.IsNil)
+	opts := RedisOptions{TLSCAFile: caFile, TLSServerName: "redis.internal"}
+	client, err := opts.Client()
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	tlsConfig := client.(*redis.Client).Options().TLSConfig
+	c.Assert(tlsConfig, check.NotNil)
+	c.Assert(tlsConfig.ServerName, check.Equals, "redis.internal")
+	c.Assert(tlsConfig.RootCAs, check.NotNil)
+	opts = RedisOptions{SentinelAddrs: "10.0.0.1:26379", SentinelName: "mymaster", TLS: true}
+	client, err = opts.Client()
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	c.Assert(client.(*redis.Client).Options().TLSConfig, check.NotNil)
+}
+
+func (s *S) TestRedisOptionsClientTLSInvalidCA(c *check.C) {
+	dir, err := ioutil.TempDir("", "redis-options")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile, []byte("invalid"), 0o600)
+	c.Assert(err, check.IsNil)
+	opts := RedisOptions{TLSCAFile: caFile}
+	_, err = opts.Client()
+	c.Assert(err, check.ErrorMatches, `no certificates found in redis CA file .*`)
 }
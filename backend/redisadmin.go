@@ -0,0 +1,355 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// maxTxAttempts is how many times a change is attempted when the frontend is
+// modified by someone else between reading and writing it.
+const maxTxAttempts = 5
+
+// RedisAdmin manages the routes stored in redis. Every change is made in a
+// transaction watching the frontend list, so concurrent edits are never lost
+// or interleaved, and is published to the routes channel so roxxy instances
+// evict the frontend from their caches. Marking backends as dead or reviving
+// them emits backend events, like roxxy instances do.
+type RedisAdmin struct {
+	client redis.UniversalClient
+	keys   redisKeys
+	events *eventNotifier
+}
+
+// RouteStatus is the current state of a frontend, Healthcheck and Options
+// hold the raw fields of its healthcheck:<host> and options:<host> hashes.
+type RouteStatus struct {
+	Host        string
+	ID          string
+	Backends    []BackendStatus
+	Healthcheck map[string]string
+	Options     map[string]string
+}
+
+// BackendStatus is the current state of a backend. DeadUntil is zero for
+// backends alive and CheckedBy is the roxxy instance health checking it, if
+// any.
+type BackendStatus struct {
+	URL       string
+	Weight    int
+	DeadUntil time.Time
+	CheckedBy string
+}
+
+func NewRedisAdmin(ctx context.Context, opts RedisOptions, events EventOptions) (*RedisAdmin, error) {
+	client, err := opts.Client()
+	if err != nil {
+		return nil, err
+	}
+	err = client.Ping(ctx).Err()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	a := &RedisAdmin{
+		client: client,
+		keys: redisKeys{
+			hashTag:    opts.isCluster(),
+			prefix:     opts.KeyPrefix,
+			legacyDead: opts.LegacyDeadBackends,
+		},
+	}
+	a.events = newEventNotifier(events, func(ctx context.Context, data []byte) error {
+		return a.client.Publish(ctx, a.keys.eventsChannel(), data).Err()
+	})
+	return a, nil
+}
+
+// Close waits for pending event deliveries before closing the connection.
+func (a *RedisAdmin) Close() error {
+	a.events.wait()
+	return a.client.Close()
+}
+
+// Routes returns the sorted hosts of every frontend.
+func (a *RedisAdmin) Routes(ctx context.Context) ([]string, error) {
+	hosts, err := scanHosts(ctx, a.client, a.keys)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// Route returns the backends of host along with their dead and health check
+// state.
+func (a *RedisAdmin) Route(ctx context.Context, host string) (*RouteStatus, error) {
+	now := time.Now()
+	pipe := a.client.Pipeline()
+	defer pipe.Close()
+	rangeVal := pipe.LRange(ctx, a.keys.frontend(host), 0, -1)
+	deadVal := queueDead(ctx, pipe, a.keys, host, now)
+	weightsVal := pipe.HGetAll(ctx, a.keys.weight(host))
+	healthcheckVal := pipe.HGetAll(ctx, a.keys.healthcheck(host))
+	optionsVal := pipe.HGetAll(ctx, a.keys.options(host))
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries := rangeVal.Val()
+	if len(entries) == 0 {
+		return nil, ErrFrontendNotFound
+	}
+	deadUntil := deadVal.until(now)
+	backends := entries[1:]
+	weights := parseWeights(backends, weightsVal.Val())
+	status := &RouteStatus{
+		Host:        host,
+		ID:          entries[0],
+		Backends:    make([]BackendStatus, len(backends)),
+		Healthcheck: healthcheckVal.Val(),
+		Options:     optionsVal.Val(),
+	}
+	reservations := make([]*redis.StringCmd, len(backends))
+	legacyReservations := make([]*redis.StringCmd, len(backends))
+	pipe = a.client.Pipeline()
+	defer pipe.Close()
+	for i, backend := range backends {
+		status.Backends[i] = BackendStatus{URL: backend, Weight: 1}
+		if weights != nil {
+			status.Backends[i].Weight = weights[i]
+		}
+		if t, ok := deadUntil[backend]; ok {
+			status.Backends[i].DeadUntil = t
+		} else if t, ok := deadUntil[strconv.Itoa(i)]; ok {
+			status.Backends[i].DeadUntil = t
+		}
+		reservations[i] = pipe.Get(ctx, a.keys.reservation(host, backend))
+		legacyReservations[i] = pipe.Get(ctx, a.keys.legacyReservation(host, backend))
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, reservation := range reservations {
+		status.Backends[i].CheckedBy = reservation.Val()
+		if status.Backends[i].CheckedBy == "" {
+			status.Backends[i].CheckedBy = legacyReservations[i].Val()
+		}
+	}
+	return status, nil
+}
+
+// AddRoute creates the frontend of host, failing if it already exists.
+func (a *RedisAdmin) AddRoute(ctx context.Context, host, id string, backends ...string) error {
+	if id == "" {
+		return errors.New("frontend id cannot be empty")
+	}
+	if hasDuplicates(backends) {
+		return ErrBackendExists
+	}
+	return a.update(ctx, host, func(pipe redis.Pipeliner, entries []string) error {
+		if len(entries) > 0 {
+			return ErrFrontendExists
+		}
+		values := make([]interface{}, 0, len(backends)+1)
+		values = append(values, id)
+		for _, backend := range backends {
+			values = append(values, backend)
+		}
+		pipe.RPush(ctx, a.keys.frontend(host), values...)
+		return nil
+	})
+}
+
+// RemoveRoute removes the frontend of host along with its dead backends,
+// weights, options and health check settings.
+func (a *RedisAdmin) RemoveRoute(ctx context.Context, host string) error {
+	return a.update(ctx, host, func(pipe redis.Pipeliner, entries []string) error {
+		if len(entries) == 0 {
+			return ErrFrontendNotFound
+		}
+		pipe.Del(ctx,
+			a.keys.frontend(host),
+			a.keys.deadBackends(host),
+			a.keys.dead(host),
+			a.keys.weight(host),
+			a.keys.options(host),
+			a.keys.healthcheck(host),
+		)
+		return nil
+	})
+}
+
+// AddBackend appends backend to the frontend of host.
+func (a *RedisAdmin) AddBackend(ctx context.Context, host, backend string) error {
+	return a.update(ctx, host, func(pipe redis.Pipeliner, entries []string) error {
+		if len(entries) == 0 {
+			return ErrFrontendNotFound
+		}
+		if backendIndex(entries, backend) != -1 {
+			return ErrBackendExists
+		}
+		pipe.RPush(ctx, a.keys.frontend(host), backend)
+		return nil
+	})
+}
+
+// RemoveBackend removes backend from the frontend of host, along with its
+// weight and dead state.
+func (a *RedisAdmin) RemoveBackend(ctx context.Context, host, backend string) error {
+	return a.update(ctx, host, func(pipe redis.Pipeliner, entries []string) error {
+		if len(entries) == 0 {
+			return ErrFrontendNotFound
+		}
+		idx := backendIndex(entries, backend)
+		if idx == -1 {
+			return ErrBackendNotFound
+		}
+		values := make([]interface{}, 0, len(entries)-1)
+		for i, entry := range entries {
+			if i != idx+1 {
+				values = append(values, entry)
+			}
+		}
+		frontend := a.keys.frontend(host)
+		pipe.Del(ctx, frontend)
+		pipe.RPush(ctx, frontend, values...)
+		queueRevive(ctx, pipe, a.keys, host, backend, "", time.Now())
+		queueRemoveLegacyIndex(ctx, pipe, a.keys, host, idx)
+		pipe.HDel(ctx, a.keys.weight(host), backend)
+		return nil
+	})
+}
+
+// MarkDead marks backend as dead for ttl. Roxxy instances running the active
+// healthcheck start checking it right away.
+func (a *RedisAdmin) MarkDead(ctx context.Context, host, backend string, ttl time.Duration) error {
+	var event BackendEvent
+	var changed *redis.Cmd
+	var dead *redis.IntCmd
+	err := a.update(ctx, host, func(pipe redis.Pipeliner, entries []string) error {
+		if len(entries) == 0 {
+			return ErrFrontendNotFound
+		}
+		idx := backendIndex(entries, backend)
+		if idx == -1 {
+			return ErrBackendNotFound
+		}
+		now := time.Now()
+		changed, _ = queueMarkDead(ctx, pipe, a.keys, host, backend, now, now.Add(ttl))
+		deadArgs := deadMembersArgs(now)
+		dead = pipe.ZCount(ctx, a.keys.deadBackends(host), deadArgs.Min, deadArgs.Max)
+		pipe.Publish(ctx, a.keys.deadChannel(), a.keys.deadMessage(host, backend, idx, len(entries)-1))
+		event = BackendEvent{
+			Type:     BackendDead,
+			Host:     host,
+			Backend:  backend,
+			Time:     now,
+			Backends: frontendBackends(int64(len(entries))),
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if n, _ := changed.Int64(); n > 0 {
+		event.DeadBackends = int(dead.Val())
+		a.events.notify(ctx, event)
+	}
+	return nil
+}
+
+// Revive removes backend from the dead backends of host.
+func (a *RedisAdmin) Revive(ctx context.Context, host, backend string) error {
+	var event BackendEvent
+	var changed *redis.Cmd
+	var dead *redis.IntCmd
+	err := a.update(ctx, host, func(pipe redis.Pipeliner, entries []string) error {
+		if len(entries) == 0 {
+			return ErrFrontendNotFound
+		}
+		idx := backendIndex(entries, backend)
+		if idx == -1 {
+			return ErrBackendNotFound
+		}
+		now := time.Now()
+		// The index is removed as well to revive backends marked as dead by
+		// older roxxy versions.
+		changed = queueRevive(ctx, pipe, a.keys, host, backend, strconv.Itoa(idx), now)
+		deadArgs := deadMembersArgs(now)
+		dead = pipe.ZCount(ctx, a.keys.deadBackends(host), deadArgs.Min, deadArgs.Max)
+		event = BackendEvent{
+			Type:     BackendAlive,
+			Host:     host,
+			Backend:  backend,
+			Time:     now,
+			Backends: frontendBackends(int64(len(entries))),
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if n, _ := changed.Int64(); n > 0 {
+		event.DeadBackends = int(dead.Val())
+		a.events.notify(ctx, event)
+	}
+	return nil
+}
+
+// update runs fn in a transaction watching the frontend of host, entries is
+// the frontend list read inside the transaction. Once the commands queued by
+// fn are applied host is published to the routes channel.
+func (a *RedisAdmin) update(ctx context.Context, host string, fn func(pipe redis.Pipeliner, entries []string) error) error {
+	frontend := a.keys.frontend(host)
+	txf := func(tx *redis.Tx) error {
+		entries, err := tx.LRange(ctx, frontend, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			err := fn(pipe, entries)
+			if err != nil {
+				return err
+			}
+			pipe.Publish(ctx, a.keys.routesChannel(), host)
+			return nil
+		})
+		return err
+	}
+	var err error
+	for i := 0; i < maxTxAttempts; i++ {
+		err = a.client.Watch(ctx, txf, frontend)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+// backendIndex returns the index of backend in the backends of a frontend
+// list, whose first entry is the frontend id, or -1 if it's not found.
+func backendIndex(entries []string, backend string) int {
+	for i := 1; i < len(entries); i++ {
+		if entries[i] == backend {
+			return i - 1
+		}
+	}
+	return -1
+}
+
+func hasDuplicates(values []string) bool {
+	seen := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		if _, ok := seen[value]; ok {
+			return true
+		}
+		seen[value] = struct{}{}
+	}
+	return false
+}
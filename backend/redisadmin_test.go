@@ -0,0 +1,234 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) newAdmin(c *check.C) *RedisAdmin {
+	admin, err := NewRedisAdmin(context.Background(), RedisOptions{DB: 1}, EventOptions{})
+	c.Assert(err, check.IsNil)
+	return admin
+}
+
+func (s *S) TestAdminAddRoute(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	pubsub := s.redisConn.Subscribe(ctx, "routes")
+	defer pubsub.Close()
+	_, err := pubsub.Receive(ctx)
+	c.Assert(err, check.IsNil)
+	err = admin.AddRoute(ctx, "f1.com", "myapp", "srv1", "srv2")
+	c.Assert(err, check.IsNil)
+	entries, err := s.redisConn.LRange(ctx, "frontend:f1.com", 0, -1).Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.DeepEquals, []string{"myapp", "srv1", "srv2"})
+	msg, err := pubsub.ReceiveMessage(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(msg.Payload, check.Equals, "f1.com")
+	err = admin.AddRoute(ctx, "f1.com", "other")
+	c.Assert(err, check.Equals, ErrFrontendExists)
+	err = admin.AddRoute(ctx, "f2.com", "")
+	c.Assert(err, check.ErrorMatches, "frontend id cannot be empty")
+	err = admin.AddRoute(ctx, "f2.com", "myapp", "srv1", "srv1")
+	c.Assert(err, check.Equals, ErrBackendExists)
+	c.Assert(s.redisConn.Exists(ctx, "frontend:f2.com").Val(), check.Equals, int64(0))
+}
+
+func (s *S) TestAdminRemoveRoute(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	err := admin.AddRoute(ctx, "f1.com", "myapp", "srv1")
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.HSet(ctx, "healthcheck:f1.com", "path", "/health").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.HSet(ctx, "weight:f1.com", "srv1", "2").Err()
+	c.Assert(err, check.IsNil)
+	err = admin.RemoveRoute(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	n, err := s.redisConn.Exists(ctx, "frontend:f1.com", "weight:f1.com", "healthcheck:f1.com").Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, int64(0))
+	err = admin.RemoveRoute(ctx, "f1.com")
+	c.Assert(err, check.Equals, ErrFrontendNotFound)
+}
+
+func (s *S) TestAdminAddAndRemoveBackend(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	err := admin.AddBackend(ctx, "f1.com", "srv1")
+	c.Assert(err, check.Equals, ErrFrontendNotFound)
+	err = admin.AddRoute(ctx, "f1.com", "myapp", "srv1")
+	c.Assert(err, check.IsNil)
+	err = admin.AddBackend(ctx, "f1.com", "srv2")
+	c.Assert(err, check.IsNil)
+	err = admin.AddBackend(ctx, "f1.com", "srv2")
+	c.Assert(err, check.Equals, ErrBackendExists)
+	err = admin.AddBackend(ctx, "f1.com", "myapp")
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.HSet(ctx, "weight:f1.com", "srv1", "3", "srv2", "2").Err()
+	c.Assert(err, check.IsNil)
+	err = admin.MarkDead(ctx, "f1.com", "srv1", time.Minute)
+	c.Assert(err, check.IsNil)
+	err = admin.RemoveBackend(ctx, "f1.com", "srv1")
+	c.Assert(err, check.IsNil)
+	entries, err := s.redisConn.LRange(ctx, "frontend:f1.com", 0, -1).Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.DeepEquals, []string{"myapp", "srv2", "myapp"})
+	weights, err := s.redisConn.HGetAll(ctx, "weight:f1.com").Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(weights, check.DeepEquals, map[string]string{"srv2": "2"})
+	c.Assert(s.redisConn.ZCard(ctx, "dead-backends:f1.com").Val(), check.Equals, int64(0))
+	err = admin.RemoveBackend(ctx, "f1.com", "srv1")
+	c.Assert(err, check.Equals, ErrBackendNotFound)
+	err = admin.RemoveBackend(ctx, "f1.com", "myapp")
+	c.Assert(err, check.IsNil)
+	entries, err = s.redisConn.LRange(ctx, "frontend:f1.com", 0, -1).Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.DeepEquals, []string{"myapp", "srv2"})
+}
+
+func (s *S) TestAdminRemoveBackendShiftsLegacyDeadIndexes(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2", "srv3", "srv4").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.SAdd(ctx, "dead:f1.com", "0", "1", "3").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.Expire(ctx, "dead:f1.com", time.Minute).Err()
+	c.Assert(err, check.IsNil)
+	err = admin.RemoveBackend(ctx, "f1.com", "srv2")
+	c.Assert(err, check.IsNil)
+	members, err := s.redisConn.SMembers(ctx, "dead:f1.com").Result()
+	c.Assert(err, check.IsNil)
+	sort.Strings(members)
+	c.Assert(members, check.DeepEquals, []string{"0", "2"})
+	ttl, err := s.redisConn.PTTL(ctx, "dead:f1.com").Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl > 59*time.Second, check.Equals, true)
+	frontend, err := s.be.Frontend(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(frontend.URLs(), check.DeepEquals, []string{"srv1", "srv3", "srv4"})
+	c.Assert(frontend.Dead, check.DeepEquals, map[int]struct{}{0: {}, 2: {}})
+}
+
+func (s *S) TestAdminMarkDeadAndRevive(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	err := admin.AddRoute(ctx, "f1.com", "myapp", "srv1", "srv2")
+	c.Assert(err, check.IsNil)
+	pubsub := s.redisConn.Subscribe(ctx, "dead")
+	defer pubsub.Close()
+	_, err = pubsub.Receive(ctx)
+	c.Assert(err, check.IsNil)
+	err = admin.MarkDead(ctx, "f1.com", "srv3", time.Minute)
+	c.Assert(err, check.Equals, ErrBackendNotFound)
+	err = admin.MarkDead(ctx, "f1.com", "srv2", time.Minute)
+	c.Assert(err, check.IsNil)
+	msg, err := pubsub.ReceiveMessage(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(msg.Payload, check.Equals, "f1.com;srv2")
+	c.Assert(s.reviveIn(c, "dead-backends:f1.com", "srv2") > 59*time.Second, check.Equals, true)
+	err = s.redisConn.Set(ctx, "reservation:f1.com:srv2", "roxxy1", time.Minute).Err()
+	c.Assert(err, check.IsNil)
+	defer s.redisConn.Del(ctx, "reservation:f1.com:srv2")
+	status, err := admin.Route(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(status.ID, check.Equals, "myapp")
+	c.Assert(status.Backends, check.HasLen, 2)
+	c.Assert(status.Backends[0], check.DeepEquals, BackendStatus{URL: "srv1", Weight: 1})
+	c.Assert(status.Backends[1].CheckedBy, check.Equals, "roxxy1")
+	deadFor := time.Until(status.Backends[1].DeadUntil)
+	c.Assert(deadFor > 59*time.Second && deadFor <= time.Minute, check.Equals, true)
+	err = admin.Revive(ctx, "f1.com", "srv2")
+	c.Assert(err, check.IsNil)
+	status, err = admin.Route(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(status.Backends[1].DeadUntil.IsZero(), check.Equals, true)
+}
+
+func (s *S) TestAdminMarkDeadAndRevivePublishEvents(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	err := admin.AddRoute(ctx, "f1.com", "myapp", "srv1", "srv2")
+	c.Assert(err, check.IsNil)
+	pubsub := s.redisConn.Subscribe(ctx, "backend-events")
+	defer pubsub.Close()
+	_, err = pubsub.Receive(ctx)
+	c.Assert(err, check.IsNil)
+	err = admin.MarkDead(ctx, "f1.com", "srv1", time.Minute)
+	c.Assert(err, check.IsNil)
+	err = admin.MarkDead(ctx, "f1.com", "srv1", time.Minute)
+	c.Assert(err, check.IsNil)
+	err = admin.Revive(ctx, "f1.com", "srv1")
+	c.Assert(err, check.IsNil)
+	err = admin.Revive(ctx, "f1.com", "srv1")
+	c.Assert(err, check.IsNil)
+	for _, expected := range []BackendEvent{
+		{Type: BackendDead, Host: "f1.com", Backend: "srv1", Backends: 2, DeadBackends: 1},
+		{Type: BackendAlive, Host: "f1.com", Backend: "srv1", Backends: 2, DeadBackends: 0},
+	} {
+		msg, err := pubsub.ReceiveMessage(ctx)
+		c.Assert(err, check.IsNil)
+		var event BackendEvent
+		err = json.Unmarshal([]byte(msg.Payload), &event)
+		c.Assert(err, check.IsNil)
+		c.Assert(event.Time.IsZero(), check.Equals, false)
+		event.Time = time.Time{}
+		c.Assert(event, check.DeepEquals, expected)
+	}
+	msg, err := pubsub.ReceiveTimeout(ctx, 100*time.Millisecond)
+	c.Assert(err, check.NotNil, check.Commentf("unexpected event %v", msg))
+}
+
+func (s *S) TestAdminRoute(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	_, err := admin.Route(ctx, "f1.com")
+	c.Assert(err, check.Equals, ErrFrontendNotFound)
+	err = admin.AddRoute(ctx, "f1.com", "myapp", "srv1", "srv2")
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.HSet(ctx, "weight:f1.com", "srv2", "4").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.HSet(ctx, "healthcheck:f1.com", "path", "/health").Err()
+	c.Assert(err, check.IsNil)
+	defer s.redisConn.Del(ctx, "healthcheck:f1.com")
+	err = s.redisConn.HSet(ctx, "options:f1.com", "lb", "round-robin").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.SAdd(ctx, "dead:f1.com", "0").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.Expire(ctx, "dead:f1.com", time.Minute).Err()
+	c.Assert(err, check.IsNil)
+	status, err := admin.Route(ctx, "f1.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(status.Host, check.Equals, "f1.com")
+	c.Assert(status.Healthcheck, check.DeepEquals, map[string]string{"path": "/health"})
+	c.Assert(status.Options, check.DeepEquals, map[string]string{"lb": "round-robin"})
+	c.Assert(status.Backends[0].DeadUntil.IsZero(), check.Equals, false)
+	c.Assert(status.Backends[1].DeadUntil.IsZero(), check.Equals, true)
+	c.Assert(status.Backends[1].Weight, check.Equals, 4)
+}
+
+func (s *S) TestAdminRoutes(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	err := admin.AddRoute(ctx, "f2.com", "app2", "srv1")
+	c.Assert(err, check.IsNil)
+	err = admin.AddRoute(ctx, "f1.com", "app1")
+	c.Assert(err, check.IsNil)
+	hosts, err := admin.Routes(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.DeepEquals, []string{"f1.com", "f2.com"})
+}
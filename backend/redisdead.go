@@ -0,0 +1,188 @@
+package backend
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Dead backends are stored in a sorted set scored by the time, in unix
+// milliseconds, each backend is revived. The key itself expires with the last
+// member. Older roxxy versions keep the list indexes of dead backends in a set
+// under another key, expiring as a whole. Both are read, so backends marked as
+// dead by older instances are honored during rolling upgrades, and with
+// legacyDead keys the older set is kept up to date for them as well.
+
+// markDeadScript marks ARGV[3] as dead until ARGV[2], never shortening a
+// later expiry, and returns 1 if the backend wasn't already dead.
+var markDeadScript = redis.NewScript(`
+redis.call('zremrangebyscore', KEYS[1], '-inf', ARGV[1])
+local current = redis.call('zscore', KEYS[1], ARGV[3])
+if current and tonumber(current) >= tonumber(ARGV[2]) then
+	return 0
+end
+local added = redis.call('zadd', KEYS[1], ARGV[2], ARGV[3])
+local last = redis.call('zrange', KEYS[1], -1, -1, 'WITHSCORES')
+redis.call('pexpireat', KEYS[1], last[2])
+return added
+`)
+
+// markLegacyDeadScript adds the index of ARGV[1] in the frontend list KEYS[2]
+// to the legacy dead set KEYS[1], expiring the whole set in ARGV[2]
+// milliseconds like older roxxy versions do. It returns the index, -1 if the
+// backend isn't part of the frontend, and the number of backends.
+var markLegacyDeadScript = redis.NewScript(`
+local backends = redis.call('lrange', KEYS[2], 1, -1)
+for i, backend in ipairs(backends) do
+	if backend == ARGV[1] then
+		redis.call('sadd', KEYS[1], i - 1)
+		redis.call('pexpire', KEYS[1], ARGV[2])
+		return {i - 1, #backends}
+	end
+end
+return {-1, #backends}
+`)
+
+// reviveScript removes ARGV[2] from the dead backends KEYS[1] and, if given,
+// its list index ARGV[3] from the legacy dead set KEYS[2]. It returns how many
+// of them were dead.
+var reviveScript = redis.NewScript(`
+redis.call('zremrangebyscore', KEYS[1], '-inf', ARGV[1])
+local removed = redis.call('zrem', KEYS[1], ARGV[2])
+if ARGV[3] then
+	removed = removed + redis.call('srem', KEYS[2], ARGV[3])
+end
+return removed
+`)
+
+// removeLegacyIndexScript removes the list index ARGV[1] from the legacy dead
+// set KEYS[1], shifting the greater indexes down by one like the backends
+// following it in the frontend list, and keeps the expiry of the set.
+var removeLegacyIndexScript = redis.NewScript(`
+local ttl = redis.call('pttl', KEYS[1])
+local removed = tonumber(ARGV[1])
+local shifted = {}
+for _, member in ipairs(redis.call('smembers', KEYS[1])) do
+	local idx = tonumber(member)
+	if idx and idx >= removed then
+		redis.call('srem', KEYS[1], member)
+		if idx > removed then
+			table.insert(shifted, idx - 1)
+		end
+	end
+end
+if #shifted > 0 then
+	redis.call('sadd', KEYS[1], unpack(shifted))
+	if ttl > 0 then
+		redis.call('pexpire', KEYS[1], ttl)
+	end
+end
+return #shifted
+`)
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// deadMembersArgs returns the ZRANGEBYSCORE arguments selecting the backends
+// still dead at now.
+func deadMembersArgs(now time.Time) *redis.ZRangeBy {
+	return &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(unixMilli(now), 10),
+		Max: "+inf",
+	}
+}
+
+// deadCmds reads the dead backends of a frontend in a pipeline.
+type deadCmds struct {
+	members   *redis.ZSliceCmd
+	legacy    *redis.StringSliceCmd
+	legacyTTL *redis.DurationCmd
+}
+
+func queueDead(ctx context.Context, pipe redis.Pipeliner, keys redisKeys, host string, now time.Time) deadCmds {
+	return deadCmds{
+		members:   pipe.ZRangeByScoreWithScores(ctx, keys.deadBackends(host), deadMembersArgs(now)),
+		legacy:    pipe.SMembers(ctx, keys.dead(host)),
+		legacyTTL: pipe.PTTL(ctx, keys.dead(host)),
+	}
+}
+
+// until returns when each dead backend is revived, keyed by backend URL or, for
+// backends marked as dead by older roxxy versions, by list index.
+func (c deadCmds) until(now time.Time) map[string]time.Time {
+	deadUntil := make(map[string]time.Time)
+	for _, member := range c.legacy.Val() {
+		// Legacy sets written by roxxy always expire, the members of one
+		// without a ttl are taken as about to be revived.
+		deadUntil[member] = now.Add(c.legacyTTL.Val())
+	}
+	for _, z := range c.members.Val() {
+		deadUntil[z.Member.(string)] = time.Unix(0, int64(z.Score)*int64(time.Millisecond))
+	}
+	return deadUntil
+}
+
+// deadMembers returns the backends dead at now, by URL or list index.
+func deadMembers(ctx context.Context, client redis.Cmdable, keys redisKeys, host string, now time.Time) ([]string, error) {
+	pipe := client.Pipeline()
+	defer pipe.Close()
+	cmds := queueDead(ctx, pipe, keys, host, now)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadUntil := cmds.until(now)
+	members := make([]string, 0, len(deadUntil))
+	for member := range deadUntil {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// queueMarkDead marks backend of host as dead until reviveAt. With legacyDead
+// keys its index is also added to the legacy dead set, returned by the
+// legacy command, otherwise legacy is nil.
+func queueMarkDead(ctx context.Context, pipe redis.Pipeliner, keys redisKeys, host, backend string, now, reviveAt time.Time) (changed, legacy *redis.Cmd) {
+	changed = markDeadScript.Eval(ctx, pipe, []string{keys.deadBackends(host)}, unixMilli(now), unixMilli(reviveAt), backend)
+	if keys.legacyDead {
+		ttl := reviveAt.Sub(now).Milliseconds()
+		legacy = markLegacyDeadScript.Eval(ctx, pipe, []string{keys.dead(host), keys.frontend(host)}, backend, ttl)
+	}
+	return changed, legacy
+}
+
+// legacyIndex returns the list index of a backend marked as dead and the
+// number of backends of its frontend, read from the result of
+// markLegacyDeadScript. The index is -1 if the legacy set wasn't written.
+func legacyIndex(legacy *redis.Cmd) (idx, backends int) {
+	if legacy == nil {
+		return -1, 0
+	}
+	values, _ := legacy.Slice()
+	if len(values) != 2 {
+		return -1, 0
+	}
+	i, _ := values[0].(int64)
+	n, _ := values[1].(int64)
+	return int(i), int(n)
+}
+
+// queueRevive revives backend of host, removing its list index idx, if not
+// empty, from the legacy dead set.
+func queueRevive(ctx context.Context, pipe redis.Pipeliner, keys redisKeys, host, backend, idx string, now time.Time) *redis.Cmd {
+	args := []interface{}{unixMilli(now), backend}
+	if idx != "" {
+		args = append(args, idx)
+	}
+	return reviveScript.Eval(ctx, pipe, []string{keys.deadBackends(host), keys.dead(host)}, args...)
+}
+
+// queueRemoveLegacyIndex removes the list index idx of a backend removed from
+// host from the legacy dead set, so the indexes of the backends after it
+// still match their new positions.
+func queueRemoveLegacyIndex(ctx context.Context, pipe redis.Pipeliner, keys redisKeys, host string, idx int) *redis.Cmd {
+	return removeLegacyIndexScript.Eval(ctx, pipe, []string{keys.dead(host)}, idx)
+}
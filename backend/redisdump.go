@@ -0,0 +1,398 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"gopkg.in/yaml.v3"
+)
+
+// RoutesDumpVersion is the version of the RoutesDump documents written by
+// Export, documents with a newer version are refused by Import.
+const RoutesDumpVersion = 1
+
+const (
+	RouteAdded   = "add"
+	RouteUpdated = "update"
+	RouteRemoved = "remove"
+)
+
+// RoutesDump is a backup of the routes stored in redis. Regex lists the regex
+// frontends in priority order and TLS is only set when certificates are
+// exported.
+type RoutesDump struct {
+	Version   int                     `json:"version" yaml:"version"`
+	Frontends map[string]FrontendDump `json:"frontends" yaml:"frontends"`
+	Regex     []string                `json:"regex,omitempty" yaml:"regex,omitempty"`
+	TLS       map[string]TLSDump      `json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+// FrontendDump is a frontend of a RoutesDump. Healthcheck and Options hold the
+// raw fields of the healthcheck:<host> and options:<host> hashes.
+type FrontendDump struct {
+	ID          string            `json:"id" yaml:"id"`
+	Backends    []string          `json:"backends" yaml:"backends"`
+	Weights     map[string]int    `json:"weights,omitempty" yaml:"weights,omitempty"`
+	Healthcheck map[string]string `json:"healthcheck,omitempty" yaml:"healthcheck,omitempty"`
+	Options     map[string]string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// UnmarshalYAML also accepts frontends written as hipache lists, the frontend
+// id followed by its backends.
+func (f *FrontendDump) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var entries []string
+		err := value.Decode(&entries)
+		if err != nil {
+			return err
+		}
+		*f = FrontendDump{}
+		if len(entries) > 0 {
+			f.ID = entries[0]
+			f.Backends = entries[1:]
+		}
+		return nil
+	}
+	type frontendDump FrontendDump
+	return value.Decode((*frontendDump)(f))
+}
+
+// diff describes the fields changed from f to updated, one per line.
+func (f FrontendDump) diff(updated FrontendDump) []string {
+	var fields []string
+	if f.ID != updated.ID {
+		fields = append(fields, fmt.Sprintf("id: %q -> %q", f.ID, updated.ID))
+	}
+	if len(f.Backends) != len(updated.Backends) || len(f.Backends) > 0 && !reflect.DeepEqual(f.Backends, updated.Backends) {
+		fields = append(fields, fmt.Sprintf("backends: %q -> %q", f.Backends, updated.Backends))
+	}
+	fields = append(fields, diffFields("weights", weightFields(f.Weights), weightFields(updated.Weights))...)
+	fields = append(fields, diffFields("healthcheck", f.Healthcheck, updated.Healthcheck)...)
+	fields = append(fields, diffFields("options", f.Options, updated.Options)...)
+	return fields
+}
+
+// diffFields describes the fields of the hash name changed from old to
+// updated, in field order.
+func diffFields(name string, old, updated map[string]string) []string {
+	keys := make([]string, 0, len(old)+len(updated))
+	for key := range old {
+		keys = append(keys, key)
+	}
+	for key := range updated {
+		if _, ok := old[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var fields []string
+	for _, key := range keys {
+		oldValue, hadOld := old[key]
+		value, ok := updated[key]
+		if hadOld == ok && oldValue == value {
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s[%s]: %s -> %s", name, key, fieldValue(oldValue, hadOld), fieldValue(value, ok)))
+	}
+	return fields
+}
+
+func fieldValue(value string, ok bool) string {
+	if !ok {
+		return "(unset)"
+	}
+	return strconv.Quote(value)
+}
+
+func weightFields(weights map[string]int) map[string]string {
+	fields := make(map[string]string, len(weights))
+	for backend, weight := range weights {
+		fields[backend] = strconv.Itoa(weight)
+	}
+	return fields
+}
+
+type TLSDump struct {
+	Certificate string `json:"certificate" yaml:"certificate"`
+	Key         string `json:"key" yaml:"key"`
+}
+
+// RouteChange is a change applied, or to be applied in a dry run, by Import.
+// Kind is frontend, regex or tls. Fields describes what changed in updated
+// frontends and regex lists, one line per field.
+type RouteChange struct {
+	Action string
+	Kind   string
+	Name   string
+	Fields []string
+}
+
+func (c RouteChange) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", c.Action, c.Kind, c.Name)
+	for _, field := range c.Fields {
+		fmt.Fprintf(&b, "\n  %s", field)
+	}
+	return b.String()
+}
+
+// ImportOptions configures Import. With DryRun the changes are only
+// returned, with Prune frontends missing from the dump are removed.
+type ImportOptions struct {
+	DryRun bool
+	Prune  bool
+}
+
+// Export dumps every frontend, the regex frontends and, with withTLS, the
+// certificates stored in redis.
+func (a *RedisAdmin) Export(ctx context.Context, withTLS bool) (*RoutesDump, error) {
+	hosts, err := a.Routes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pipe := a.client.Pipeline()
+	defer pipe.Close()
+	type frontendCmds struct {
+		entries     *redis.StringSliceCmd
+		weights     *redis.StringStringMapCmd
+		healthcheck *redis.StringStringMapCmd
+		options     *redis.StringStringMapCmd
+	}
+	cmds := make([]frontendCmds, len(hosts))
+	for i, host := range hosts {
+		cmds[i] = frontendCmds{
+			entries:     pipe.LRange(ctx, a.keys.frontend(host), 0, -1),
+			weights:     pipe.HGetAll(ctx, a.keys.weight(host)),
+			healthcheck: pipe.HGetAll(ctx, a.keys.healthcheck(host)),
+			options:     pipe.HGetAll(ctx, a.keys.options(host)),
+		}
+	}
+	regexVal := pipe.ZRange(ctx, a.keys.regexFrontends(), 0, -1)
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dump := &RoutesDump{
+		Version:   RoutesDumpVersion,
+		Frontends: make(map[string]FrontendDump, len(hosts)),
+		Regex:     regexVal.Val(),
+	}
+	for i, host := range hosts {
+		entries := cmds[i].entries.Val()
+		if len(entries) == 0 {
+			// Removed since it was scanned.
+			continue
+		}
+		frontend := FrontendDump{
+			ID:          entries[0],
+			Backends:    entries[1:],
+			Healthcheck: nonEmpty(cmds[i].healthcheck.Val()),
+			Options:     nonEmpty(cmds[i].options.Val()),
+		}
+		for backend, value := range cmds[i].weights.Val() {
+			weight, err := strconv.Atoi(value)
+			if err != nil {
+				continue
+			}
+			if frontend.Weights == nil {
+				frontend.Weights = make(map[string]int)
+			}
+			frontend.Weights[backend] = weight
+		}
+		dump.Frontends[host] = frontend
+	}
+	if withTLS {
+		dump.TLS, err = a.exportTLS(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dump, nil
+}
+
+func (a *RedisAdmin) exportTLS(ctx context.Context) (map[string]TLSDump, error) {
+	keys, err := scanKeys(ctx, a.client, a.keys.tlsPattern())
+	if err != nil {
+		return nil, err
+	}
+	prefix := a.keys.tls("")
+	pipe := a.client.Pipeline()
+	defer pipe.Close()
+	cmds := make(map[string]*redis.SliceCmd, len(keys))
+	for _, key := range keys {
+		cmds[key[len(prefix):]] = pipe.HMGet(ctx, key, "certificate", "key")
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	certs := make(map[string]TLSDump, len(cmds))
+	for serverName, cmd := range cmds {
+		values := cmd.Val()
+		cert, _ := values[0].(string)
+		key, _ := values[1].(string)
+		if cert == "" || key == "" {
+			continue
+		}
+		certs[serverName] = TLSDump{Certificate: cert, Key: key}
+	}
+	return certs, nil
+}
+
+// Import applies dump, leaving frontends and certificates already matching
+// it untouched, so importing the same dump twice changes nothing. Changed
+// frontends are replaced in a transaction, keeping their dead backends.
+func (a *RedisAdmin) Import(ctx context.Context, dump *RoutesDump, opts ImportOptions) ([]RouteChange, error) {
+	if dump.Version > RoutesDumpVersion {
+		return nil, fmt.Errorf("unsupported routes dump version %d", dump.Version)
+	}
+	current, err := a.Export(ctx, dump.TLS != nil)
+	if err != nil {
+		return nil, err
+	}
+	var changes []RouteChange
+	for _, host := range sortedHosts(dump.Frontends) {
+		frontend := dump.Frontends[host]
+		change := RouteChange{Action: RouteAdded, Kind: "frontend", Name: host}
+		if old, ok := current.Frontends[host]; ok {
+			change.Action = RouteUpdated
+			change.Fields = old.diff(frontend)
+			if len(change.Fields) == 0 {
+				continue
+			}
+		}
+		changes = append(changes, change)
+		if !opts.DryRun {
+			err = a.replaceFrontend(ctx, host, frontend)
+			if err != nil {
+				return changes, err
+			}
+		}
+	}
+	if opts.Prune {
+		for _, host := range sortedHosts(current.Frontends) {
+			if _, ok := dump.Frontends[host]; ok {
+				continue
+			}
+			changes = append(changes, RouteChange{Action: RouteRemoved, Kind: "frontend", Name: host})
+			if !opts.DryRun {
+				err = a.RemoveRoute(ctx, host)
+				if err != nil && err != ErrFrontendNotFound {
+					return changes, err
+				}
+			}
+		}
+	}
+	if dump.Regex != nil && (len(dump.Regex) != len(current.Regex) || len(dump.Regex) > 0 && !reflect.DeepEqual(dump.Regex, current.Regex)) {
+		changes = append(changes, RouteChange{
+			Action: RouteUpdated,
+			Kind:   "regex",
+			Name:   a.keys.regexFrontends(),
+			Fields: []string{fmt.Sprintf("regex: %q -> %q", current.Regex, dump.Regex)},
+		})
+		if !opts.DryRun {
+			err = a.replaceRegex(ctx, dump.Regex)
+			if err != nil {
+				return changes, err
+			}
+		}
+	}
+	for _, serverName := range sortedServerNames(dump.TLS) {
+		cert := dump.TLS[serverName]
+		old, ok := current.TLS[serverName]
+		if ok && old == cert {
+			continue
+		}
+		action := RouteUpdated
+		if !ok {
+			action = RouteAdded
+		}
+		changes = append(changes, RouteChange{Action: action, Kind: "tls", Name: serverName})
+		if !opts.DryRun {
+			err = a.client.HSet(ctx, a.keys.tls(serverName), "certificate", cert.Certificate, "key", cert.Key).Err()
+			if err != nil {
+				return changes, err
+			}
+		}
+	}
+	return changes, nil
+}
+
+func (a *RedisAdmin) replaceFrontend(ctx context.Context, host string, frontend FrontendDump) error {
+	if frontend.ID == "" {
+		return fmt.Errorf("frontend %q: frontend id cannot be empty", host)
+	}
+	return a.update(ctx, host, func(pipe redis.Pipeliner, _ []string) error {
+		values := make([]interface{}, 0, len(frontend.Backends)+1)
+		values = append(values, frontend.ID)
+		for _, backend := range frontend.Backends {
+			values = append(values, backend)
+		}
+		key := a.keys.frontend(host)
+		pipe.Del(ctx, key, a.keys.weight(host), a.keys.healthcheck(host), a.keys.options(host))
+		pipe.RPush(ctx, key, values...)
+		if len(frontend.Weights) > 0 {
+			weights := make(map[string]interface{}, len(frontend.Weights))
+			for backend, weight := range frontend.Weights {
+				weights[backend] = weight
+			}
+			pipe.HSet(ctx, a.keys.weight(host), weights)
+		}
+		if len(frontend.Healthcheck) > 0 {
+			pipe.HSet(ctx, a.keys.healthcheck(host), frontend.Healthcheck)
+		}
+		if len(frontend.Options) > 0 {
+			pipe.HSet(ctx, a.keys.options(host), frontend.Options)
+		}
+		return nil
+	})
+}
+
+// replaceRegex replaces the regex frontends, scoring them by their position.
+func (a *RedisAdmin) replaceRegex(ctx context.Context, regex []string) error {
+	key := a.keys.regexFrontends()
+	_, err := a.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.Publish(ctx, a.keys.routesChannel(), "")
+		if len(regex) == 0 {
+			return nil
+		}
+		members := make([]*redis.Z, len(regex))
+		for i, expr := range regex {
+			members[i] = &redis.Z{Score: float64(i + 1), Member: expr}
+		}
+		pipe.ZAdd(ctx, key, members...)
+		return nil
+	})
+	return err
+}
+
+func nonEmpty(fields map[string]string) map[string]string {
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+func sortedHosts(frontends map[string]FrontendDump) []string {
+	hosts := make([]string, 0, len(frontends))
+	for host := range frontends {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func sortedServerNames(certs map[string]TLSDump) []string {
+	names := make([]string, 0, len(certs))
+	for name := range certs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,180 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+	"gopkg.in/check.v1"
+	"gopkg.in/yaml.v3"
+)
+
+func (s *S) TestAdminExport(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	err := admin.AddRoute(ctx, "f1.com", "app1", "srv1", "srv2")
+	c.Assert(err, check.IsNil)
+	err = admin.AddRoute(ctx, "^f[0-9]+\\.io$", "regex", "srv3")
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.ZAdd(ctx, "frontends:regex", &redis.Z{Score: 1, Member: "^f[0-9]+\\.io$"}).Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.HSet(ctx, "weight:f1.com", "srv2", "3").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.HSet(ctx, "healthcheck:f1.com", "path", "/health").Err()
+	c.Assert(err, check.IsNil)
+	defer s.redisConn.Del(ctx, "healthcheck:f1.com")
+	err = s.redisConn.HSet(ctx, "tls:f1.com", "certificate", "cert", "key", "key").Err()
+	c.Assert(err, check.IsNil)
+	defer s.redisConn.Del(ctx, "tls:f1.com")
+	dump, err := admin.Export(ctx, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(dump, check.DeepEquals, &RoutesDump{
+		Version: RoutesDumpVersion,
+		Frontends: map[string]FrontendDump{
+			"f1.com": {
+				ID:          "app1",
+				Backends:    []string{"srv1", "srv2"},
+				Weights:     map[string]int{"srv2": 3},
+				Healthcheck: map[string]string{"path": "/health"},
+			},
+			"^f[0-9]+\\.io$": {ID: "regex", Backends: []string{"srv3"}},
+		},
+		Regex: []string{"^f[0-9]+\\.io$"},
+	})
+	dump, err = admin.Export(ctx, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(dump.TLS["f1.com"], check.DeepEquals, TLSDump{Certificate: "cert", Key: "key"})
+}
+
+func (s *S) TestAdminImport(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	err := admin.AddRoute(ctx, "f1.com", "app1", "srv1")
+	c.Assert(err, check.IsNil)
+	err = admin.AddRoute(ctx, "f2.com", "app2", "srv2")
+	c.Assert(err, check.IsNil)
+	err = admin.AddRoute(ctx, "old.com", "old", "srv9")
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.HSet(ctx, "weight:f2.com", "srv2", "2").Err()
+	c.Assert(err, check.IsNil)
+	defer s.redisConn.Del(ctx, "healthcheck:f3.com", "tls:f3.com")
+	var dump RoutesDump
+	err = yaml.Unmarshal([]byte(`
+version: 1
+frontends:
+  f1.com:
+    id: app1
+    backends: [srv1]
+  f2.com:
+    id: app2
+    backends: [srv2, srv3]
+  f3.com: [app3, srv4, srv5]
+tls:
+  f3.com:
+    certificate: cert
+    key: key
+`), &dump)
+	c.Assert(err, check.IsNil)
+	c.Assert(dump.Frontends["f3.com"], check.DeepEquals, FrontendDump{ID: "app3", Backends: []string{"srv4", "srv5"}})
+	expected := []RouteChange{
+		{Action: RouteUpdated, Kind: "frontend", Name: "f2.com", Fields: []string{
+			`backends: ["srv2"] -> ["srv2" "srv3"]`,
+			`weights[srv2]: "2" -> (unset)`,
+		}},
+		{Action: RouteAdded, Kind: "frontend", Name: "f3.com"},
+		{Action: RouteRemoved, Kind: "frontend", Name: "old.com"},
+		{Action: RouteAdded, Kind: "tls", Name: "f3.com"},
+	}
+	changes, err := admin.Import(ctx, &dump, ImportOptions{DryRun: true, Prune: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(changes, check.DeepEquals, expected)
+	c.Assert(s.redisConn.Exists(ctx, "frontend:f3.com").Val(), check.Equals, int64(0))
+	changes, err = admin.Import(ctx, &dump, ImportOptions{Prune: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(changes, check.DeepEquals, expected)
+	entries, err := s.redisConn.LRange(ctx, "frontend:f2.com", 0, -1).Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.DeepEquals, []string{"app2", "srv2", "srv3"})
+	c.Assert(s.redisConn.Exists(ctx, "weight:f2.com", "frontend:old.com").Val(), check.Equals, int64(0))
+	entries, err = s.redisConn.LRange(ctx, "frontend:f3.com", 0, -1).Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.DeepEquals, []string{"app3", "srv4", "srv5"})
+	c.Assert(s.redisConn.HGet(ctx, "tls:f3.com", "certificate").Val(), check.Equals, "cert")
+	changes, err = admin.Import(ctx, &dump, ImportOptions{Prune: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(changes, check.HasLen, 0)
+}
+
+func (s *S) TestFrontendDumpDiff(c *check.C) {
+	old := FrontendDump{
+		ID:          "app1",
+		Backends:    []string{"srv1", "srv2"},
+		Weights:     map[string]int{"srv1": 2},
+		Healthcheck: map[string]string{"path": "/", "timeout": "1s"},
+	}
+	updated := FrontendDump{
+		ID:          "app2",
+		Backends:    []string{"srv1", "srv2"},
+		Weights:     map[string]int{"srv1": 4},
+		Healthcheck: map[string]string{"path": "/healthcheck", "timeout": "1s"},
+		Options:     map[string]string{"lb": "least-conn"},
+	}
+	change := RouteChange{Action: RouteUpdated, Kind: "frontend", Name: "f1.com", Fields: old.diff(updated)}
+	c.Assert(change.String(), check.Equals, `update frontend f1.com
+  id: "app1" -> "app2"
+  weights[srv1]: "2" -> "4"
+  healthcheck[path]: "/" -> "/healthcheck"
+  options[lb]: (unset) -> "least-conn"`)
+	c.Assert(old.diff(old), check.HasLen, 0)
+	c.Assert(FrontendDump{ID: "app1", Weights: map[string]int{}}.diff(FrontendDump{ID: "app1"}), check.HasLen, 0)
+}
+
+func (s *S) TestAdminImportKeepsUnlistedFrontends(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	err := admin.AddRoute(ctx, "f1.com", "app1", "srv1")
+	c.Assert(err, check.IsNil)
+	dump := &RoutesDump{Frontends: map[string]FrontendDump{
+		"f2.com": {ID: "app2", Backends: []string{"srv2"}, Options: map[string]string{"lb": "round-robin"}},
+	}}
+	changes, err := admin.Import(ctx, dump, ImportOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(changes, check.DeepEquals, []RouteChange{{Action: RouteAdded, Kind: "frontend", Name: "f2.com"}})
+	hosts, err := admin.Routes(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.DeepEquals, []string{"f1.com", "f2.com"})
+	c.Assert(s.redisConn.HGet(ctx, "options:f2.com", "lb").Val(), check.Equals, "round-robin")
+}
+
+func (s *S) TestAdminImportRegexPublishes(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	pubsub := s.redisConn.Subscribe(ctx, "routes")
+	defer pubsub.Close()
+	_, err := pubsub.Receive(ctx)
+	c.Assert(err, check.IsNil)
+	changes, err := admin.Import(ctx, &RoutesDump{Regex: []string{"^f[0-9]+\\.io$"}}, ImportOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(changes, check.DeepEquals, []RouteChange{{
+		Action: RouteUpdated,
+		Kind:   "regex",
+		Name:   "frontends:regex",
+		Fields: []string{`regex: [] -> ["^f[0-9]+\\.io$"]`},
+	}})
+	msg, err := pubsub.ReceiveMessage(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(msg.Payload, check.Equals, "")
+}
+
+func (s *S) TestAdminImportInvalid(c *check.C) {
+	ctx := context.Background()
+	admin := s.newAdmin(c)
+	defer admin.Close()
+	_, err := admin.Import(ctx, &RoutesDump{Version: RoutesDumpVersion + 1}, ImportOptions{})
+	c.Assert(err, check.ErrorMatches, "unsupported routes dump version 2")
+	_, err = admin.Import(ctx, &RoutesDump{Frontends: map[string]FrontendDump{"f1.com": {}}}, ImportOptions{})
+	c.Assert(err, check.ErrorMatches, `frontend "f1.com": frontend id cannot be empty`)
+}
@@ -2,11 +2,7 @@ package backend
 
 import (
 	"context"
-	"errors"
-	"fmt"
-	"io/ioutil"
-	"net"
-	"net/http"
+	"log"
 	"os"
 	"strconv"
 	"strings"
@@ -14,45 +10,84 @@ import (
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-var errBackendIdxNotFound = errors.New("backend not in backends list")
+const (
+	minResubscribeBackoff = 100 * time.Millisecond
+	maxResubscribeBackoff = 30 * time.Second
+)
+
+var (
+	monitorSubscribed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "roxxy",
+		Subsystem: "monitor",
+		Name:      "subscribed",
+		Help:      "Whether the monitor is subscribed to the dead backends channel.",
+	})
+
+	monitorResubscribes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "roxxy",
+		Subsystem: "monitor",
+		Name:      "resubscribes_total",
+		Help:      "The total attempts to subscribe again to the dead backends channel.",
+	})
+
+	monitorMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "roxxy",
+		Subsystem: "monitor",
+		Name:      "messages_received_total",
+		Help:      "The total messages received in the dead backends channel.",
+	})
+
+	monitorChecksInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "roxxy",
+		Subsystem: "monitor",
+		Name:      "checks_in_flight",
+		Help:      "The current number of backend health checks running.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(monitorSubscribed)
+	prometheus.MustRegister(monitorResubscribes)
+	prometheus.MustRegister(monitorMessages)
+	prometheus.MustRegister(monitorChecksInFlight)
+}
 
 type redisMonitor struct {
 	mu          sync.Mutex
 	reserved    map[string]struct{}
+	counters    map[string]*checkCounters
 	hostID      string
-	quit        chan struct{}
+	opts        MonitorOptions
+	cancel      context.CancelFunc
+	pubsub      *redis.PubSub
 	done        chan struct{}
+	wg          sync.WaitGroup
 	limiter     chan struct{}
-	redisClient *redis.Client
-	httpClient  *http.Client
+	redisClient redis.UniversalClient
+	keys        redisKeys
+	events      *eventNotifier
 }
 
-func newRedisMonitor(ctx context.Context, redisClient *redis.Client) (*redisMonitor, error) {
+func newRedisMonitor(ctx context.Context, redisClient redis.UniversalClient, keys redisKeys, opts MonitorOptions, events *eventNotifier) (*redisMonitor, error) {
 	hostID, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
 
+	opts.setDefaults()
 	redisMon := &redisMonitor{
 		hostID:      hostID,
-		quit:        make(chan struct{}),
+		opts:        opts,
 		done:        make(chan struct{}),
-		limiter:     make(chan struct{}, 5),
+		limiter:     make(chan struct{}, opts.Concurrency),
 		reserved:    make(map[string]struct{}),
+		counters:    make(map[string]*checkCounters),
 		redisClient: redisClient,
-		httpClient: &http.Client{
-			Transport: &http.Transport{
-				Dial: (&net.Dialer{
-					Timeout: 10 * time.Second,
-				}).Dial,
-				DisableKeepAlives:   true,
-				MaxIdleConnsPerHost: -1,
-				TLSHandshakeTimeout: 10 * time.Second,
-			},
-			Timeout: 15 * time.Second,
-		},
+		keys:        keys,
+		events:      events,
 	}
 	err = redisMon.start(ctx)
 	if err != nil {
@@ -62,67 +97,117 @@ func newRedisMonitor(ctx context.Context, redisClient *redis.Client) (*redisMoni
 }
 
 func (b *redisMonitor) start(ctx context.Context) error {
-	pubsub := b.redisClient.Subscribe(ctx, "dead")
+	pubsub, err := b.subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, b.cancel = context.WithCancel(ctx)
 	go b.loop(ctx, pubsub)
+	if b.opts.Interval > 0 {
+		b.wg.Add(1)
+		go b.schedule(ctx)
+	}
 	return nil
 }
 
+// subscribe subscribes to the dead channel, waiting for the subscription to
+// be confirmed so no message published afterwards is lost.
+func (b *redisMonitor) subscribe(ctx context.Context) (*redis.PubSub, error) {
+	pubsub := b.redisClient.Subscribe(ctx, b.keys.deadChannel())
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	b.mu.Lock()
+	b.pubsub = pubsub
+	b.mu.Unlock()
+	monitorSubscribed.Set(1)
+	return pubsub, nil
+}
+
+// loop watches every backend published in the dead channel. When the
+// subscription is lost, because redis went away or the connection broke, it
+// subscribes again with an exponential backoff until ctx is done.
 func (b *redisMonitor) loop(ctx context.Context, pubsub *redis.PubSub) {
 	wg := sync.WaitGroup{}
 	defer close(b.done)
 	defer wg.Wait()
-	defer pubsub.Close()
-	msgCh := make(chan string)
-
+	backoff := minResubscribeBackoff
 	for {
-		go func() {
-			msg, _ := pubsub.ReceiveMessage(ctx)
-			if msg == nil {
-				msgCh <- ""
-			} else {
-				msgCh <- msg.Payload
+		if pubsub == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
 			}
-		}()
-		select {
-		case <-b.quit:
-			return
-		case msg := <-msgCh:
-			if msg == "" {
+			monitorResubscribes.Inc()
+			var err error
+			pubsub, err = b.subscribe(ctx)
+			if err != nil {
+				log.Printf("unable to subscribe to dead backends, retrying in %v: %v", backoff, err)
+				backoff *= 2
+				if backoff > maxResubscribeBackoff {
+					backoff = maxResubscribeBackoff
+				}
 				continue
 			}
-			wg.Add(1)
-			go func(msg string) {
-				defer wg.Done()
-				b.watch(ctx, msg)
-			}(msg)
+			backoff = minResubscribeBackoff
 		}
+		msg, err := pubsub.ReceiveMessage(ctx)
+		if err != nil {
+			pubsub.Close()
+			pubsub = nil
+			monitorSubscribed.Set(0)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("dead backends subscription lost: %v", err)
+			continue
+		}
+		monitorMessages.Inc()
+		wg.Add(1)
+		go func(msg string) {
+			defer wg.Done()
+			b.watch(ctx, msg)
+		}(msg.Payload)
 	}
 }
 
-func (b *redisMonitor) reserve(ctx context.Context, host, backend string) bool {
-	key := "dead:" + host + ":" + backend
-	reserved := false
-	err := b.redisClient.Watch(ctx, func(tx *redis.Tx) error {
-		watchKey := tx.Get(ctx, key).Val()
-		if watchKey != "" && watchKey != b.hostID {
-			return nil
-		}
-		_, txErr := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.Set(ctx, key, b.hostID, 30*time.Second)
-			return nil
-		})
-		reserved = txErr != redis.TxFailedErr
-		return nil
-	}, key)
-	if err != nil {
-		return false
+// reserveScript sets ARGV[1] as the holder of the reservation KEYS[1] for
+// ARGV[2] milliseconds, unless it or the legacy reservation KEYS[2] is held by
+// another instance. With ARGV[3] the legacy reservation is set as well.
+var reserveScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	local holder = redis.call('get', key)
+	if holder and holder ~= ARGV[1] then
+		return 0
+	end
+end
+redis.call('set', KEYS[1], ARGV[1], 'px', ARGV[2])
+if ARGV[3] then
+	redis.call('set', KEYS[2], ARGV[1], 'px', ARGV[2])
+end
+return 1
+`)
+
+// reserve sets this roxxy instance as the one checking backend for ttl,
+// returning false if another instance holds the reservation.
+func (b *redisMonitor) reserve(ctx context.Context, host, backend string, ttl time.Duration) bool {
+	keys := []string{b.keys.reservation(host, backend), b.keys.legacyReservation(host, backend)}
+	args := []interface{}{b.hostID, ttl.Milliseconds()}
+	if b.keys.legacyDead {
+		args = append(args, 1)
 	}
-	return reserved
+	reserved, err := reserveScript.Run(ctx, b.redisClient, keys, args...).Int()
+	return err == nil && reserved == 1
 }
 
 func (b *redisMonitor) watch(ctx context.Context, msg string) {
+	// Messages are "host;backend", older roxxy versions also append the
+	// backend index and the number of backends.
 	parts := strings.Split(msg, ";")
-	if len(parts) != 4 {
+	if len(parts) != 2 && len(parts) != 4 {
 		return
 	}
 	host := parts[0]
@@ -140,38 +225,46 @@ func (b *redisMonitor) watch(ctx context.Context, msg string) {
 		delete(b.reserved, localKey)
 		b.mu.Unlock()
 	}()
-	if !b.reserve(ctx, host, backend) {
+	if !b.reserve(ctx, host, backend, 30*time.Second) {
 		return
 	}
 out:
 	for {
 		select {
-		case <-b.quit:
+		case <-ctx.Done():
 			break out
 		case <-time.After(time.Second):
 		}
-		b.limiter <- struct{}{}
-		if !b.reserve(ctx, host, backend) {
+		select {
+		case <-ctx.Done():
+			break out
+		case b.limiter <- struct{}{}:
+		}
+		if !b.reserve(ctx, host, backend, 30*time.Second) {
 			<-b.limiter
 			return
 		}
 		isOk := b.check(ctx, host, backend)
-		err := b.updateDead(ctx, host, backend, isOk)
+		if ctx.Err() != nil {
+			<-b.limiter
+			break out
+		}
+		err := b.updateDead(ctx, host, backend, isOk, 30*time.Second)
 		<-b.limiter
-		if (err == nil && isOk) || err == errBackendIdxNotFound {
+		if (err == nil && isOk) || err == ErrBackendNotFound {
 			break out
 		}
 	}
-	b.free(ctx, host, backend)
+	b.free(host, backend)
 }
 
-func (b *redisMonitor) updateDead(ctx context.Context, host, backend string, isOk bool) error {
-	frontend := "frontend:" + host
+func (b *redisMonitor) updateDead(ctx context.Context, host, backend string, isOk bool, deadTTL time.Duration) error {
+	frontend := b.keys.frontend(host)
 	return b.redisClient.Watch(ctx, func(tx *redis.Tx) error {
 		entries, err := tx.LRange(ctx, frontend, 1, -1).Result()
 		if err != nil {
 			if err == redis.Nil {
-				return errBackendIdxNotFound
+				return ErrBackendNotFound
 			}
 			return err
 		}
@@ -183,53 +276,89 @@ func (b *redisMonitor) updateDead(ctx context.Context, host, backend string, isO
 			}
 		}
 		if idx == "" {
-			return errBackendIdxNotFound
+			return ErrBackendNotFound
 		}
-		deadKey := "dead:" + host
+		now := time.Now()
+		var changed *redis.Cmd
+		var dead *redis.IntCmd
 		_, err = tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
 			if isOk {
-				pipe.SRem(ctx, deadKey, idx)
+				// The index is removed as well to revive backends marked
+				// as dead by older roxxy versions.
+				changed = queueRevive(ctx, pipe, b.keys, host, backend, idx, now)
 			} else {
-				pipe.SAdd(ctx, deadKey, idx)
-				pipe.Expire(ctx, deadKey, 30*time.Second)
+				changed, _ = queueMarkDead(ctx, pipe, b.keys, host, backend, now, now.Add(deadTTL))
 			}
+			deadArgs := deadMembersArgs(now)
+			dead = pipe.ZCount(ctx, b.keys.deadBackends(host), deadArgs.Min, deadArgs.Max)
 			return nil
 		})
-		return err
+		if err != nil {
+			return err
+		}
+		if n, _ := changed.Int64(); n == 0 {
+			return nil
+		}
+		err = tx.Publish(ctx, b.keys.routesChannel(), host).Err()
+		if err != nil {
+			return err
+		}
+		event := BackendEvent{
+			Type:         BackendDead,
+			Host:         host,
+			Backend:      backend,
+			Time:         now,
+			Backends:     len(entries),
+			DeadBackends: int(dead.Val()),
+		}
+		if isOk {
+			event.Type = BackendAlive
+		}
+		b.events.notify(ctx, event)
+		return nil
 	}, frontend)
 }
 
+// stop cancels the monitor context, closing the subscription to unblock any
+// pending receive, and waits for every running check.
 func (b *redisMonitor) stop() {
-	if b.quit != nil {
-		close(b.quit)
+	if b.cancel != nil {
+		b.cancel()
 	}
+	b.mu.Lock()
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	b.mu.Unlock()
 	if b.done != nil {
 		<-b.done
 	}
+	b.wg.Wait()
+	if b.opts.Interval > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		b.redisClient.ZRem(ctx, b.keys.monitors(), b.hostID)
+	}
 }
 
-func (b *redisMonitor) free(ctx context.Context, host, backend string) {
-	key := "dead:" + host + ":" + backend
-	b.redisClient.Del(ctx, key)
-}
-
-type hcData struct {
-	path   string
-	body   string
-	status int
+// free releases the reservation of backend, it runs on shutdown as well so
+// it doesn't use the monitor context.
+func (b *redisMonitor) free(host, backend string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	keys := []string{b.keys.reservation(host, backend)}
+	if b.keys.legacyDead {
+		keys = append(keys, b.keys.legacyReservation(host, backend))
+	}
+	b.redisClient.Del(ctx, keys...)
 }
 
 func (b *redisMonitor) hcData(ctx context.Context, host string) (hcData, error) {
-	mapData, err := b.redisClient.HGetAll(ctx, "healthcheck:"+host).Result()
+	mapData, err := b.redisClient.HGetAll(ctx, b.keys.healthcheck(host)).Result()
 	if err != nil && err != redis.Nil {
 		return hcData{}, err
 	}
-	status, _ := strconv.Atoi(mapData["status"])
-	return hcData{
-		path:   mapData["path"],
-		body:   mapData["body"],
-		status: status,
-	}, nil
+	return parseHcData(mapData), nil
 }
 
 func (b *redisMonitor) check(ctx context.Context, host, backend string) bool {
@@ -237,25 +366,7 @@ func (b *redisMonitor) check(ctx context.Context, host, backend string) bool {
 	if err != nil {
 		return false
 	}
-	url := fmt.Sprintf("%s/%s", backend, strings.TrimLeft(hcData.path, "/"))
-	if !strings.HasPrefix(url, "http") {
-		url = "http://" + url
-	}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return false
-	}
-	rsp, err := b.httpClient.Do(req)
-	if err != nil {
-		return false
-	}
-	defer rsp.Body.Close()
-	if hcData.status != 0 && rsp.StatusCode != hcData.status {
-		return false
-	}
-	if hcData.body != "" {
-		data, _ := ioutil.ReadAll(rsp.Body)
-		return (strings.Contains(string(data), hcData.body))
-	}
-	return true
+	monitorChecksInFlight.Inc()
+	defer monitorChecksInFlight.Dec()
+	return hcData.check(ctx, backend)
 }
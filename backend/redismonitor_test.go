@@ -2,9 +2,15 @@ package backend
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -25,9 +31,9 @@ func (s *S) TestStartMonitorNotDead(c *check.C) {
 	}))
 	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", s1.URL, s2.URL).Err()
 	c.Assert(err, check.IsNil)
-	err = s.be.StartMonitor(ctx)
+	err = s.be.StartMonitor(ctx, MonitorOptions{})
 	c.Assert(err, check.IsNil)
-	err = s.be.MarkDead(ctx, "f1.com", s1.URL, 0, 2, 30)
+	err = s.be.MarkDead(ctx, "f1.com", s1.URL, 30)
 	c.Assert(err, check.IsNil)
 	incCh := make(chan bool)
 	go func() {
@@ -47,10 +53,10 @@ func (s *S) TestStartMonitorNotDead(c *check.C) {
 	s.be.StopMonitor()
 	c.Assert(atomic.LoadInt32(&s1CallCount), check.Equals, int32(1))
 	c.Assert(atomic.LoadInt32(&s2CallCount), check.Equals, int32(0))
-	members, err := s.redisConn.SMembers(ctx, "dead:f1.com").Result()
+	members, err := s.redisConn.ZRange(ctx, "dead-backends:f1.com", 0, -1).Result()
 	c.Assert(err, check.IsNil)
 	c.Assert(members, check.DeepEquals, []string{})
-	val, err := s.redisConn.Get(ctx, "dead:f1.com:"+s1.URL).Result()
+	val, err := s.redisConn.Get(ctx, "reservation:f1.com:"+s1.URL).Result()
 	c.Assert(err, check.Equals, redis.Nil)
 	c.Assert(val, check.Equals, "")
 }
@@ -71,9 +77,9 @@ func (s *S) TestStartMonitorDeadAndBack(c *check.C) {
 	c.Assert(err, check.IsNil)
 	err = s.redisConn.HSet(ctx, "healthcheck:f1.com", "status", "200").Err()
 	c.Assert(err, check.IsNil)
-	err = s.be.StartMonitor(ctx)
+	err = s.be.StartMonitor(ctx, MonitorOptions{})
 	c.Assert(err, check.IsNil)
-	err = s.be.MarkDead(ctx, "f1.com", s1.URL, 0, 2, 30)
+	err = s.be.MarkDead(ctx, "f1.com", s1.URL, 30)
 	c.Assert(err, check.IsNil)
 	incCh := make(chan bool)
 	go func() {
@@ -92,10 +98,10 @@ func (s *S) TestStartMonitorDeadAndBack(c *check.C) {
 	}
 	c.Assert(atomic.LoadInt32(&s1CallCount) > int32(0), check.Equals, true)
 	c.Assert(atomic.LoadInt32(&s2CallCount), check.Equals, int32(0))
-	members, err := s.redisConn.SMembers(ctx, "dead:f1.com").Result()
+	members, err := s.redisConn.ZRange(ctx, "dead-backends:f1.com", 0, -1).Result()
 	c.Assert(err, check.IsNil)
-	c.Assert(members, check.DeepEquals, []string{"0"})
-	val, err := s.redisConn.Get(ctx, "dead:f1.com:"+s1.URL).Result()
+	c.Assert(members, check.DeepEquals, []string{s1.URL})
+	val, err := s.redisConn.Get(ctx, "reservation:f1.com:"+s1.URL).Result()
 	c.Assert(err, check.IsNil)
 	hostname, _ := os.Hostname()
 	c.Assert(val, check.Equals, hostname)
@@ -103,7 +109,7 @@ func (s *S) TestStartMonitorDeadAndBack(c *check.C) {
 	aliveCh := make(chan bool)
 	go func() {
 		for {
-			if s.redisConn.Get(ctx, "dead:f1.com:"+s1.URL).Err() == redis.Nil {
+			if s.redisConn.Get(ctx, "reservation:f1.com:"+s1.URL).Err() == redis.Nil {
 				aliveCh <- true
 				return
 			}
@@ -116,7 +122,325 @@ func (s *S) TestStartMonitorDeadAndBack(c *check.C) {
 		c.Fatal("timeout waiting for alive call")
 	}
 	s.be.StopMonitor()
-	members, err = s.redisConn.SMembers(ctx, "dead:f1.com").Result()
+	members, err = s.redisConn.ZRange(ctx, "dead-backends:f1.com", 0, -1).Result()
 	c.Assert(err, check.IsNil)
 	c.Assert(members, check.DeepEquals, []string{})
 }
+
+func (s *S) TestUpdateDeadRemovesLegacyIndex(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.SAdd(ctx, "dead:f1.com", "1", "0").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.Expire(ctx, "dead:f1.com", 30*time.Second).Err()
+	c.Assert(err, check.IsNil)
+	mon := &redisMonitor{redisClient: s.redisConn}
+	err = mon.updateDead(ctx, "f1.com", "srv2", true, 30*time.Second)
+	c.Assert(err, check.IsNil)
+	members, err := s.redisConn.SMembers(ctx, "dead:f1.com").Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(members, check.DeepEquals, []string{"0"})
+	err = mon.updateDead(ctx, "f1.com", "srv1", false, 30*time.Second)
+	c.Assert(err, check.IsNil)
+	members, err = s.redisConn.ZRange(ctx, "dead-backends:f1.com", 0, -1).Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(members, check.DeepEquals, []string{"srv1"})
+	score, err := s.redisConn.ZScore(ctx, "dead-backends:f1.com", "srv1").Result()
+	c.Assert(err, check.IsNil)
+	reviveIn := time.Until(time.Unix(0, int64(score)*int64(time.Millisecond)))
+	c.Assert(reviveIn > 29*time.Second && reviveIn <= 30*time.Second, check.Equals, true)
+	err = mon.updateDead(ctx, "f1.com", "srv3", false, 30*time.Second)
+	c.Assert(err, check.Equals, ErrBackendNotFound)
+}
+
+func (s *S) TestUpdateDeadPublishesAliveEvent(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1", "srv2").Err()
+	c.Assert(err, check.IsNil)
+	err = s.be.MarkDead(ctx, "f1.com", "srv1", 30)
+	c.Assert(err, check.IsNil)
+	pubsub := s.redisConn.Subscribe(ctx, "backend-events")
+	defer pubsub.Close()
+	_, err = pubsub.Receive(ctx)
+	c.Assert(err, check.IsNil)
+	mon := &redisMonitor{
+		redisClient: s.redisConn,
+		events: newEventNotifier(EventOptions{}, func(ctx context.Context, data []byte) error {
+			return s.redisConn.Publish(ctx, "backend-events", data).Err()
+		}),
+	}
+	err = mon.updateDead(ctx, "f1.com", "srv1", true, 30*time.Second)
+	c.Assert(err, check.IsNil)
+	err = mon.updateDead(ctx, "f1.com", "srv1", true, 30*time.Second)
+	c.Assert(err, check.IsNil)
+	err = mon.updateDead(ctx, "f1.com", "srv2", false, 30*time.Second)
+	c.Assert(err, check.IsNil)
+	for _, expected := range []BackendEvent{
+		{Type: BackendAlive, Host: "f1.com", Backend: "srv1", Backends: 2, DeadBackends: 0},
+		{Type: BackendDead, Host: "f1.com", Backend: "srv2", Backends: 2, DeadBackends: 1},
+	} {
+		msg, err := pubsub.ReceiveMessage(ctx)
+		c.Assert(err, check.IsNil)
+		var event BackendEvent
+		err = json.Unmarshal([]byte(msg.Payload), &event)
+		c.Assert(err, check.IsNil)
+		event.Time = time.Time{}
+		c.Assert(event, check.DeepEquals, expected)
+	}
+}
+
+func (s *S) TestCheckAllMarksDeadAndRevives(c *check.C) {
+	ctx := context.Background()
+	rsp := int32(500)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(int(atomic.LoadInt32(&rsp)))
+	}))
+	defer srv.Close()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", srv.URL).Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.HSet(ctx, "healthcheck:f1.com", "status", "200").Err()
+	c.Assert(err, check.IsNil)
+	defer s.redisConn.Del(ctx, "healthcheck:f1.com")
+	mon := &redisMonitor{
+		hostID:      "roxxy1",
+		opts:        MonitorOptions{Interval: time.Second, Rise: 2, Fall: 2},
+		limiter:     make(chan struct{}, 5),
+		reserved:    make(map[string]struct{}),
+		counters:    make(map[string]*checkCounters),
+		redisClient: s.redisConn,
+	}
+	deadMembers := func() []string {
+		members, zErr := s.redisConn.ZRange(ctx, "dead-backends:f1.com", 0, -1).Result()
+		c.Assert(zErr, check.IsNil)
+		return members
+	}
+	err = mon.checkAll(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(deadMembers(), check.DeepEquals, []string{})
+	err = mon.checkAll(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(deadMembers(), check.DeepEquals, []string{srv.URL})
+	val, err := s.redisConn.Get(ctx, "reservation:f1.com:"+srv.URL).Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(val, check.Equals, "roxxy1")
+	atomic.StoreInt32(&rsp, 200)
+	err = mon.checkAll(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(deadMembers(), check.DeepEquals, []string{srv.URL})
+	err = mon.checkAll(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(deadMembers(), check.DeepEquals, []string{})
+}
+
+func (s *S) TestCheckAllSkipsBackendsReservedByOthers(c *check.C) {
+	ctx := context.Background()
+	var callCount int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&callCount, 1)
+	}))
+	defer srv.Close()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", srv.URL).Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.Set(ctx, "reservation:f1.com:"+srv.URL, "roxxy2", time.Minute).Err()
+	c.Assert(err, check.IsNil)
+	mon := &redisMonitor{
+		hostID:      "roxxy1",
+		opts:        MonitorOptions{Interval: time.Second, Rise: 1, Fall: 1},
+		limiter:     make(chan struct{}, 5),
+		reserved:    make(map[string]struct{}),
+		counters:    make(map[string]*checkCounters),
+		redisClient: s.redisConn,
+	}
+	err = mon.checkAll(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(atomic.LoadInt32(&callCount), check.Equals, int32(0))
+}
+
+func (s *S) TestCheckAllSkipsBackendsReservedByOlderVersions(c *check.C) {
+	ctx := context.Background()
+	var callCount int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&callCount, 1)
+	}))
+	defer srv.Close()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", srv.URL).Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.Set(ctx, "dead:f1.com:"+srv.URL, "roxxy2", time.Minute).Err()
+	c.Assert(err, check.IsNil)
+	mon := &redisMonitor{
+		hostID:      "roxxy1",
+		opts:        MonitorOptions{Interval: time.Second, Rise: 1, Fall: 1},
+		limiter:     make(chan struct{}, 5),
+		reserved:    make(map[string]struct{}),
+		counters:    make(map[string]*checkCounters),
+		redisClient: s.redisConn,
+	}
+	err = mon.checkAll(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(atomic.LoadInt32(&callCount), check.Equals, int32(0))
+	c.Assert(mon.reserve(ctx, "f1.com", srv.URL, time.Minute), check.Equals, false)
+}
+
+func (s *S) TestReserveLegacyDeadBackends(c *check.C) {
+	ctx := context.Background()
+	mon := &redisMonitor{
+		hostID:      "roxxy1",
+		keys:        redisKeys{legacyDead: true},
+		redisClient: s.redisConn,
+	}
+	c.Assert(mon.reserve(ctx, "f1.com", "srv1", time.Minute), check.Equals, true)
+	c.Assert(s.redisConn.Get(ctx, "reservation:f1.com:srv1").Val(), check.Equals, "roxxy1")
+	c.Assert(s.redisConn.Get(ctx, "dead:f1.com:srv1").Val(), check.Equals, "roxxy1")
+	mon.free("f1.com", "srv1")
+	c.Assert(s.redisConn.Exists(ctx, "reservation:f1.com:srv1", "dead:f1.com:srv1").Val(), check.Equals, int64(0))
+}
+
+func (s *S) TestCheckAllSplitsBackendsBetweenInstances(c *check.C) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+	backends := []interface{}{"f1.com"}
+	for i := 0; i < 4; i++ {
+		backends = append(backends, fmt.Sprintf("%s/%d", srv.URL, i))
+	}
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", backends...).Err()
+	c.Assert(err, check.IsNil)
+	newMonitor := func(hostID string) *redisMonitor {
+		return &redisMonitor{
+			hostID:      hostID,
+			opts:        MonitorOptions{Interval: time.Second, Rise: 1, Fall: 1},
+			limiter:     make(chan struct{}, 5),
+			reserved:    make(map[string]struct{}),
+			counters:    make(map[string]*checkCounters),
+			redisClient: s.redisConn,
+		}
+	}
+	mon1, mon2 := newMonitor("roxxy1"), newMonitor("roxxy2")
+	_, err = mon2.heartbeat(ctx, 3*time.Second)
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 2; i++ {
+		err = mon1.checkAll(ctx)
+		c.Assert(err, check.IsNil)
+		err = mon2.checkAll(ctx)
+		c.Assert(err, check.IsNil)
+	}
+	holders := map[string]int{}
+	for _, backend := range backends[1:] {
+		holder, err := s.redisConn.Get(ctx, "reservation:f1.com:"+backend.(string)).Result()
+		c.Assert(err, check.IsNil)
+		holders[holder]++
+	}
+	c.Assert(holders, check.DeepEquals, map[string]int{"roxxy1": 2, "roxxy2": 2})
+	c.Assert(s.redisConn.ZCard(ctx, "monitors").Val(), check.Equals, int64(2))
+}
+
+func (s *S) TestScanHosts(c *check.C) {
+	ctx := context.Background()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", "srv1").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redisConn.RPush(ctx, "frontend:f2.com", "f2.com", "srv2").Err()
+	c.Assert(err, check.IsNil)
+	mon := &redisMonitor{redisClient: s.redisConn}
+	hosts, err := mon.scanHosts(ctx)
+	c.Assert(err, check.IsNil)
+	sort.Strings(hosts)
+	c.Assert(hosts, check.DeepEquals, []string{"f1.com", "f2.com"})
+}
+
+// redisProxy forwards connections to the test redis, allowing tests to break
+// every open connection.
+type redisProxy struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+func newRedisProxy(c *check.C) *redisProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	p := &redisProxy{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", "127.0.0.1:6379")
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.mu.Unlock()
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+	return p
+}
+
+func (p *redisProxy) breakConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *redisProxy) close() {
+	p.listener.Close()
+	p.breakConns()
+}
+
+func (s *S) TestMonitorResubscribes(c *check.C) {
+	ctx := context.Background()
+	var callCount int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&callCount, 1)
+	}))
+	defer srv.Close()
+	err := s.redisConn.RPush(ctx, "frontend:f1.com", "f1.com", srv.URL).Err()
+	c.Assert(err, check.IsNil)
+	proxy := newRedisProxy(c)
+	defer proxy.close()
+	client := redis.NewClient(&redis.Options{Addr: proxy.listener.Addr().String(), DB: 1})
+	defer client.Close()
+	mon, err := newRedisMonitor(ctx, client, redisKeys{}, MonitorOptions{}, nil)
+	c.Assert(err, check.IsNil)
+	defer mon.stop()
+	proxy.breakConns()
+	timeout := time.After(10 * time.Second)
+	for atomic.LoadInt32(&callCount) == 0 {
+		err = s.redisConn.Publish(ctx, "dead", "f1.com;"+srv.URL).Err()
+		c.Assert(err, check.IsNil)
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for healthcheck after resubscribing")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (s *S) TestMonitorStopWhileRedisIsDown(c *check.C) {
+	ctx := context.Background()
+	proxy := newRedisProxy(c)
+	client := redis.NewClient(&redis.Options{Addr: proxy.listener.Addr().String(), DB: 1})
+	defer client.Close()
+	mon, err := newRedisMonitor(ctx, client, redisKeys{}, MonitorOptions{}, nil)
+	c.Assert(err, check.IsNil)
+	proxy.close()
+	time.Sleep(300 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		mon.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for monitor to stop")
+	}
+}
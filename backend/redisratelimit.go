@@ -0,0 +1,49 @@
+package backend
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// rateLimitScript implements the generic cell rate algorithm: KEYS[1] holds
+// the theoretical arrival time, in unix microseconds, of the next request
+// conforming to the rate. A request at ARGV[1] is allowed unless it comes
+// more than ARGV[3] emission intervals of ARGV[2] microseconds earlier. It
+// returns whether the request was allowed, the remaining requests and the
+// retry after and reset times in microseconds.
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local tat = tonumber(redis.call('get', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local allowAt = tat + interval - interval * tonumber(ARGV[3])
+if now < allowAt then
+	return {0, 0, allowAt - now, tat - now}
+end
+tat = tat + interval
+redis.call('set', KEYS[1], string.format('%d', tat), 'px', math.ceil((tat - now) / 1000))
+return {1, math.floor((now - allowAt) / interval), 0, tat - now}
+`)
+
+func (b *redisBackend) RateLimit(ctx context.Context, host, key string, rate float64, burst int, now time.Time) (RateLimitResult, error) {
+	interval := int64(math.Ceil(float64(time.Second/time.Microsecond) / rate))
+	if burst < 1 {
+		burst = 1
+	}
+	values, err := rateLimitScript.Run(ctx, b.writeClient, []string{b.keys.rateLimit(host, key)},
+		now.UnixNano()/int64(time.Microsecond), interval, burst).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return RateLimitResult{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Microsecond,
+		Reset:      time.Duration(values[3]) * time.Microsecond,
+	}, nil
+}
@@ -0,0 +1,257 @@
+package backend
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// checkCounters are the consecutive check results of a backend, kept by the
+// roxxy instance holding the backend reservation.
+type checkCounters struct {
+	successes int
+	failures  int
+}
+
+// schedule continuously checks every backend of every frontend. Work is split
+// between roxxy instances using the same reservations as the dead backends
+// watch: each instance reserves its share of the backends, keeping the ones it
+// already reserved for as long as it renews the reservations, other instances
+// take over if it goes away.
+func (b *redisMonitor) schedule(ctx context.Context) {
+	defer b.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(b.opts.Interval):
+		}
+		err := b.checkAll(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("unable to run backend health checks: %v", err)
+		}
+	}
+}
+
+// checkTarget is a backend checked by checkAll.
+type checkTarget struct {
+	host    string
+	backend string
+	isDead  bool
+}
+
+func (b *redisMonitor) checkAll(ctx context.Context) error {
+	leaseTTL := 3 * b.opts.Interval
+	instances, err := b.heartbeat(ctx, leaseTTL)
+	if err != nil {
+		return err
+	}
+	hosts, err := b.scanHosts(ctx)
+	if err != nil {
+		return err
+	}
+	var targets []checkTarget
+	for _, host := range hosts {
+		backends, err := b.redisClient.LRange(ctx, b.keys.frontend(host), 1, -1).Result()
+		if err != nil {
+			return err
+		}
+		members, err := deadMembers(ctx, b.redisClient, b.keys, host, time.Now())
+		if err != nil {
+			return err
+		}
+		deadMap := deadIndexes(backends, members)
+		for i, backend := range backends {
+			b.mu.Lock()
+			_, watching := b.reserved[host+"-"+backend]
+			b.mu.Unlock()
+			if watching {
+				continue
+			}
+			_, isDead := deadMap[i]
+			targets = append(targets, checkTarget{host: host, backend: backend, isDead: isDead})
+		}
+	}
+	targets, err = b.claim(ctx, targets, instances)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, target := range targets {
+		select {
+		case <-ctx.Done():
+			return nil
+		case b.limiter <- struct{}{}:
+		}
+		// The lease starts along with the check, a pass outlasting the
+		// lease would let other instances check the same backends.
+		if !b.reserve(ctx, target.host, target.backend, leaseTTL) {
+			<-b.limiter
+			continue
+		}
+		seen[target.host+"-"+target.backend] = struct{}{}
+		wg.Add(1)
+		go func(target checkTarget) {
+			defer wg.Done()
+			isOk := b.check(ctx, target.host, target.backend)
+			<-b.limiter
+			if ctx.Err() != nil {
+				return
+			}
+			b.record(ctx, target.host, target.backend, target.isDead, isOk)
+		}(target)
+	}
+	wg.Wait()
+	b.mu.Lock()
+	for localKey := range b.counters {
+		if _, ok := seen[localKey]; !ok {
+			delete(b.counters, localKey)
+		}
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// heartbeat registers this instance as running continuous checks for ttl and
+// returns how many instances are running them.
+func (b *redisMonitor) heartbeat(ctx context.Context, ttl time.Duration) (int, error) {
+	now := time.Now()
+	key := b.keys.monitors()
+	pipe := b.redisClient.TxPipeline()
+	defer pipe.Close()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(unixMilli(now)), Member: b.hostID})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(unixMilli(now.Add(-ttl)), 10))
+	count := pipe.ZCard(ctx, key)
+	pipe.PExpire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if count.Val() < 1 {
+		return 1, nil
+	}
+	return int(count.Val()), nil
+}
+
+// claim returns the share of targets checked by this instance, one of
+// instances running checks: the backends it already reserved come first,
+// then the free ones. Backends reserved by other instances are left to them.
+func (b *redisMonitor) claim(ctx context.Context, targets []checkTarget, instances int) ([]checkTarget, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	pipe := b.redisClient.Pipeline()
+	defer pipe.Close()
+	holders := make([]*redis.StringCmd, len(targets))
+	legacyHolders := make([]*redis.StringCmd, len(targets))
+	for i, target := range targets {
+		holders[i] = pipe.Get(ctx, b.keys.reservation(target.host, target.backend))
+		legacyHolders[i] = pipe.Get(ctx, b.keys.legacyReservation(target.host, target.backend))
+	}
+	pipe.Exec(ctx)
+	var mine, free []checkTarget
+	for i, target := range targets {
+		holder, err := holders[i].Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		// Backends reserved by older roxxy versions are left to them.
+		legacyHolder, err := legacyHolders[i].Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		if legacyHolder != "" && legacyHolder != b.hostID {
+			continue
+		}
+		switch holder {
+		case b.hostID:
+			mine = append(mine, target)
+		case "":
+			free = append(free, target)
+		}
+	}
+	share := (len(targets) + instances - 1) / instances
+	claimed := append(mine, free...)
+	if len(claimed) > share {
+		claimed = claimed[:share]
+	}
+	return claimed, nil
+}
+
+// record updates the consecutive results of backend, marking it as dead after
+// Fall failures and reviving it after Rise successes.
+func (b *redisMonitor) record(ctx context.Context, host, backend string, isDead, isOk bool) {
+	localKey := host + "-" + backend
+	b.mu.Lock()
+	counters := b.counters[localKey]
+	if counters == nil {
+		counters = &checkCounters{}
+		b.counters[localKey] = counters
+	}
+	if isOk {
+		counters.successes++
+		counters.failures = 0
+	} else {
+		counters.failures++
+		counters.successes = 0
+	}
+	markDead := !isOk && counters.failures >= b.opts.Fall
+	revive := isOk && isDead && counters.successes >= b.opts.Rise
+	b.mu.Unlock()
+	var err error
+	if markDead || revive {
+		err = b.updateDead(ctx, host, backend, isOk, b.opts.deadTTL())
+	}
+	if err != nil && err != ErrBackendNotFound {
+		log.Printf("unable to update dead backend %q of %q: %v", backend, host, err)
+	}
+}
+
+// scanHosts returns the hosts of every frontend.
+func (b *redisMonitor) scanHosts(ctx context.Context) ([]string, error) {
+	return scanHosts(ctx, b.redisClient, b.keys)
+}
+
+// scanHosts returns the hosts of every frontend.
+func scanHosts(ctx context.Context, redisClient redis.UniversalClient, keys redisKeys) ([]string, error) {
+	frontends, err := scanKeys(ctx, redisClient, keys.frontendPattern())
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, key := range frontends {
+		if host := keys.hostFromKey(key); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// scanKeys returns the keys matching pattern, scanning each master node when
+// running against a Redis Cluster.
+func scanKeys(ctx context.Context, redisClient redis.UniversalClient, pattern string) ([]string, error) {
+	var mu sync.Mutex
+	var keys []string
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			keys = append(keys, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+	if cluster, ok := redisClient.(*redis.ClusterClient); ok {
+		err := cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+		return keys, err
+	}
+	return keys, scan(ctx, redisClient)
+}
@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisRoutesWatcher calls fn with the host of every frontend changed either
+// by roxxy itself, through the routes channel, or by other clients when
+// keyspace notifications are enabled. fn is called with an empty host when
+// the regex frontends change or changes may have been missed while
+// reconnecting.
+type redisRoutesWatcher struct {
+	pubsubs []*redis.PubSub
+	keys    redisKeys
+	fn      func(host string)
+	// mu serializes the calls to fn made by each pubsub loop.
+	mu   sync.Mutex
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newRedisRoutesWatcher(ctx context.Context, client redis.UniversalClient, keys redisKeys, db int, fn func(host string)) (*redisRoutesWatcher, error) {
+	pubsub := client.Subscribe(ctx, keys.routesChannel())
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	w := &redisRoutesWatcher{
+		pubsubs: []*redis.PubSub{pubsub},
+		keys:    keys,
+		fn:      fn,
+		quit:    make(chan struct{}),
+	}
+	patterns := keys.keyspacePatterns(db)
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		// Keyspace notifications are only delivered to the clients of the
+		// node holding the key, every master is subscribed to. Masters
+		// added after the watcher started aren't.
+		var mu sync.Mutex
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			pubsub, err := psubscribe(ctx, master, patterns)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			w.pubsubs = append(w.pubsubs, pubsub)
+			mu.Unlock()
+			return nil
+		})
+	} else {
+		err = pubsub.PSubscribe(ctx, patterns...)
+		if err == nil {
+			err = receiveAll(ctx, pubsub, len(patterns))
+		}
+	}
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+	for _, pubsub := range w.pubsubs {
+		w.wg.Add(1)
+		go w.loop(pubsub)
+	}
+	return w, nil
+}
+
+// psubscribe subscribes to patterns in a pubsub of its own of client.
+func psubscribe(ctx context.Context, client *redis.Client, patterns []string) (*redis.PubSub, error) {
+	pubsub := client.PSubscribe(ctx, patterns...)
+	err := receiveAll(ctx, pubsub, len(patterns))
+	if err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	return pubsub, nil
+}
+
+// receiveAll waits for the confirmation of n subscriptions.
+func receiveAll(ctx context.Context, pubsub *redis.PubSub, n int) error {
+	for i := 0; i < n; i++ {
+		_, err := pubsub.Receive(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *redisRoutesWatcher) loop(pubsub *redis.PubSub) {
+	defer w.wg.Done()
+	ch := pubsub.ChannelWithSubscriptions(context.Background(), 100)
+	for {
+		select {
+		case <-w.quit:
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			w.mu.Lock()
+			w.handle(msg)
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *redisRoutesWatcher) handle(msg interface{}) {
+	switch msg := msg.(type) {
+	case *redis.Subscription:
+		// The subscriptions are only confirmed again after the
+		// connection dropped, changes published meanwhile are lost.
+		if msg.Kind == "subscribe" || msg.Kind == "psubscribe" {
+			w.fn("")
+		}
+	case *redis.Message:
+		switch {
+		case msg.Pattern == "":
+			w.fn(msg.Payload)
+		case w.keys.isRegexKeyspaceChannel(msg.Channel):
+			w.fn("")
+		default:
+			if host := w.keys.hostFromKeyspaceChannel(msg.Channel); host != "" {
+				w.fn(host)
+			}
+		}
+	}
+}
+
+func (w *redisRoutesWatcher) close() {
+	for _, pubsub := range w.pubsubs {
+		pubsub.Close()
+	}
+}
+
+func (w *redisRoutesWatcher) stop() {
+	close(w.quit)
+	w.wg.Wait()
+	w.close()
+}
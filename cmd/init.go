@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -72,45 +74,68 @@ func runServer(c *cli.Context) error {
 
 	rp := &reverseproxy.NativeReverseProxy{}
 
-	readOpts := backend.RedisOptions{
-		Network:       c.String("read-redis-network"),
-		Host:          c.String("read-redis-host"),
-		Port:          c.Int("read-redis-port"),
-		SentinelAddrs: c.String("read-redis-sentinel-addrs"),
-		SentinelName:  c.String("read-redis-sentinel-name"),
-		Password:      c.String("read-redis-password"),
-		DB:            c.Int("read-redis-db"),
-	}
-
-	writeOpts := backend.RedisOptions{
-		Network:       c.String("write-redis-network"),
-		Host:          c.String("write-redis-host"),
-		Port:          c.Int("write-redis-port"),
-		SentinelAddrs: c.String("write-redis-sentinel-addrs"),
-		SentinelName:  c.String("write-redis-sentinel-name"),
-		Password:      c.String("write-redis-password"),
-		DB:            c.Int("write-redis-db"),
-	}
+	readOpts := redisOptions(c, "read")
+	writeOpts := redisOptions(c, "write")
 
 	ctx := context.Background()
 
-	routesBE, err := backend.NewRedisBackend(ctx, readOpts, writeOpts)
+	routesBE, err := getRoutesBackend(ctx, c, readOpts, writeOpts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	if c.Bool("active-healthcheck") {
-		err = routesBE.StartMonitor(ctx)
+		err = routesBE.StartMonitor(ctx, backend.MonitorOptions{
+			Interval:    c.Duration("healthcheck-interval"),
+			Rise:        c.Int("healthcheck-rise"),
+			Fall:        c.Int("healthcheck-fall"),
+			Concurrency: c.Int("healthcheck-concurrency"),
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	if c.String("sticky-key") == "" {
+		log.Println("sticky-key is unset, sticky cookies are signed with a random key and only honored by the instance which set them")
+	}
+
 	r := router.Router{
-		Backend:        routesBE,
-		LogPath:        c.String("access-log"),
-		DeadBackendTTL: c.Int("dead-backend-time"),
-		CacheEnabled:   c.Bool("backend-cache"),
+		Backend:           routesBE,
+		LogPath:           c.String("access-log"),
+		DeadBackendTTL:    c.Int("dead-backend-time"),
+		CacheEnabled:      c.Bool("backend-cache"),
+		CacheSize:         c.Int("backend-cache-size"),
+		CacheTTL:          c.Duration("backend-cache-ttl"),
+		CacheInvalidation: c.Bool("backend-cache-invalidation"),
+		PathPrefixDepth:   c.Int("path-prefix-depth"),
+		StripPathPrefix:   c.Bool("strip-path-prefix"),
+		LoadBalancer:      c.String("load-balancer"),
+		HashKey:           c.String("hash-key"),
+		EWMADecay:         c.Duration("ewma-decay"),
+		StickyCookie:      c.String("sticky-cookie"),
+		StickyTTL:         c.Duration("sticky-ttl"),
+		StickyKey:         c.String("sticky-key"),
+		OutlierDetection: router.OutlierDetection{
+			ConsecutiveFailures: c.Int("outlier-consecutive-failures"),
+			Window:              c.Duration("outlier-window"),
+			MaxEjectionPercent:  c.Int("outlier-max-ejection-percent"),
+		},
+		CircuitBreaker: router.CircuitBreaker{
+			ErrorRate:        c.Float64("circuit-breaker-error-rate"),
+			Latency:          c.Duration("circuit-breaker-latency"),
+			MinRequests:      c.Int("circuit-breaker-min-requests"),
+			Window:           c.Duration("circuit-breaker-window"),
+			OpenDuration:     c.Duration("circuit-breaker-open-duration"),
+			HalfOpenRequests: c.Int("circuit-breaker-half-open-requests"),
+			PerBackend:       c.Bool("circuit-breaker-per-backend"),
+		},
+		RateLimit: router.RateLimit{
+			Rate:        c.Float64("rate-limit"),
+			Burst:       c.Int("rate-limit-burst"),
+			Key:         c.String("rate-limit-key"),
+			Distributed: c.Bool("rate-limit-distributed"),
+		},
 	}
 
 	err = r.Init(ctx)
@@ -128,6 +153,13 @@ func runServer(c *cli.Context) error {
 		ReadHeaderTimeout: c.Duration("client-read-header-timeout"),
 		WriteTimeout:      c.Duration("client-write-timeout"),
 		IdleTimeout:       c.Duration("client-idle-timeout"),
+		Retries:           c.Int("retries"),
+		RetryStatuses:     c.IntSlice("retry-status"),
+		RetryIdempotent:   c.Bool("retry-idempotent"),
+		RetryBudget:       c.Float64("retry-budget"),
+		RetryBufferSize:   c.Int64("retry-buffer-size"),
+		CircuitOpenStatus: c.Int("circuit-breaker-status"),
+		CircuitOpenBody:   c.String("circuit-breaker-body"),
 	})
 
 	if err != nil {
@@ -158,6 +190,57 @@ func runServer(c *cli.Context) error {
 	return nil
 }
 
+func redisOptions(c *cli.Context, side string) backend.RedisOptions {
+	opts := backend.RedisOptions{
+		Network:            c.String(side + "-redis-network"),
+		Host:               c.String(side + "-redis-host"),
+		Port:               c.Int(side + "-redis-port"),
+		SentinelAddrs:      c.String(side + "-redis-sentinel-addrs"),
+		SentinelName:       c.String(side + "-redis-sentinel-name"),
+		ClusterAddrs:       c.String(side + "-redis-cluster-addrs"),
+		Username:           c.String(side + "-redis-username"),
+		Password:           c.String(side + "-redis-password"),
+		PasswordFile:       c.String(side + "-redis-password-file"),
+		DB:                 c.Int(side + "-redis-db"),
+		TLS:                c.Bool(side + "-redis-tls"),
+		TLSCAFile:          c.String(side + "-redis-tls-ca-file"),
+		TLSCertFile:        c.String(side + "-redis-tls-cert-file"),
+		TLSKeyFile:         c.String(side + "-redis-tls-key-file"),
+		TLSServerName:      c.String(side + "-redis-tls-server-name"),
+		KeyPrefix:          c.String("redis-key-prefix"),
+		LegacyDeadBackends: c.Bool("legacy-dead-backends"),
+	}
+	// Only reads can be routed to replicas.
+	if side == "read" {
+		opts.ClusterReadFromReplicas = c.Bool("read-redis-cluster-read-from-replicas")
+	}
+	return opts
+}
+
+func eventOptions(c *cli.Context) backend.EventOptions {
+	return backend.EventOptions{
+		WebhookURLs:    c.StringSlice("event-webhook"),
+		WebhookRetries: c.Int("event-webhook-retries"),
+		WebhookTimeout: c.Duration("event-webhook-timeout"),
+	}
+}
+
+func getRoutesBackend(ctx context.Context, c *cli.Context, readOpts, writeOpts backend.RedisOptions) (backend.RoutesBackend, error) {
+	events := eventOptions(c)
+	switch kind := c.String("backend"); kind {
+	case "redis":
+		return backend.NewRedisBackend(ctx, readOpts, writeOpts, events)
+	case "file":
+		path := c.String("backend-file")
+		if path == "" {
+			return nil, errors.New("backend-file is required when using the file backend")
+		}
+		return backend.NewFileBackend(ctx, path, events)
+	default:
+		return nil, fmt.Errorf("invalid backend %q, possible values are \"redis\" and \"file\"", kind)
+	}
+}
+
 func getCertificateLoader(c *cli.Context, readOpts backend.RedisOptions) tls.CertificateLoader {
 	if c.String("tls-listen") == "" {
 		return nil
@@ -171,7 +254,7 @@ func getCertificateLoader(c *cli.Context, readOpts backend.RedisOptions) tls.Cer
 			log.Fatal(err)
 		}
 
-		return tls.NewRedisCertificateLoader(client)
+		return tls.NewRedisCertificateLoader(client, readOpts.KeyPrefix)
 	default:
 		return tls.NewFSCertificateLoader(from)
 	}
@@ -186,6 +269,15 @@ func Execute() {
 			Value:   ":8989",
 			Usage:   "Address to listen",
 		},
+		&cli.StringFlag{
+			Name:  "backend",
+			Value: "redis",
+			Usage: "Backend used to store routes, possible values are \"redis\" and \"file\"",
+		},
+		&cli.StringFlag{
+			Name:  "backend-file",
+			Usage: "Path to a YAML or JSON file containing routes when using the file backend. The file is reloaded whenever it changes.",
+		},
 		&cli.StringFlag{
 			Name:  "read-redis-network",
 			Value: "tcp",
@@ -210,8 +302,45 @@ func Execute() {
 			Usage: "Redis sentinel name",
 		},
 		&cli.StringFlag{
-			Name:  "read-redis-password",
-			Usage: "Redis password",
+			Name:  "read-redis-cluster-addrs",
+			Usage: "Comma separated list of redis cluster seed addresses, enables redis cluster mode",
+		},
+		&cli.BoolFlag{
+			Name:  "read-redis-cluster-read-from-replicas",
+			Usage: "Route read commands to redis cluster replicas",
+		},
+		&cli.StringFlag{
+			Name:  "read-redis-username",
+			Usage: "Redis ACL username",
+		},
+		&cli.StringFlag{
+			Name:    "read-redis-password",
+			Usage:   "Redis password",
+			EnvVars: []string{"ROXXY_READ_REDIS_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:  "read-redis-password-file",
+			Usage: "File containing the redis password, takes precedence over read-redis-password",
+		},
+		&cli.BoolFlag{
+			Name:  "read-redis-tls",
+			Usage: "Connect to redis using TLS",
+		},
+		&cli.StringFlag{
+			Name:  "read-redis-tls-ca-file",
+			Usage: "PEM encoded CA bundle used to verify the redis server certificate, enables TLS",
+		},
+		&cli.StringFlag{
+			Name:  "read-redis-tls-cert-file",
+			Usage: "PEM encoded client certificate used to authenticate to redis, enables TLS",
+		},
+		&cli.StringFlag{
+			Name:  "read-redis-tls-key-file",
+			Usage: "PEM encoded private key of the redis client certificate",
+		},
+		&cli.StringFlag{
+			Name:  "read-redis-tls-server-name",
+			Usage: "Server name used to verify the redis server certificate",
 		},
 		&cli.IntFlag{
 			Name:  "read-redis-db",
@@ -241,13 +370,55 @@ func Execute() {
 			Usage: "Redis sentinel name",
 		},
 		&cli.StringFlag{
-			Name:  "write-redis-password",
-			Usage: "Redis password",
+			Name:  "write-redis-cluster-addrs",
+			Usage: "Comma separated list of redis cluster seed addresses, enables redis cluster mode",
+		},
+		&cli.StringFlag{
+			Name:  "write-redis-username",
+			Usage: "Redis ACL username",
+		},
+		&cli.StringFlag{
+			Name:    "write-redis-password",
+			Usage:   "Redis password",
+			EnvVars: []string{"ROXXY_WRITE_REDIS_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:  "write-redis-password-file",
+			Usage: "File containing the redis password, takes precedence over write-redis-password",
+		},
+		&cli.BoolFlag{
+			Name:  "write-redis-tls",
+			Usage: "Connect to redis using TLS",
+		},
+		&cli.StringFlag{
+			Name:  "write-redis-tls-ca-file",
+			Usage: "PEM encoded CA bundle used to verify the redis server certificate, enables TLS",
+		},
+		&cli.StringFlag{
+			Name:  "write-redis-tls-cert-file",
+			Usage: "PEM encoded client certificate used to authenticate to redis, enables TLS",
+		},
+		&cli.StringFlag{
+			Name:  "write-redis-tls-key-file",
+			Usage: "PEM encoded private key of the redis client certificate",
+		},
+		&cli.StringFlag{
+			Name:  "write-redis-tls-server-name",
+			Usage: "Server name used to verify the redis server certificate",
 		},
 		&cli.IntFlag{
 			Name:  "write-redis-db",
 			Usage: "Redis database number",
 		},
+		&cli.StringFlag{
+			Name:  "redis-key-prefix",
+			Usage: "Prefix added to every redis key and channel, allowing several roxxy fleets to share the same redis",
+		},
+		&cli.BoolFlag{
+			Name:  "legacy-dead-backends",
+			Value: true,
+			Usage: "Also write dead backends in the format read by older roxxy versions, disable once every instance is upgraded",
+		},
 		&cli.IntFlag{
 			Name:  "request-timeout",
 			Value: 30,
@@ -258,6 +429,28 @@ func Execute() {
 			Value: 10,
 			Usage: "Dial backend request timeout in seconds",
 		},
+		&cli.IntFlag{
+			Name:  "retries",
+			Usage: "Number of times a request is retried on another backend after a dial error or a --retry-status response, 0 disables retries",
+		},
+		&cli.IntSliceFlag{
+			Name:  "retry-status",
+			Usage: "Backend response status of idempotent requests retried on another backend, may be repeated",
+		},
+		&cli.BoolFlag{
+			Name:  "retry-idempotent",
+			Usage: "Also retry idempotent requests after network errors once sent to the backend",
+		},
+		&cli.Float64Flag{
+			Name:  "retry-budget",
+			Value: 0.2,
+			Usage: "Maximum ratio of retries to requests, 0 allows every retry",
+		},
+		&cli.Int64Flag{
+			Name:  "retry-buffer-size",
+			Value: 64 * 1024,
+			Usage: "Maximum size in bytes of the request bodies buffered to be retried, larger requests are only retried after dial errors",
+		},
 		&cli.DurationFlag{
 			Name:  "client-read-timeout",
 			Value: 0,
@@ -278,6 +471,35 @@ func Execute() {
 			Value: 0,
 			Usage: "Maximum amount of time to wait for the next request when keep-alives are enabled",
 		},
+		&cli.StringFlag{
+			Name:  "load-balancer",
+			Value: "weighted",
+			Usage: "Load balancing algorithm used by frontends without their own, possible values are \"weighted\", \"round-robin\", \"least-conn\", \"consistent-hash\" and \"p2c\"",
+		},
+		&cli.StringFlag{
+			Name:  "hash-key",
+			Value: "ip",
+			Usage: "Request part hashed by the consistent-hash load balancer, possible values are \"ip\", \"path\", \"header:<name>\" and \"cookie:<name>\"",
+		},
+		&cli.DurationFlag{
+			Name:  "ewma-decay",
+			Value: 10 * time.Second,
+			Usage: "Time constant of the backend latency averages used by the p2c load balancer",
+		},
+		&cli.StringFlag{
+			Name:  "sticky-cookie",
+			Value: "ROXXY_BACKEND",
+			Usage: "Name of the cookie naming the backend of sticky frontends",
+		},
+		&cli.DurationFlag{
+			Name:  "sticky-ttl",
+			Usage: "Lifetime of sticky cookies, 0 keeps them for the browser session",
+		},
+		&cli.StringFlag{
+			Name:    "sticky-key",
+			EnvVars: []string{"ROXXY_STICKY_KEY"},
+			Usage:   "Key signing sticky cookies, shared by every roxxy instance. A random key is used when unset, so cookies are only honored by the instance which set them",
+		},
 		&cli.IntFlag{
 			Name:  "dead-backend-time",
 			Value: 30,
@@ -296,15 +518,144 @@ func Execute() {
 			Name:  "active-healthcheck",
 			Usage: "Enable active healthcheck on dead backends once they are marked as dead. Enabling this flag will result in dead backends only being enabled again once the active healthcheck routine is able to reach them.",
 		},
+		&cli.DurationFlag{
+			Name:  "healthcheck-interval",
+			Usage: "Interval between active healthchecks of every backend, requires active-healthcheck. Healthy backends are marked as dead after healthcheck-fall consecutive failures and dead backends revived after healthcheck-rise consecutive successes. 0 only checks backends once they are marked as dead.",
+		},
+		&cli.IntFlag{
+			Name:  "healthcheck-rise",
+			Value: 2,
+			Usage: "Consecutive successful healthchecks needed to revive a dead backend when healthcheck-interval is set.",
+		},
+		&cli.IntFlag{
+			Name:  "healthcheck-fall",
+			Value: 3,
+			Usage: "Consecutive failed healthchecks needed to mark a backend as dead when healthcheck-interval is set.",
+		},
+		&cli.IntFlag{
+			Name:  "healthcheck-concurrency",
+			Value: 5,
+			Usage: "Maximum number of active healthchecks running at the same time.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "event-webhook",
+			Usage: "URL receiving a JSON POST every time a backend is marked as dead or revived. Can be repeated.",
+		},
+		&cli.IntFlag{
+			Name:  "event-webhook-retries",
+			Value: 3,
+			Usage: "Number of retries of failed event webhook deliveries, with an exponential backoff starting at 1s.",
+		},
+		&cli.DurationFlag{
+			Name:  "event-webhook-timeout",
+			Value: 10 * time.Second,
+			Usage: "Timeout of each event webhook delivery.",
+		},
 		&cli.BoolFlag{
 			Name:  "backend-cache",
-			Usage: "Enable caching backend results for 2 seconds. This may cause temporary inconsistencies.",
+			Usage: "Enable caching backend results for backend-cache-ttl. This may cause temporary inconsistencies.",
+		},
+		&cli.IntFlag{
+			Name:  "backend-cache-size",
+			Value: 100,
+			Usage: "Maximum number of frontends kept in the backend cache",
+		},
+		&cli.DurationFlag{
+			Name:  "backend-cache-ttl",
+			Value: 2 * time.Second,
+			Usage: "Time backend results are kept in the backend cache",
+		},
+		&cli.BoolFlag{
+			Name:  "backend-cache-invalidation",
+			Usage: "Evict frontends from the backend cache as soon as their routes change. Changes made by roxxy are always published, changes made by other redis clients require keyspace notifications to be enabled. Allows using a long backend-cache-ttl.",
+		},
+		&cli.IntFlag{
+			Name:  "path-prefix-depth",
+			Usage: "Number of path segments considered when looking up path-prefix frontends like frontend:example.com/api, the longest matching prefix wins. 0 disables path-prefix routing.",
+		},
+		&cli.BoolFlag{
+			Name:  "strip-path-prefix",
+			Usage: "Remove the matched path prefix of path-prefix frontends before forwarding requests to the backend.",
+		},
+		&cli.IntFlag{
+			Name:  "outlier-consecutive-failures",
+			Usage: "Mark a backend as dead after this many consecutive network errors or 5xx responses. 0 disables outlier detection, marking backends as dead on the first network error.",
+		},
+		&cli.DurationFlag{
+			Name:  "outlier-window",
+			Value: 30 * time.Second,
+			Usage: "Time window the consecutive failures must happen in to mark a backend as dead, 0 disables the window.",
+		},
+		&cli.IntFlag{
+			Name:  "outlier-max-ejection-percent",
+			Value: 50,
+			Usage: "Maximum percentage of the backends of a frontend marked as dead by outlier detection.",
+		},
+		&cli.Float64Flag{
+			Name:  "circuit-breaker-error-rate",
+			Usage: "Ratio of failed requests opening the circuit breaker of a frontend, 0 disables circuit breakers.",
+		},
+		&cli.DurationFlag{
+			Name:  "circuit-breaker-latency",
+			Usage: "Responses slower than this count as failures, 0 only counts network errors and 5xx responses.",
+		},
+		&cli.IntFlag{
+			Name:  "circuit-breaker-min-requests",
+			Value: 20,
+			Usage: "Minimum number of requests within the window before a circuit breaker opens.",
+		},
+		&cli.DurationFlag{
+			Name:  "circuit-breaker-window",
+			Value: 10 * time.Second,
+			Usage: "Time window the error rate is computed over.",
+		},
+		&cli.DurationFlag{
+			Name:  "circuit-breaker-open-duration",
+			Value: 30 * time.Second,
+			Usage: "Time an open circuit breaker rejects requests before letting probe requests through.",
+		},
+		&cli.IntFlag{
+			Name:  "circuit-breaker-half-open-requests",
+			Value: 5,
+			Usage: "Number of probe requests which must succeed to close a half-open circuit breaker.",
+		},
+		&cli.BoolFlag{
+			Name:  "circuit-breaker-per-backend",
+			Usage: "Also break the circuit of each backend, skipping backends with an open circuit breaker.",
+		},
+		&cli.IntFlag{
+			Name:  "circuit-breaker-status",
+			Value: 503,
+			Usage: "Status of the responses to requests rejected by an open circuit breaker.",
+		},
+		&cli.StringFlag{
+			Name:  "circuit-breaker-body",
+			Value: "circuit breaker open",
+			Usage: "Body of the responses to requests rejected by an open circuit breaker.",
+		},
+		&cli.Float64Flag{
+			Name:  "rate-limit",
+			Usage: "Requests per second allowed from each client of a frontend, 0 disables rate limits unless set for the frontend.",
+		},
+		&cli.IntFlag{
+			Name:  "rate-limit-burst",
+			Usage: "Requests a client can send at once, 0 allows a second worth of requests.",
+		},
+		&cli.StringFlag{
+			Name:  "rate-limit-key",
+			Value: "ip",
+			Usage: "Part of the request telling clients apart: ip, path, header:<name> or cookie:<name>.",
+		},
+		&cli.BoolFlag{
+			Name:  "rate-limit-distributed",
+			Usage: "Share rate limits between every roxxy instance through redis.",
 		},
 	}
 	app.Name = "roxxy"
 	app.Usage = "http and websockets reverse proxy"
 	app.Version = Version
 	app.Action = runServer
+	app.Commands = adminCommands()
 
 	err := app.Run(os.Args)
 	if err != nil {
@@ -0,0 +1,284 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aaqaishtyaq/roxxy/backend"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// adminCommands manage the routes stored in redis, connecting with the
+// write-redis-* flags.
+func adminCommands() []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:  "route",
+			Usage: "Manage the frontends stored in redis",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List the hosts of every frontend",
+					Action: withAdmin(0, routeList),
+				},
+				{
+					Name:      "show",
+					Usage:     "Show the backends of a frontend and their dead and health check state",
+					ArgsUsage: "<host>",
+					Action:    withAdmin(1, routeShow),
+				},
+				{
+					Name:      "add",
+					Usage:     "Create a frontend",
+					ArgsUsage: "<host> <id> [backend...]",
+					Action:    withAdmin(2, routeAdd),
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove a frontend along with its dead backends, weights, options and health check",
+					ArgsUsage: "<host>",
+					Action:    withAdmin(1, routeRemove),
+				},
+			},
+		},
+		{
+			Name:  "routes",
+			Usage: "Back up and restore the routes stored in redis",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "export",
+					Usage:     "Write every frontend, health check and regex frontend to a JSON or YAML document",
+					ArgsUsage: "[file]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "format",
+							Value: "json",
+							Usage: "Format of the document, possible values are \"json\" and \"yaml\"",
+						},
+						&cli.BoolFlag{
+							Name:  "tls",
+							Usage: "Include the certificates stored in redis",
+						},
+					},
+					Action: withAdmin(0, routesExport),
+				},
+				{
+					Name:      "import",
+					Usage:     "Apply a document written by export, frontends may also be written as hipache lists",
+					ArgsUsage: "<file>",
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Print the changes without applying them",
+						},
+						&cli.BoolFlag{
+							Name:  "prune",
+							Usage: "Remove frontends missing from the document",
+						},
+					},
+					Action: withAdmin(1, routesImport),
+				},
+			},
+		},
+		{
+			Name:  "backend",
+			Usage: "Manage the backends of a frontend stored in redis",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "add",
+					Usage:     "Add a backend to a frontend",
+					ArgsUsage: "<host> <backend>",
+					Action:    withAdmin(2, backendAdd),
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove a backend from a frontend",
+					ArgsUsage: "<host> <backend>",
+					Action:    withAdmin(2, backendRemove),
+				},
+				{
+					Name:      "dead",
+					Usage:     "Mark a backend as dead",
+					ArgsUsage: "<host> <backend>",
+					Flags: []cli.Flag{
+						&cli.DurationFlag{
+							Name:  "ttl",
+							Value: 30 * time.Second,
+							Usage: "Time the backend remains dead",
+						},
+					},
+					Action: withAdmin(2, backendDead),
+				},
+				{
+					Name:      "revive",
+					Usage:     "Revive a dead backend",
+					ArgsUsage: "<host> <backend>",
+					Action:    withAdmin(2, backendRevive),
+				},
+			},
+		},
+	}
+}
+
+// withAdmin connects to redis before running fn, failing with the command
+// usage when less than minArgs arguments are given.
+func withAdmin(minArgs int, fn func(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		if c.NArg() < minArgs {
+			cli.ShowCommandHelp(c, c.Command.Name)
+			return fmt.Errorf("%s requires %s", c.Command.FullName(), c.Command.ArgsUsage)
+		}
+		ctx := context.Background()
+		admin, err := backend.NewRedisAdmin(ctx, redisOptions(c, "write"), eventOptions(c))
+		if err != nil {
+			return err
+		}
+		defer admin.Close()
+		return fn(ctx, c, admin)
+	}
+}
+
+func routeList(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error {
+	hosts, err := admin.Routes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		fmt.Fprintln(c.App.Writer, host)
+	}
+	return nil
+}
+
+func routeShow(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error {
+	status, err := admin.Route(ctx, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.App.Writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Host:\t%s\n", status.Host)
+	fmt.Fprintf(w, "ID:\t%s\n", status.ID)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "BACKEND\tWEIGHT\tSTATE\tCHECKED BY")
+	for _, b := range status.Backends {
+		state := "alive"
+		if !b.DeadUntil.IsZero() {
+			state = fmt.Sprintf("dead until %s", b.DeadUntil.Format(time.RFC3339))
+		}
+		checkedBy := b.CheckedBy
+		if checkedBy == "" {
+			checkedBy = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", b.URL, b.Weight, state, checkedBy)
+	}
+	printFields(w, "Healthcheck", status.Healthcheck)
+	printFields(w, "Options", status.Options)
+	return w.Flush()
+}
+
+func printFields(w *tabwriter.Writer, title string, fields map[string]string) {
+	if len(fields) == 0 {
+		return
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "\n%s:\n", title)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s:\t%s\n", name, fields[name])
+	}
+}
+
+func routeAdd(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error {
+	args := c.Args().Slice()
+	return admin.AddRoute(ctx, args[0], args[1], args[2:]...)
+}
+
+func routeRemove(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error {
+	return admin.RemoveRoute(ctx, c.Args().Get(0))
+}
+
+func routesExport(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error {
+	var marshal func(interface{}) ([]byte, error)
+	switch format := c.String("format"); format {
+	case "json":
+		marshal = func(v interface{}) ([]byte, error) {
+			data, err := json.MarshalIndent(v, "", "  ")
+			return append(data, '\n'), err
+		}
+	case "yaml":
+		marshal = yaml.Marshal
+	default:
+		return fmt.Errorf("invalid format %q, possible values are \"json\" and \"yaml\"", format)
+	}
+	dump, err := admin.Export(ctx, c.Bool("tls"))
+	if err != nil {
+		return err
+	}
+	data, err := marshal(dump)
+	if err != nil {
+		return err
+	}
+	if path := c.Args().Get(0); path != "" && path != "-" {
+		return ioutil.WriteFile(path, data, 0o600)
+	}
+	_, err = c.App.Writer.Write(data)
+	return err
+}
+
+func routesImport(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error {
+	var data []byte
+	var err error
+	if path := c.Args().Get(0); path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	// JSON documents are also valid YAML.
+	var dump backend.RoutesDump
+	err = yaml.Unmarshal(data, &dump)
+	if err != nil {
+		return err
+	}
+	changes, err := admin.Import(ctx, &dump, backend.ImportOptions{
+		DryRun: c.Bool("dry-run"),
+		Prune:  c.Bool("prune"),
+	})
+	for _, change := range changes {
+		fmt.Fprintln(c.App.Writer, change)
+	}
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(c.App.Writer, "routes are up to date")
+	}
+	return nil
+}
+
+func backendAdd(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error {
+	return admin.AddBackend(ctx, c.Args().Get(0), c.Args().Get(1))
+}
+
+func backendRemove(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error {
+	return admin.RemoveBackend(ctx, c.Args().Get(0), c.Args().Get(1))
+}
+
+func backendDead(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error {
+	return admin.MarkDead(ctx, c.Args().Get(0), c.Args().Get(1), c.Duration("ttl"))
+}
+
+func backendRevive(ctx context.Context, c *cli.Context, admin *backend.RedisAdmin) error {
+	return admin.Revive(ctx, c.Args().Get(0), c.Args().Get(1))
+}
@@ -10,7 +10,9 @@ require (
 	github.com/prometheus/client_golang v1.14.0
 	github.com/urfave/cli/v2 v2.17.1
 	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
+	google.golang.org/protobuf v1.28.1
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -28,5 +30,5 @@ require (
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
 	golang.org/x/sys v0.0.0-20220829200755-d48e67d00261 // indirect
-	google.golang.org/protobuf v1.28.1 // indirect
+	golang.org/x/text v0.3.7 // indirect
 )
@@ -16,12 +16,15 @@ import (
 	"github.com/go-redis/redis/v8"
 )
 
-const redisDB = 5
+const (
+	redisDB   = 5
+	keyPrefix = "integration:"
+)
 
 func clearKeys(r *redis.Client) error {
 	ctx := context.Background()
-	val := r.Keys(ctx, "frontend:*").Val()
-	val = append(val, r.Keys(ctx, "dead:*").Val()...)
+	val := r.Keys(ctx, keyPrefix+"frontend:*").Val()
+	val = append(val, r.Keys(ctx, keyPrefix+"dead:*").Val()...)
 	if len(val) > 0 {
 		return r.Del(ctx, val...).Err()
 	}
@@ -57,15 +60,16 @@ func BenchmarkFullStackNativeRedisNoCache(b *testing.B) {
 	}
 	backends = append([]interface{}{"benchfrontend"}, backends...)
 	ctx := context.Background()
-	err := r.RPush(ctx, "frontend:myfrontend.com", backends...).Err()
+	err := r.RPush(ctx, keyPrefix+"frontend:myfrontend.com", backends...).Err()
 	if err != nil {
 		b.Fatal(err)
 	}
 	rp := &reverseproxy.NativeReverseProxy{}
 	opts := backend.RedisOptions{
-		DB: redisDB,
+		DB:        redisDB,
+		KeyPrefix: keyPrefix,
 	}
-	be, err := backend.NewRedisBackend(ctx, opts, opts)
+	be, err := backend.NewRedisBackend(ctx, opts, opts, backend.EventOptions{})
 	if err != nil {
 		b.Fatal(err)
 	}
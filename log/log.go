@@ -56,6 +56,7 @@ type LogEntry struct {
 	ForwardedFor    string
 	StatusCode      int
 	ContentLength   int64
+	RateLimited     bool
 	Err             *ErrEntry
 }
 
@@ -164,9 +165,15 @@ func (l *Logger) logWriter() {
 		if !strings.HasPrefix(ip, "::") {
 			ip = "::ffff:" + ip
 		}
+		// Requests rejected by rate limits are flagged at the end of the
+		// line, keeping the fields before it for existing parsers.
+		flags := ""
+		if el.RateLimited {
+			flags = " rate-limited"
+		}
 		fmt.Fprintf(
 			l.writer,
-			"%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" \"%s:%s\" \"%s\" \"%s\" %0.3f %0.3f\n",
+			"%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" \"%s:%s\" \"%s\" \"%s\" %0.3f %0.3f%s\n",
 			ip,
 			nowFormatted,
 			el.Method,
@@ -182,6 +189,7 @@ func (l *Logger) logWriter() {
 			el.ForwardedFor,
 			float64(el.TotalDuration)/float64(time.Second),
 			float64(el.BackendDuration)/float64(time.Second),
+			flags,
 		)
 	}
 }
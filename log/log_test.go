@@ -63,6 +63,14 @@ func (s *LogSuite) TestNewWriterLogger(c *check.C) {
 	c.Assert(buffer.String(), check.Equals, "::ffff: - - [Mon Jan  1 00:00:00 UTC 0001] \"  \" 0 0 \"\" \"\" \":\" \"\" \"\" 0.000 0.000\n")
 }
 
+func (s *LogSuite) TestWriterLoggerRateLimited(c *check.C) {
+	buffer := &bytes.Buffer{}
+	logger := NewWriterLogger(nopCloseWriter{buffer})
+	logger.MessageRaw(&LogEntry{StatusCode: 429, RateLimited: true})
+	logger.Stop()
+	c.Assert(buffer.String(), check.Equals, "::ffff: - - [Mon Jan  1 00:00:00 UTC 0001] \"  \" 429 0 \"\" \"\" \":\" \"\" \"\" 0.000 0.000 rate-limited\n")
+}
+
 func (s *LogSuite) TestLoggerMessageAfterStop(c *check.C) {
 	buffer := &bytes.Buffer{}
 	logger := NewWriterLogger(nopCloseWriter{buffer})
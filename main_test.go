@@ -110,7 +110,7 @@ func (s *S) TestServeHTTPStressAllLeakDetector(c *check.C) {
 		Port: 6379,
 		DB:   int(redisDB),
 	}
-	routesBE, err := backend.NewRedisBackend(ctx, opts, opts)
+	routesBE, err := backend.NewRedisBackend(ctx, opts, opts, backend.EventOptions{})
 	c.Assert(err, check.IsNil)
 	r := router.Router{Backend: routesBE}
 	err = r.Init(ctx)
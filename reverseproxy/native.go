@@ -1,11 +1,14 @@
 package reverseproxy
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -25,6 +28,7 @@ var (
 	emptyResponseBody           = &fixedReadCloser{}
 	noRouteResponseBody         = &fixedReadCloser{value: noRouteResponseContent}
 	allBackendsDeadResponseBody = &fixedReadCloser{value: allBackendsDeadContent}
+	rateLimitedResponseBody     = &fixedReadCloser{value: rateLimitedContent}
 	noopDirector                = func(*http.Request) {}
 
 	_ ReverseProxy = &NativeReverseProxy{}
@@ -71,6 +75,8 @@ type NativeReverseProxy struct {
 	servers []*http.Server
 	rp      *httputil.ReverseProxy
 	dialer  *net.Dialer
+
+	retryBudget *retryBudget
 }
 
 type fixedReadCloser struct {
@@ -110,11 +116,12 @@ func (rp *NativeReverseProxy) Initialize(rpConfig ReverseProxyConfig) error {
 		KeepAlive: 30 * time.Second,
 	}
 	rp.Transport = http.Transport{
-		Dial:                rp.dialer.Dial,
+		DialContext:         rp.dialContext,
 		TLSHandshakeTimeout: rp.DialTimeout,
 		MaxIdleConnsPerHost: 100,
 		DisableCompression:  true,
 	}
+	rp.retryBudget = newRetryBudget(rp.RetryBudget)
 	rp.rp = &httputil.ReverseProxy{
 		Director:      noopDirector,
 		Transport:     rp,
@@ -124,6 +131,19 @@ func (rp *NativeReverseProxy) Initialize(rpConfig ReverseProxyConfig) error {
 	return nil
 }
 
+type dialTimeoutKey struct{}
+
+// dialContext dials with the dial timeout of the frontend, when set in ctx by
+// roundTripWithData, instead of the global one.
+func (rp *NativeReverseProxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if timeout, ok := ctx.Value(dialTimeoutKey{}).(time.Duration); ok {
+		dialer := *rp.dialer
+		dialer.Timeout = timeout
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return rp.dialer.DialContext(ctx, network, addr)
+}
+
 func (rp *NativeReverseProxy) Listen(listener net.Listener, tlsConfig *tls.Config) {
 	server := &http.Server{
 		ReadTimeout:       rp.ReadTimeout,
@@ -178,40 +198,65 @@ func (rp *NativeReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 	}
 	upgrade := fastHeaderGet(req.Header, "Upgrade")
 	if upgrade != "" && strings.ToLower(upgrade) == "websocket" {
-		reqData, err := rp.serveWebsocket(rw, req)
-		if err != nil {
+		reqData, isDead, err := rp.serveWebsocket(rw, req)
+		if err == ErrCircuitOpen {
+			rsp := rp.circuitOpenResponse()
+			rw.WriteHeader(rsp.StatusCode)
+			io.Copy(rw, rsp.Body)
+		} else if err == ErrRateLimited {
+			setRateLimitHeaders(rw.Header(), reqData.RateLimit)
+			rw.WriteHeader(http.StatusTooManyRequests)
+			rw.Write(rateLimitedContent)
+		} else if err != nil {
 			reqData.logError(req.URL.Path, rp.ridString(req), err)
+			reqData.StatusCode = http.StatusBadGateway
 			http.Error(rw, "", http.StatusBadGateway)
 		}
+		// Websocket sessions aren't access logged, ending them releases the
+		// backend chosen for the session and records failed sessions.
+		err = rp.Router.EndRequest(ctx, reqData, isDead, nil)
+		if err != nil {
+			reqData.logError(req.URL.Path, rp.ridString(req), err)
+		}
 		return
 	}
 	req.Header["Roxxy-X-Forwarded-For"] = req.Header["X-Forwarded-For"]
 	rp.rp.ServeHTTP(rw, req)
 }
 
-func (rp *NativeReverseProxy) serveWebsocket(rw http.ResponseWriter, req *http.Request) (*RequestData, error) {
-	ctx := context.Background()
-	reqData, err := rp.Router.ChooseBackend(ctx, req.Host)
+// serveWebsocket proxies a websocket session, isDead is set when the chosen
+// backend can't be reached.
+func (rp *NativeReverseProxy) serveWebsocket(rw http.ResponseWriter, req *http.Request) (reqData *RequestData, isDead bool, err error) {
+	ctx := WithRequest(context.Background(), req)
+	reqData, err = rp.Router.ChooseBackend(ctx, req.Host, req.URL.Path)
 	if err != nil {
-		return reqData, err
+		return reqData, false, err
+	}
+	if reqData.StripPrefix != "" {
+		stripPrefix(req.URL, reqData.StripPrefix)
 	}
 	url, err := url.Parse(reqData.Backend)
 	if err != nil {
-		return reqData, err
+		return reqData, false, err
 	}
 	req.Host = url.Host
-	dstConn, err := rp.dialer.Dial("tcp", url.Host)
+	setRequestHeaders(req, reqData)
+	dialCtx := context.Background()
+	if reqData.Frontend != nil && reqData.Frontend.Options.DialTimeout > 0 {
+		dialCtx = context.WithValue(dialCtx, dialTimeoutKey{}, reqData.Frontend.Options.DialTimeout)
+	}
+	dstConn, err := rp.dialContext(dialCtx, "tcp", url.Host)
 	if err != nil {
-		return reqData, err
+		return reqData, true, err
 	}
 	defer dstConn.Close()
 	hj, ok := rw.(http.Hijacker)
 	if !ok {
-		return reqData, errors.New("not a hijacker")
+		return reqData, false, errors.New("not a hijacker")
 	}
 	conn, _, err := hj.Hijack()
 	if err != nil {
-		return reqData, err
+		return reqData, false, err
 	}
 	defer conn.Close()
 	var clientIP string
@@ -223,7 +268,14 @@ func (rp *NativeReverseProxy) serveWebsocket(rw http.ResponseWriter, req *http.R
 	}
 	err = req.Write(dstConn)
 	if err != nil {
-		return reqData, err
+		return reqData, false, err
+	}
+	var dst io.Reader = dstConn
+	if reqData.StickyCookie != nil {
+		dst, err = setUpgradeCookie(conn, dstConn, req, reqData.StickyCookie)
+		if err != nil {
+			return reqData, false, err
+		}
 	}
 	errc := make(chan error, 2)
 	cp := func(dst io.Writer, src io.Reader) {
@@ -231,19 +283,80 @@ func (rp *NativeReverseProxy) serveWebsocket(rw http.ResponseWriter, req *http.R
 		errc <- err
 	}
 	go cp(dstConn, conn)
-	go cp(conn, dstConn)
+	go cp(conn, dst)
 	<-errc
-	return reqData, nil
+	return reqData, false, nil
+}
+
+// setUpgradeCookie relays the backend response to the upgrade request with
+// cookie added. The returned reader holds the data sent by the backend after
+// its response.
+func setUpgradeCookie(conn net.Conn, dstConn net.Conn, req *http.Request, cookie *http.Cookie) (io.Reader, error) {
+	br := bufio.NewReader(dstConn)
+	rsp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Header.Add("Set-Cookie", cookie.String())
+	err = rsp.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	return br, nil
 }
 
 func (rp *NativeReverseProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	retry := rp.newRetry(req)
+	attempt := req
+	if retry != nil {
+		attempt = retry.request()
+	}
+	reqData, err := rp.chooseBackend(attempt, nil)
+	if err != nil {
+		// Rejections are only access logged, an abusive client would flood
+		// the error log.
+		if err != ErrRateLimited {
+			reqData.logError(attempt.URL.Path, rp.ridString(attempt), err)
+		}
+		rsp, _ := rp.roundTripWithData(attempt, reqData, err)
+		return rsp, nil
+	}
+	for {
+		rsp, reason := rp.roundTripWithData(attempt, reqData, nil)
+		if reason == "" || !rp.nextRetry(retry, reqData.Backend) {
+			return rsp, nil
+		}
+		next := retry.request()
+		nextData, err := rp.chooseBackend(next, retry.tried)
+		if err != nil {
+			// No backend left to try, the failed response is kept.
+			rp.Router.EndRequest(context.Background(), nextData, false, nil)
+			return rsp, nil
+		}
+		// The rate limit is only taken by the first attempt.
+		nextData.RateLimit = reqData.RateLimit
+		rsp.Body.Close()
+		retriesTotal.WithLabelValues(reason).Inc()
+		reqData.logError(attempt.URL.Path, rp.ridString(attempt), fmt.Errorf("retry %d of %d on %s after %s failure", retry.retries, rp.Retries, nextData.Backend, reason))
+		attempt, reqData = next, nextData
+	}
+}
+
+// chooseBackend asks the router for a backend other than exclude and points
+// req to it.
+func (rp *NativeReverseProxy) chooseBackend(req *http.Request, exclude []string) (*RequestData, error) {
 	req.URL.Scheme = ""
 	req.URL.Host = ""
-	ctx := context.Background()
-	reqData, err := rp.Router.ChooseBackend(ctx, req.Host)
+	ctx := WithRequest(context.Background(), req)
+	if len(exclude) > 0 {
+		ctx = WithExcludedBackends(ctx, exclude)
+	}
+	reqData, err := rp.Router.ChooseBackend(ctx, req.Host, req.URL.Path)
 	if err != nil {
-		reqData.logError(req.URL.Path, rp.ridString(req), err)
-		return rp.roundTripWithData(req, reqData, err), nil
+		return reqData, err
+	}
+	if reqData.StripPrefix != "" {
+		stripPrefix(req.URL, reqData.StripPrefix)
 	}
 	u, err := url.Parse(reqData.Backend)
 	if err == nil {
@@ -254,7 +367,7 @@ func (rp *NativeReverseProxy) RoundTrip(req *http.Request) (*http.Response, erro
 		req.URL.Scheme = "http"
 		req.URL.Host = reqData.Backend
 	}
-	return rp.roundTripWithData(req, reqData, nil), nil
+	return reqData, nil
 }
 
 func (rp *NativeReverseProxy) doResponse(req *http.Request, reqData *RequestData, rsp *http.Response, isDebug bool, isDead bool, backendDuration time.Duration, originalForwardedFor string) *http.Response {
@@ -276,6 +389,7 @@ func (rp *NativeReverseProxy) doResponse(req *http.Request, reqData *RequestData
 			StatusCode:      rsp.StatusCode,
 			ContentLength:   rsp.ContentLength,
 			ForwardedFor:    originalForwardedFor,
+			RateLimited:     reqData.RateLimit != nil && reqData.RateLimit.Exceeded,
 		}
 	}
 	rsp.Request = req
@@ -284,11 +398,25 @@ func (rp *NativeReverseProxy) doResponse(req *http.Request, reqData *RequestData
 	if rsp.Header == nil {
 		rsp.Header = http.Header{}
 	}
+	if reqData.Frontend != nil {
+		for name, value := range reqData.Frontend.Options.ResponseHeaders {
+			rsp.Header.Set(name, value)
+		}
+	}
+	if reqData.StickyCookie != nil {
+		rsp.Header.Add("Set-Cookie", reqData.StickyCookie.String())
+	}
+	setRateLimitHeaders(rsp.Header, reqData.RateLimit)
 	if isDebug {
 		fastHeaderSet(rsp.Header, "X-Debug-Backend-Url", reqData.Backend)
 		fastHeaderSet(rsp.Header, "X-Debug-Backend-Id", strconv.FormatUint(uint64(reqData.BackendIdx), 10))
 		fastHeaderSet(rsp.Header, "X-Debug-Frontend-Key", reqData.Host)
+		if reqData.CircuitState != "" {
+			fastHeaderSet(rsp.Header, "X-Debug-Circuit-Breaker", reqData.CircuitState)
+		}
 	}
+	reqData.StatusCode = rsp.StatusCode
+	reqData.BackendDuration = backendDuration
 	ctx := context.Background()
 	err := rp.Router.EndRequest(ctx, reqData, isDead, logEntry)
 	if err != nil {
@@ -300,13 +428,23 @@ func (rp *NativeReverseProxy) doResponse(req *http.Request, reqData *RequestData
 	return rsp
 }
 
-func (rp *NativeReverseProxy) roundTripWithData(req *http.Request, reqData *RequestData, err error) (rsp *http.Response) {
+// roundTripWithData sends req to the backend of reqData, the returned reason
+// is set when the attempt can be retried on another backend.
+func (rp *NativeReverseProxy) roundTripWithData(req *http.Request, reqData *RequestData, err error) (rsp *http.Response, reason string) {
 	isDebug := fastHeaderGet(req.Header, "X-Debug-Router") != ""
 	fastHeaderDel(req.Header, "X-Debug-Router")
 	originalForwardedFor := fastHeaderGet(req.Header, "Roxxy-X-Forwarded-For")
 	fastHeaderDel(req.Header, "Roxxy-X-Forwarded-For")
 	if err != nil || req.URL.Scheme == "" || req.URL.Host == "" {
 		switch err {
+		case ErrCircuitOpen:
+			rsp = rp.circuitOpenResponse()
+		case ErrRateLimited:
+			rsp = &http.Response{
+				StatusCode:    http.StatusTooManyRequests,
+				ContentLength: int64(len(rateLimitedResponseBody.value)),
+				Body:          rateLimitedResponseBody,
+			}
 		case ErrAllBackendsDead:
 			rsp = &http.Response{
 				StatusCode:    http.StatusServiceUnavailable,
@@ -325,11 +463,21 @@ func (rp *NativeReverseProxy) roundTripWithData(req *http.Request, reqData *Requ
 				Body:       emptyResponseBody,
 			}
 		}
-		return rp.doResponse(req, reqData, rsp, isDebug, false, 0, originalForwardedFor)
+		return rp.doResponse(req, reqData, rsp, isDebug, false, 0, originalForwardedFor), ""
+	}
+	requestTimeout := rp.RequestTimeout
+	if reqData.Frontend != nil {
+		opts := reqData.Frontend.Options
+		if opts.RequestTimeout > 0 {
+			requestTimeout = opts.RequestTimeout
+		}
+		if opts.DialTimeout > 0 {
+			req = req.WithContext(context.WithValue(req.Context(), dialTimeoutKey{}, opts.DialTimeout))
+		}
 	}
 	var timedout int32
-	if rp.RequestTimeout > 0 {
-		timer := time.AfterFunc(rp.RequestTimeout, func() {
+	if requestTimeout > 0 {
+		timer := time.AfterFunc(requestTimeout, func() {
 			atomic.AddInt32(&timedout, 1)
 			rp.Transport.CancelRequest(req)
 		})
@@ -352,6 +500,7 @@ func (rp *NativeReverseProxy) roundTripWithData(req *http.Request, reqData *Requ
 		}
 		fastHeaderSet(req.Header, "X-Forwarded-Proto", proto)
 	}
+	setRequestHeaders(req, reqData)
 	t0 := time.Now().UTC()
 	rsp, err = rp.Transport.RoundTrip(req)
 	backendDuration := time.Since(t0)
@@ -363,6 +512,9 @@ func (rp *NativeReverseProxy) roundTripWithData(req *http.Request, reqData *Requ
 			dialTimeout = netErr.Timeout()
 		}
 		requestTimeout = atomic.LoadInt32(&timedout) == int32(1)
+		if !requestTimeout {
+			reason = rp.retryReason(req, nil, err)
+		}
 		if requestTimeout {
 			markAsDead = false
 			err = fmt.Errorf("request timeout after %v: %s", time.Since(reqData.StartTime), err)
@@ -380,8 +532,82 @@ func (rp *NativeReverseProxy) roundTripWithData(req *http.Request, reqData *Requ
 			StatusCode: http.StatusServiceUnavailable,
 			Body:       emptyResponseBody,
 		}
+	} else {
+		reason = rp.retryReason(req, rsp, nil)
+	}
+	return rp.doResponse(req, reqData, rsp, isDebug, markAsDead, backendDuration, originalForwardedFor), reason
+}
+
+// circuitOpenResponse returns the response to requests rejected by an open
+// circuit breaker.
+func (rp *NativeReverseProxy) circuitOpenResponse() *http.Response {
+	status := rp.CircuitOpenStatus
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	body := circuitOpenContent
+	if rp.CircuitOpenBody != "" {
+		body = []byte(rp.CircuitOpenBody)
+	}
+	return &http.Response{
+		StatusCode:    status,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+// setRateLimitHeaders sets the RateLimit headers of the rate limit of a
+// request, along with Retry-After if the rate limit was exceeded.
+func setRateLimitHeaders(header http.Header, rl *RateLimit) {
+	if rl == nil {
+		return
+	}
+	header.Set("RateLimit-Limit", strconv.Itoa(rl.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(rl.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(rl.Reset)))
+	if rl.Exceeded {
+		retryAfter := ceilSeconds(rl.RetryAfter)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		header.Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// setRequestHeaders adds the request headers of the frontend, a Host header
+// replaces the host sent to the backend.
+func setRequestHeaders(req *http.Request, reqData *RequestData) {
+	if reqData.Frontend == nil {
+		return
+	}
+	for name, value := range reqData.Frontend.Options.RequestHeaders {
+		if strings.EqualFold(name, "host") {
+			req.Host = value
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+}
+
+// stripPrefix removes the matched path prefix of a frontend before the
+// request is forwarded, "/api/users" with prefix "/api" becomes "/users".
+func stripPrefix(u *url.URL, prefix string) {
+	u.Path = strings.TrimPrefix(u.Path, prefix)
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	if strings.HasPrefix(u.RawPath, prefix) {
+		u.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+		if !strings.HasPrefix(u.RawPath, "/") {
+			u.RawPath = "/" + u.RawPath
+		}
+	} else {
+		u.RawPath = ""
 	}
-	return rp.doResponse(req, reqData, rsp, isDebug, markAsDead, backendDuration, originalForwardedFor)
 }
 
 func fastHeaderGet(header http.Header, key string) string {
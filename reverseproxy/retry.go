@@ -0,0 +1,255 @@
+package reverseproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultRetryBufferSize = 64 * 1024
+	// retryBudgetMin is the number of retries allowed before any request
+	// added to the budget, so the first requests can be retried too.
+	retryBudgetMin = 10
+)
+
+var (
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "roxxy",
+		Subsystem: "reverseproxy",
+		Name:      "retries_total",
+		Help:      "The total requests retried on another backend by reason.",
+	}, []string{"reason"})
+
+	retryBudgetExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "roxxy",
+		Subsystem: "reverseproxy",
+		Name:      "retry_budget_exhausted_total",
+		Help:      "The total retries skipped because the retry budget was exhausted.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(retriesTotal)
+	prometheus.MustRegister(retryBudgetExhausted)
+}
+
+// retryBudget allows ratio retries for every request, so retries can't
+// multiply the load when most backends are failing. A nil budget allows every
+// retry.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	if ratio <= 0 {
+		return nil
+	}
+	return &retryBudget{ratio: ratio, tokens: retryBudgetMin}
+}
+
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Budget saved while every request succeeds doesn't pile up.
+	b.tokens += b.ratio
+	if max := retryBudgetMin + b.ratio*100; b.tokens > max {
+		b.tokens = max
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// errRetryBodyReplaced is returned to attempts still reading the request body
+// after another attempt started.
+var errRetryBodyReplaced = errors.New("request body replaced by a retry")
+
+// retryBody buffers the request body while attempts stream it to backends, up
+// to limit bytes, so it can be sent again. Larger bodies can only be sent
+// again if nothing was read from them yet, as when the first attempt failed to
+// dial.
+type retryBody struct {
+	mu      sync.Mutex
+	body    io.Reader
+	limit   int64
+	buf     []byte
+	read    int64
+	err     error
+	attempt int
+}
+
+// replayable returns whether everything read from the body is buffered.
+func (b *retryBody) replayable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(len(b.buf)) == b.read
+}
+
+// reader returns the body of a new attempt, earlier attempts fail reading
+// their own from now on.
+func (b *retryBody) reader() io.ReadCloser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempt++
+	return &retryBodyReader{body: b, attempt: b.attempt}
+}
+
+type retryBodyReader struct {
+	body    *retryBody
+	attempt int
+	off     int64
+}
+
+func (r *retryBodyReader) Read(p []byte) (int, error) {
+	b := r.body
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.attempt != b.attempt {
+		return 0, errRetryBodyReplaced
+	}
+	if r.off < b.read {
+		if int64(len(b.buf)) != b.read {
+			return 0, errRetryBodyReplaced
+		}
+		n := copy(p, b.buf[r.off:])
+		r.off += int64(n)
+		return n, nil
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.body.Read(p)
+	if int64(len(b.buf)) == b.read {
+		if b.read+int64(n) > b.limit {
+			b.buf = nil
+		} else {
+			b.buf = append(b.buf, p[:n]...)
+		}
+	}
+	b.read += int64(n)
+	r.off += int64(n)
+	b.err = err
+	return n, err
+}
+
+// Close leaves the client request body open for later attempts, the server
+// closes it once the request is done.
+func (r *retryBodyReader) Close() error {
+	return nil
+}
+
+// retryState replays a request on other backends, keeping the request body
+// and the backends already tried.
+type retryState struct {
+	orig    *http.Request
+	body    *retryBody
+	retries int
+	tried   []string
+}
+
+// newRetry returns the state replaying req on other backends, nil if retries
+// are disabled.
+func (rp *NativeReverseProxy) newRetry(req *http.Request) *retryState {
+	if rp.Retries <= 0 {
+		return nil
+	}
+	rp.retryBudget.deposit()
+	retry := &retryState{orig: req}
+	if req.Body == nil || req.Body == http.NoBody {
+		return retry
+	}
+	limit := rp.RetryBufferSize
+	if limit <= 0 {
+		limit = defaultRetryBufferSize
+	}
+	retry.body = &retryBody{body: req.Body, limit: limit}
+	return retry
+}
+
+// request returns a copy of the original request for a new attempt, the
+// proxy modifies the request it sends.
+func (r *retryState) request() *http.Request {
+	req := r.orig.Clone(r.orig.Context())
+	if r.body != nil {
+		req.Body = r.body.reader()
+		req.GetBody = func() (io.ReadCloser, error) {
+			if !r.body.replayable() {
+				return nil, errRetryBodyReplaced
+			}
+			return r.body.reader(), nil
+		}
+	}
+	return req
+}
+
+// nextRetry records the failure of backend and returns whether another
+// attempt is allowed by the retry count and the retry budget.
+func (rp *NativeReverseProxy) nextRetry(r *retryState, backend string) bool {
+	if r == nil || r.retries >= rp.Retries {
+		return false
+	}
+	if r.body != nil && !r.body.replayable() {
+		return false
+	}
+	if !rp.retryBudget.withdraw() {
+		retryBudgetExhausted.Inc()
+		return false
+	}
+	r.retries++
+	r.tried = append(r.tried, backend)
+	return true
+}
+
+// retryReason returns why an attempt can be retried on another backend, ""
+// if it can't. Requests which failed to dial were never sent, any other
+// request may have been processed by the backend and is only retried if it's
+// idempotent.
+func (rp *NativeReverseProxy) retryReason(req *http.Request, rsp *http.Response, err error) string {
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return "dial"
+		}
+		if rp.RetryIdempotent && isIdempotent(req) {
+			return "error"
+		}
+		return ""
+	}
+	if !isIdempotent(req) {
+		return ""
+	}
+	for _, status := range rp.RetryStatuses {
+		if rsp.StatusCode == status {
+			return "status"
+		}
+	}
+	return ""
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return fastHeaderGet(req.Header, "Idempotency-Key") != ""
+}
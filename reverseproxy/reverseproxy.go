@@ -5,26 +5,69 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"net/http"
 	"time"
 
+	"github.com/aaqaishtyaq/roxxy/backend"
 	"github.com/aaqaishtyaq/roxxy/log"
 )
 
 var (
 	noRouteResponseContent = []byte("no such route")
 	allBackendsDeadContent = []byte("all backends are dead")
+	circuitOpenContent     = []byte("circuit breaker open")
+	rateLimitedContent     = []byte("rate limit exceeded")
 	okResponse             = []byte("OK")
 
 	ErrAllBackendsDead      = errors.New(string(allBackendsDeadContent))
 	ErrNoRegisteredBackends = errors.New("no backends registered for host")
+	ErrCircuitOpen          = errors.New(string(circuitOpenContent))
+	ErrRateLimited          = errors.New(string(rateLimitedContent))
 )
 
 type Router interface {
 	Healthcheck(ctx context.Context) error
-	ChooseBackend(ctx context.Context, host string) (*RequestData, error)
+	ChooseBackend(ctx context.Context, host, path string) (*RequestData, error)
+	// EndRequest is called once for every ChooseBackend call, when the
+	// response headers are received or the websocket session ends. fn builds
+	// the access log entry and is nil for websocket sessions.
+	// reqData.BackendDuration is zero unless a backend response was awaited.
+	// ChooseBackend sets reqData.StickyCookie to have it set on the response
+	// and reqData.RateLimit to have the RateLimit headers sent, retries keep
+	// the RateLimit of the first attempt. reqData.Retry is set by
+	// ChooseBackend when called with ExcludedBackends.
 	EndRequest(ctx context.Context, reqData *RequestData, isDead bool, fn func() *log.LogEntry) error
 }
 
+type requestKey struct{}
+
+// WithRequest returns a copy of ctx carrying req, the client request passed
+// to ChooseBackend.
+func WithRequest(ctx context.Context, req *http.Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, req)
+}
+
+// RequestFromContext returns the client request ChooseBackend was called
+// for, nil if ctx doesn't carry one.
+func RequestFromContext(ctx context.Context) *http.Request {
+	req, _ := ctx.Value(requestKey{}).(*http.Request)
+	return req
+}
+
+type excludedKey struct{}
+
+// WithExcludedBackends returns a copy of ctx asking ChooseBackend to treat
+// backends as dead, used to retry a request on another backend.
+func WithExcludedBackends(ctx context.Context, backends []string) context.Context {
+	return context.WithValue(ctx, excludedKey{}, backends)
+}
+
+// ExcludedBackends returns the backends ChooseBackend must not choose.
+func ExcludedBackends(ctx context.Context) []string {
+	backends, _ := ctx.Value(excludedKey{}).([]string)
+	return backends
+}
+
 type ReverseProxy interface {
 	Initialize(rpConfig ReverseProxyConfig) error
 	Listen(net.Listener, *tls.Config)
@@ -32,13 +75,33 @@ type ReverseProxy interface {
 }
 
 type RequestData struct {
-	BackendLen int
-	Backend    string
-	BackendIdx int
-	BackendKey string
-	Host       string
-	StartTime  time.Time
-	AllDead    bool
+	Frontend        *backend.Frontend
+	BackendLen      int
+	Backend         string
+	BackendIdx      int
+	BackendKey      string
+	Host            string
+	StripPrefix     string
+	StatusCode      int
+	StartTime       time.Time
+	AllDead         bool
+	BackendDuration time.Duration
+	StickyCookie    *http.Cookie
+	CircuitState    string
+	RateLimit       *RateLimit
+	Retry           bool
+}
+
+// RateLimit is the rate limit state of the client of a request. Limit is the
+// burst allowed to the client, Remaining the requests it can still send right
+// away and Reset the time until the whole burst is available again. Exceeded
+// requests are rejected and can be retried after RetryAfter.
+type RateLimit struct {
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+	Exceeded   bool
 }
 
 func (r *RequestData) logError(path string, rid string, err error) {
@@ -63,4 +126,19 @@ type ReverseProxyConfig struct {
 	WriteTimeout      time.Duration
 	IdleTimeout       time.Duration
 	RequestIDHeader   string
+	// Retries is the number of times a request is retried on another
+	// backend, after dial errors, RetryStatuses responses and, with
+	// RetryIdempotent, network errors of idempotent requests. Retries are
+	// limited to RetryBudget times the number of requests, unless zero.
+	// Request bodies are buffered up to RetryBufferSize bytes while they are
+	// sent, larger ones are only retried after dial errors.
+	Retries         int
+	RetryStatuses   []int
+	RetryIdempotent bool
+	RetryBudget     float64
+	RetryBufferSize int64
+	// CircuitOpenStatus and CircuitOpenBody are the response to requests
+	// rejected by an open circuit breaker.
+	CircuitOpenStatus int
+	CircuitOpenBody   string
 }
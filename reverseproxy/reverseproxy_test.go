@@ -1,6 +1,7 @@
 package reverseproxy
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
@@ -14,10 +15,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/aaqaishtyaq/roxxy/backend"
 	"github.com/aaqaishtyaq/roxxy/log"
 	"golang.org/x/net/websocket"
 	"gopkg.in/check.v1"
@@ -34,7 +38,7 @@ func (r *noopRouter) Healthcheck(ctx context.Context) error {
 	return nil
 }
 
-func (r *noopRouter) ChooseBackend(ctx context.Context, host string) (*RequestData, error) {
+func (r *noopRouter) ChooseBackend(ctx context.Context, host, path string) (*RequestData, error) {
 	return &RequestData{
 		Backend:    r.dst,
 		BackendIdx: 0,
@@ -50,32 +54,50 @@ func (r *noopRouter) EndRequest(ctx context.Context, reqData *RequestData, isDea
 
 type recoderRouter struct {
 	dst           string
+	stripPrefix   string
+	frontend      *backend.Frontend
+	stickyCookie  *http.Cookie
 	resultHost    string
+	resultPath    string
 	resultReqData *RequestData
 	resultIsDead  bool
 	logEntry      *log.LogEntry
 	errChoose     error
+	rateLimit     *RateLimit
 	healthErr     error
+
+	// resultBackendDuration is taken out of resultReqData to compare it.
+	resultBackendDuration time.Duration
 }
 
 func (r *recoderRouter) Healthcheck(ctx context.Context) error {
 	return r.healthErr
 }
 
-func (r *recoderRouter) ChooseBackend(ctx context.Context, host string) (*RequestData, error) {
+func (r *recoderRouter) ChooseBackend(ctx context.Context, host, path string) (*RequestData, error) {
 	r.resultHost = host
+	r.resultPath = path
 	return &RequestData{
-		Backend:    r.dst,
-		BackendIdx: 0,
-		BackendKey: host,
-		BackendLen: 1,
-		Host:       host,
+		Frontend:     r.frontend,
+		Backend:      r.dst,
+		BackendIdx:   0,
+		BackendKey:   host,
+		BackendLen:   1,
+		Host:         host,
+		StripPrefix:  r.stripPrefix,
+		StickyCookie: r.stickyCookie,
+		RateLimit:    r.rateLimit,
 	}, r.errChoose
 }
 
 func (r *recoderRouter) EndRequest(ctx context.Context, reqData *RequestData, isDead bool, fn func() *log.LogEntry) error {
-	r.resultReqData = reqData
-	r.logEntry = fn()
+	data := *reqData
+	r.resultBackendDuration = data.BackendDuration
+	data.BackendDuration = 0
+	r.resultReqData = &data
+	if fn != nil {
+		r.logEntry = fn()
+	}
 	r.resultIsDead = isDead
 	return nil
 }
@@ -153,7 +175,9 @@ func (s *S) TestRoundTrip(c *check.C) {
 		BackendKey: "myhost.com",
 		BackendLen: 1,
 		Host:       "myhost.com",
+		StatusCode: 200,
 	})
+	c.Assert(router.resultBackendDuration, check.Equals, router.logEntry.BackendDuration)
 	le := router.logEntry
 	c.Assert(le.Now.IsZero(), check.Equals, false)
 	c.Assert(le.BackendDuration, check.Not(check.Equals), 0)
@@ -227,6 +251,7 @@ func (s *S) TestRoundTripForwarded(c *check.C) {
 		BackendKey: "myhost.com",
 		BackendLen: 1,
 		Host:       "myhost.com",
+		StatusCode: 200,
 	})
 	le := router.logEntry
 	c.Assert(le.Now.IsZero(), check.Equals, false)
@@ -309,6 +334,7 @@ func (s *S) TestRoundTripRedirect(c *check.C) {
 		BackendKey: "myhost.com",
 		BackendLen: 1,
 		Host:       "myhost.com",
+		StatusCode: http.StatusOK,
 	})
 	c.Assert(router.resultIsDead, check.Equals, false)
 }
@@ -397,6 +423,7 @@ func (s *S) TestRoundTripHostDestination(c *check.C) {
 		BackendKey: "myhost.com",
 		BackendLen: 1,
 		Host:       "myhost.com",
+		StatusCode: 200,
 	})
 	c.Assert(router.resultIsDead, check.Equals, false)
 }
@@ -471,6 +498,94 @@ f9Oeos0UUothgiDktdQHxdNEwLjQf7lJJBzV+5OtwswCWA==
 	return listener.Addr().String(), tls.NewListener(listener, tlsConfig), client, tlsConfig
 }
 
+func (s *S) TestRoundTripStripPrefix(c *check.C) {
+	var receivedPaths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		receivedPaths = append(receivedPaths, req.URL.RequestURI())
+	}))
+	defer ts.Close()
+	router := &recoderRouter{dst: ts.URL, stripPrefix: "/api"}
+	rp := s.factory()
+	err := rp.Initialize(ReverseProxyConfig{Router: router})
+	c.Assert(err, check.IsNil)
+	addr, listener := getFreeListener()
+	go rp.Listen(listener, nil)
+	defer rp.Stop()
+	defer listener.Close()
+	for _, path := range []string{"/api/users?id=1", "/api", "/api/a%2Fb"} {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", addr, path), nil)
+		c.Assert(err, check.IsNil)
+		req.Host = "myhost.com"
+		rsp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		rsp.Body.Close()
+		c.Assert(rsp.StatusCode, check.Equals, 200)
+	}
+	c.Assert(router.resultPath, check.Equals, "/api/a/b")
+	c.Assert(receivedPaths, check.DeepEquals, []string{"/users?id=1", "/", "/a%2Fb"})
+}
+
+func (s *S) TestRoundTripFrontendOptions(c *check.C) {
+	var receivedReq *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		receivedReq = req
+		rw.Header().Set("Server", "backend")
+	}))
+	defer ts.Close()
+	router := &recoderRouter{dst: ts.URL, frontend: &backend.Frontend{
+		Options: backend.FrontendOptions{
+			RequestHeaders:  map[string]string{"Host": "internal.com", "X-Tenant": "t1"},
+			ResponseHeaders: map[string]string{"Server": "roxxy", "X-Frame-Options": "DENY"},
+		},
+	}}
+	rp := s.factory()
+	err := rp.Initialize(ReverseProxyConfig{Router: router})
+	c.Assert(err, check.IsNil)
+	addr, listener := getFreeListener()
+	go rp.Listen(listener, nil)
+	defer rp.Stop()
+	defer listener.Close()
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/", addr), nil)
+	c.Assert(err, check.IsNil)
+	req.Host = "myhost.com"
+	rsp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, 200)
+	c.Assert(rsp.Header.Get("Server"), check.Equals, "roxxy")
+	c.Assert(rsp.Header.Get("X-Frame-Options"), check.Equals, "DENY")
+	c.Assert(receivedReq.Host, check.Equals, "internal.com")
+	c.Assert(receivedReq.Header.Get("X-Tenant"), check.Equals, "t1")
+}
+
+func (s *S) TestRoundTripFrontendTimeout(c *check.C) {
+	rp := s.factory()
+	blk := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-blk
+	}))
+	defer ts.Close()
+	defer close(blk)
+	router := &recoderRouter{dst: ts.URL, frontend: &backend.Frontend{
+		Options: backend.FrontendOptions{RequestTimeout: 100 * time.Millisecond},
+	}}
+	err := rp.Initialize(ReverseProxyConfig{Router: router, RequestTimeout: time.Minute, RequestIDHeader: "RID"})
+	c.Assert(err, check.IsNil)
+	addr, listener := getFreeListener()
+	go rp.Listen(listener, nil)
+	defer rp.Stop()
+	defer listener.Close()
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/", addr), nil)
+	c.Assert(err, check.IsNil)
+	req.Host = "myhost.com"
+	rsp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, 503)
+	log.ErrorLogger.Stop()
+	c.Assert(s.logBuffer.String(), check.Matches, `(?s).*request timeout after .+:.*`)
+}
+
 func (s *S) TestRoundTripTLSListener(c *check.C) {
 	var receivedReq *http.Request
 	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -513,6 +628,7 @@ func (s *S) TestRoundTripTLSListener(c *check.C) {
 		BackendKey: "myhost.com",
 		BackendLen: 1,
 		Host:       "myhost.com",
+		StatusCode: 200,
 	})
 	c.Assert(router.resultIsDead, check.Equals, false)
 }
@@ -543,6 +659,7 @@ func (s *S) TestRoundTripWithError(c *check.C) {
 		BackendKey: "myhost.com",
 		BackendLen: 1,
 		Host:       "myhost.com",
+		StatusCode: 503,
 	})
 	c.Assert(router.resultIsDead, check.Equals, true)
 }
@@ -575,6 +692,7 @@ func (s *S) TestRoundTripWithErrNoRegisteredBackends(c *check.C) {
 		BackendKey: "myhost.com",
 		BackendLen: 1,
 		Host:       "myhost.com",
+		StatusCode: 400,
 	})
 	c.Assert(router.resultIsDead, check.Equals, false)
 }
@@ -607,10 +725,99 @@ func (s *S) TestRoundTripWithErrAllBackendsDead(c *check.C) {
 		BackendKey: "myhost.com",
 		BackendLen: 1,
 		Host:       "myhost.com",
+		StatusCode: 503,
 	})
 	c.Assert(router.resultIsDead, check.Equals, false)
 }
 
+func (s *S) TestRoundTripWithErrCircuitOpen(c *check.C) {
+	router := &recoderRouter{errChoose: ErrCircuitOpen}
+	rp := s.factory()
+	err := rp.Initialize(ReverseProxyConfig{
+		Router:            router,
+		CircuitOpenStatus: http.StatusTooManyRequests,
+		CircuitOpenBody:   "try later",
+	})
+	c.Assert(err, check.IsNil)
+	addr, listener := getFreeListener()
+	go rp.Listen(listener, nil)
+	defer rp.Stop()
+	defer listener.Close()
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/", addr), nil)
+	c.Assert(err, check.IsNil)
+	req.Host = "myhost.com"
+	req.Header.Set("X-Debug-Router", "1")
+	rsp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusTooManyRequests)
+	data, err := ioutil.ReadAll(rsp.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "try later")
+	c.Assert(router.resultReqData.StatusCode, check.Equals, http.StatusTooManyRequests)
+	c.Assert(router.resultIsDead, check.Equals, false)
+}
+
+func (s *S) TestRoundTripWithErrRateLimited(c *check.C) {
+	router := &recoderRouter{
+		errChoose: ErrRateLimited,
+		rateLimit: &RateLimit{Limit: 10, Reset: 1500 * time.Millisecond, RetryAfter: 100 * time.Millisecond, Exceeded: true},
+	}
+	rp := s.factory()
+	err := rp.Initialize(ReverseProxyConfig{Router: router})
+	c.Assert(err, check.IsNil)
+	addr, listener := getFreeListener()
+	go rp.Listen(listener, nil)
+	defer rp.Stop()
+	defer listener.Close()
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/", addr), nil)
+	c.Assert(err, check.IsNil)
+	req.Host = "myhost.com"
+	rsp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusTooManyRequests)
+	data, err := ioutil.ReadAll(rsp.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "rate limit exceeded")
+	c.Assert(rsp.Header.Get("Retry-After"), check.Equals, "1")
+	c.Assert(rsp.Header.Get("RateLimit-Limit"), check.Equals, "10")
+	c.Assert(rsp.Header.Get("RateLimit-Remaining"), check.Equals, "0")
+	c.Assert(rsp.Header.Get("RateLimit-Reset"), check.Equals, "2")
+	c.Assert(router.logEntry.StatusCode, check.Equals, http.StatusTooManyRequests)
+	c.Assert(router.logEntry.RateLimited, check.Equals, true)
+}
+
+func (s *S) TestRoundTripRateLimitHeaders(c *check.C) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req
+		rw.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	router := &recoderRouter{dst: server.URL, rateLimit: &RateLimit{Limit: 10, Remaining: 9, Reset: 100 * time.Millisecond}}
+	rp := s.factory()
+	err := rp.Initialize(ReverseProxyConfig{Router: router})
+	c.Assert(err, check.IsNil)
+	addr, listener := getFreeListener()
+	go rp.Listen(listener, nil)
+	defer rp.Stop()
+	defer listener.Close()
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/", addr), nil)
+	c.Assert(err, check.IsNil)
+	req.Host = "myhost.com"
+	rsp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(received, check.NotNil)
+	c.Assert(rsp.Header.Get("Retry-After"), check.Equals, "")
+	c.Assert(rsp.Header.Get("RateLimit-Limit"), check.Equals, "10")
+	c.Assert(rsp.Header.Get("RateLimit-Remaining"), check.Equals, "9")
+	c.Assert(rsp.Header.Get("RateLimit-Reset"), check.Equals, "1")
+	c.Assert(router.logEntry.RateLimited, check.Equals, false)
+}
+
 func (s *S) TestRoundTripWithErrOther(c *check.C) {
 	router := &recoderRouter{errChoose: errors.New("other error")}
 	rp := s.factory()
@@ -639,6 +846,7 @@ func (s *S) TestRoundTripWithErrOther(c *check.C) {
 		BackendKey: "myhost.com",
 		BackendLen: 1,
 		Host:       "myhost.com",
+		StatusCode: 503,
 	})
 	c.Assert(router.resultIsDead, check.Equals, false)
 }
@@ -1026,6 +1234,374 @@ func (s *S) TestRoundTripWebSocket(c *check.C) {
 	c.Assert(string(msgBuf[:n]), check.Equals, "12345")
 }
 
+type endRequestRouter struct {
+	recoderRouter
+	ended chan *RequestData
+}
+
+func (r *endRequestRouter) EndRequest(ctx context.Context, reqData *RequestData, isDead bool, fn func() *log.LogEntry) error {
+	r.ended <- reqData
+	return nil
+}
+
+func (s *S) TestRoundTripWebSocketEndsRequest(c *check.C) {
+	rp := s.factory()
+	srv := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		conn.Write([]byte("hello"))
+		io.Copy(ioutil.Discard, conn)
+	}))
+	defer srv.Close()
+	router := &endRequestRouter{recoderRouter: recoderRouter{dst: srv.URL}, ended: make(chan *RequestData, 1)}
+	err := rp.Initialize(ReverseProxyConfig{Router: router})
+	c.Assert(err, check.IsNil)
+	addr, listener := getFreeListener()
+	go rp.Listen(listener, nil)
+	defer rp.Stop()
+	defer listener.Close()
+	config, err := websocket.NewConfig("ws://myfrontend.com", "ws://localhost/")
+	c.Assert(err, check.IsNil)
+	client, err := net.Dial("tcp", addr)
+	c.Assert(err, check.IsNil)
+	conn, err := websocket.NewClient(config, client)
+	c.Assert(err, check.IsNil)
+	msgBuf := make([]byte, 5)
+	_, err = conn.Read(msgBuf)
+	c.Assert(err, check.IsNil)
+	select {
+	case <-router.ended:
+		c.Fatal("request ended while the session is open")
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.Close()
+	select {
+	case reqData := <-router.ended:
+		c.Assert(reqData.Backend, check.Equals, srv.URL)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for the request to end")
+	}
+}
+
+func (s *S) TestRoundTripWebSocketDialFailure(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	srv.Close()
+	router := &retryRouter{backends: []string{srv.URL}}
+	addr, stop := s.startRetryProxy(c, router, ReverseProxyConfig{})
+	defer stop()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/", addr), nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rsp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusBadGateway)
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	c.Assert(router.ended, check.DeepEquals, []bool{true})
+}
+
+func (s *S) TestRoundTripStickyCookie(c *check.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.SetCookie(rw, &http.Cookie{Name: "app", Value: "1"})
+	}))
+	defer ts.Close()
+	router := &recoderRouter{dst: ts.URL, stickyCookie: &http.Cookie{Name: "ROXXY_BACKEND", Value: "abc.sig", Path: "/"}}
+	rp := s.factory()
+	err := rp.Initialize(ReverseProxyConfig{Router: router})
+	c.Assert(err, check.IsNil)
+	addr, listener := getFreeListener()
+	go rp.Listen(listener, nil)
+	defer rp.Stop()
+	defer listener.Close()
+	rsp, err := http.Get(fmt.Sprintf("http://%s/", addr))
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.Header["Set-Cookie"], check.DeepEquals, []string{"app=1", "ROXXY_BACKEND=abc.sig; Path=/"})
+}
+
+func (s *S) TestRoundTripWebSocketStickyCookie(c *check.C) {
+	rp := s.factory()
+	srv := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		conn.Write([]byte("hello"))
+		io.Copy(ioutil.Discard, conn)
+	}))
+	defer srv.Close()
+	router := &recoderRouter{dst: srv.URL, stickyCookie: &http.Cookie{Name: "ROXXY_BACKEND", Value: "abc.sig"}}
+	err := rp.Initialize(ReverseProxyConfig{Router: router})
+	c.Assert(err, check.IsNil)
+	addr, listener := getFreeListener()
+	go rp.Listen(listener, nil)
+	defer rp.Stop()
+	defer listener.Close()
+	client, err := net.Dial("tcp", addr)
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	req, err := http.NewRequest("GET", "http://myfrontend.com/", nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Origin", "http://localhost/")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	err = req.Write(client)
+	c.Assert(err, check.IsNil)
+	br := bufio.NewReader(client)
+	rsp, err := http.ReadResponse(br, req)
+	c.Assert(err, check.IsNil)
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusSwitchingProtocols)
+	c.Assert(rsp.Header.Get("Set-Cookie"), check.Equals, "ROXXY_BACKEND=abc.sig")
+	frame := make([]byte, 7)
+	_, err = io.ReadFull(br, frame)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(frame[2:]), check.Equals, "hello")
+}
+
+// retryRouter chooses the first of its backends not excluded by a retry.
+type retryRouter struct {
+	noopRouter
+	backends []string
+	mu       sync.Mutex
+	ended    []bool
+}
+
+func (r *retryRouter) ChooseBackend(ctx context.Context, host, path string) (*RequestData, error) {
+	excluded := ExcludedBackends(ctx)
+	for i, backend := range r.backends {
+		tried := false
+		for _, e := range excluded {
+			tried = tried || e == backend
+		}
+		if !tried {
+			return &RequestData{Backend: backend, BackendIdx: i, BackendLen: len(r.backends), Host: host}, nil
+		}
+	}
+	return &RequestData{Host: host}, ErrAllBackendsDead
+}
+
+func (r *retryRouter) EndRequest(ctx context.Context, reqData *RequestData, isDead bool, fn func() *log.LogEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ended = append(r.ended, isDead)
+	return nil
+}
+
+func (s *S) startRetryProxy(c *check.C, router Router, config ReverseProxyConfig) (string, func()) {
+	config.Router = router
+	rp := s.factory()
+	err := rp.Initialize(config)
+	c.Assert(err, check.IsNil)
+	addr, listener := getFreeListener()
+	go rp.Listen(listener, nil)
+	return addr, func() {
+		rp.Stop()
+		listener.Close()
+	}
+}
+
+func (s *S) TestRoundTripRetryDialError(c *check.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	closedAddr, listener := getFreeListener()
+	listener.Close()
+	router := &retryRouter{backends: []string{"http://" + closedAddr, ts.URL}}
+	addr, stop := s.startRetryProxy(c, router, ReverseProxyConfig{Retries: 1})
+	defer stop()
+	rsp, err := http.Get(fmt.Sprintf("http://%s/", addr))
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusOK)
+	data, err := ioutil.ReadAll(rsp.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "ok")
+	c.Assert(router.ended, check.HasLen, 2)
+}
+
+func (s *S) TestRoundTripRetryStatusReplaysBody(c *check.C) {
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(rw, req.Body)
+	}))
+	defer echo.Close()
+	router := &retryRouter{backends: []string{failing.URL, echo.URL}}
+	addr, stop := s.startRetryProxy(c, router, ReverseProxyConfig{Retries: 2, RetryStatuses: []int{503}})
+	defer stop()
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://%s/", addr), strings.NewReader("my body"))
+	c.Assert(err, check.IsNil)
+	rsp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusOK)
+	data, err := ioutil.ReadAll(rsp.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "my body")
+}
+
+func (s *S) TestRoundTripRetryStatusSkipsNonIdempotent(c *check.C) {
+	var calls int32
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	router := &retryRouter{backends: []string{failing.URL, failing.URL + "/"}}
+	addr, stop := s.startRetryProxy(c, router, ReverseProxyConfig{Retries: 2, RetryStatuses: []int{503}})
+	defer stop()
+	rsp, err := http.Post(fmt.Sprintf("http://%s/", addr), "text/plain", strings.NewReader("my body"))
+	c.Assert(err, check.IsNil)
+	rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(1))
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/", addr), strings.NewReader("my body"))
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Idempotency-Key", "abc")
+	rsp, err = http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(3))
+}
+
+// rateLimitRetryRouter sets a rate limit on first attempts only, like
+// routers taking a single rate limit token per client request.
+type rateLimitRetryRouter struct {
+	retryRouter
+}
+
+func (r *rateLimitRetryRouter) ChooseBackend(ctx context.Context, host, path string) (*RequestData, error) {
+	reqData, err := r.retryRouter.ChooseBackend(ctx, host, path)
+	if len(ExcludedBackends(ctx)) == 0 {
+		reqData.RateLimit = &RateLimit{Limit: 10, Remaining: 9, Reset: time.Second}
+	}
+	return reqData, err
+}
+
+func (s *S) TestRoundTripRetryKeepsRateLimit(c *check.C) {
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer ok.Close()
+	router := &rateLimitRetryRouter{retryRouter{backends: []string{failing.URL, ok.URL}}}
+	addr, stop := s.startRetryProxy(c, router, ReverseProxyConfig{Retries: 1, RetryStatuses: []int{503}})
+	defer stop()
+	rsp, err := http.Get(fmt.Sprintf("http://%s/", addr))
+	c.Assert(err, check.IsNil)
+	rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(rsp.Header.Get("RateLimit-Limit"), check.Equals, "10")
+	c.Assert(rsp.Header.Get("RateLimit-Remaining"), check.Equals, "9")
+}
+
+func (s *S) TestRoundTripRetryKeepsLastResponse(c *check.C) {
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte("unavailable"))
+	}))
+	defer failing.Close()
+	router := &retryRouter{backends: []string{failing.URL}}
+	addr, stop := s.startRetryProxy(c, router, ReverseProxyConfig{Retries: 2, RetryStatuses: []int{503}})
+	defer stop()
+	rsp, err := http.Get(fmt.Sprintf("http://%s/", addr))
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusServiceUnavailable)
+	data, err := ioutil.ReadAll(rsp.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "unavailable")
+	c.Assert(router.ended, check.DeepEquals, []bool{false, false})
+}
+
+func (s *S) TestRoundTripRetryLargeBody(c *check.C) {
+	var calls int32
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		data, _ := ioutil.ReadAll(req.Body)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write(data)
+	}))
+	defer failing.Close()
+	router := &retryRouter{backends: []string{failing.URL, failing.URL + "/"}}
+	addr, stop := s.startRetryProxy(c, router, ReverseProxyConfig{Retries: 1, RetryStatuses: []int{503}, RetryBufferSize: 4})
+	defer stop()
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://%s/", addr), strings.NewReader("my body"))
+	c.Assert(err, check.IsNil)
+	rsp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusServiceUnavailable)
+	data, err := ioutil.ReadAll(rsp.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "my body")
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(1))
+}
+
+func (s *S) TestRoundTripRetryLargeBodyDialError(c *check.C) {
+	echo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(rw, req.Body)
+	}))
+	defer echo.Close()
+	closedAddr, listener := getFreeListener()
+	listener.Close()
+	router := &retryRouter{backends: []string{"http://" + closedAddr, echo.URL}}
+	addr, stop := s.startRetryProxy(c, router, ReverseProxyConfig{Retries: 1, RetryBufferSize: 4})
+	defer stop()
+	rsp, err := http.Post(fmt.Sprintf("http://%s/", addr), "text/plain", strings.NewReader("my body"))
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusOK)
+	data, err := ioutil.ReadAll(rsp.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "my body")
+}
+
+func (s *S) TestRetryBodyStreams(c *check.C) {
+	rp := &NativeReverseProxy{ReverseProxyConfig: ReverseProxyConfig{Retries: 1, RetryBufferSize: 4}}
+	req, err := http.NewRequest(http.MethodPut, "http://myfrontend.com/", strings.NewReader("abc"))
+	c.Assert(err, check.IsNil)
+	retry := rp.newRetry(req)
+	first := retry.request()
+	buf := make([]byte, 2)
+	n, err := first.Body.Read(buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buf[:n]), check.Equals, "ab")
+	second := retry.request()
+	_, err = first.Body.Read(buf)
+	c.Assert(err, check.Equals, errRetryBodyReplaced)
+	data, err := ioutil.ReadAll(second.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "abc")
+	c.Assert(retry.body.replayable(), check.Equals, true)
+	req, err = http.NewRequest(http.MethodPut, "http://myfrontend.com/", strings.NewReader("my body"))
+	c.Assert(err, check.IsNil)
+	retry = rp.newRetry(req)
+	c.Assert(retry.body.replayable(), check.Equals, true)
+	data, err = ioutil.ReadAll(retry.request().Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "my body")
+	c.Assert(retry.body.replayable(), check.Equals, false)
+}
+
+func (s *S) TestRetryBudget(c *check.C) {
+	budget := newRetryBudget(0.5)
+	for i := 0; i < retryBudgetMin; i++ {
+		c.Assert(budget.withdraw(), check.Equals, true)
+	}
+	c.Assert(budget.withdraw(), check.Equals, false)
+	budget.deposit()
+	c.Assert(budget.withdraw(), check.Equals, false)
+	budget.deposit()
+	c.Assert(budget.withdraw(), check.Equals, true)
+	var unlimited *retryBudget
+	c.Assert(unlimited.withdraw(), check.Equals, true)
+}
+
 func baseBenchmarkServeHTTP(rp ReverseProxy, b *testing.B) {
 	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		rw.WriteHeader(http.StatusOK)
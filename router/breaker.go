@@ -0,0 +1,186 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CircuitBreaker configures the circuit breakers of frontends and, with
+// PerBackend, of each backend. A breaker opens once at least MinRequests
+// requests ended within Window and ErrorRate of them failed with a network
+// error, a 5xx response or, when Latency is set, a response slower than
+// Latency. Open breakers reject requests for OpenDuration, then let
+// HalfOpenRequests requests through and close if all of them succeed.
+type CircuitBreaker struct {
+	ErrorRate        float64
+	Latency          time.Duration
+	MinRequests      int
+	Window           time.Duration
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+	PerBackend       bool
+}
+
+func (c CircuitBreaker) enabled() bool {
+	return c.ErrorRate > 0
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStates = []string{"closed", "open", "half-open"}
+
+var (
+	breakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "roxxy",
+		Subsystem: "router",
+		Name:      "circuit_breaker_state",
+		Help:      "The state of circuit breakers, 0 closed, 1 open and 2 half-open. Frontend breakers have an empty backend.",
+	}, []string{"frontend", "backend"})
+
+	breakerRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "roxxy",
+		Subsystem: "router",
+		Name:      "circuit_breaker_rejected_total",
+		Help:      "The total requests rejected by open frontend circuit breakers.",
+	}, []string{"frontend"})
+)
+
+func init() {
+	prometheus.MustRegister(breakerState)
+	prometheus.MustRegister(breakerRejected)
+}
+
+type breaker struct {
+	state       int
+	until       time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	probes      int
+	successes   int
+}
+
+type breakerKey struct {
+	host    string
+	backend string
+}
+
+// circuitBreakers holds the breakers of frontends, keyed with an empty
+// backend, and of backends. Closed breakers without recent requests are kept
+// as they only hold counters.
+type circuitBreakers struct {
+	mu       sync.Mutex
+	config   CircuitBreaker
+	breakers map[breakerKey]*breaker
+}
+
+func newCircuitBreakers(config CircuitBreaker) *circuitBreakers {
+	return &circuitBreakers{
+		config:   config,
+		breakers: make(map[breakerKey]*breaker),
+	}
+}
+
+func (c *circuitBreakers) get(key breakerKey) *breaker {
+	b := c.breakers[key]
+	if b == nil {
+		b = &breaker{}
+		c.breakers[key] = b
+	}
+	return b
+}
+
+// allow returns whether a request can go through the breaker of key along
+// with the breaker state. An open breaker turns half-open once OpenDuration
+// elapsed and half-open breakers only admit HalfOpenRequests requests.
+func (c *circuitBreakers) allow(key breakerKey, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.get(key)
+	if b.state == breakerOpen && !now.Before(b.until) {
+		c.transition(key, b, breakerHalfOpen, now)
+	}
+	switch b.state {
+	case breakerOpen:
+		return breakerStates[b.state], false
+	case breakerHalfOpen:
+		if b.probes >= c.config.HalfOpenRequests {
+			return breakerStates[b.state], false
+		}
+		b.probes++
+	}
+	return breakerStates[b.state], true
+}
+
+// available is allow without admitting the request, used to skip backends
+// with an open breaker before one of them is chosen.
+func (c *circuitBreakers) available(key breakerKey, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.breakers[key]
+	if b == nil {
+		return true
+	}
+	switch b.state {
+	case breakerOpen:
+		return !now.Before(b.until)
+	case breakerHalfOpen:
+		return b.probes < c.config.HalfOpenRequests
+	}
+	return true
+}
+
+// state returns the state of the breaker of key without admitting a request.
+func (c *circuitBreakers) state(key breakerKey) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.breakers[key]
+	if b == nil {
+		return breakerStates[breakerClosed]
+	}
+	return breakerStates[b.state]
+}
+
+// record counts the outcome of a request admitted by the breaker of key.
+func (c *circuitBreakers) record(key breakerKey, failed bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.get(key)
+	switch b.state {
+	case breakerClosed:
+		if now.Sub(b.windowStart) > c.config.Window {
+			b.windowStart = now
+			b.requests, b.failures = 0, 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= c.config.MinRequests && float64(b.failures) >= c.config.ErrorRate*float64(b.requests) {
+			c.transition(key, b, breakerOpen, now)
+		}
+	case breakerHalfOpen:
+		if failed {
+			c.transition(key, b, breakerOpen, now)
+			return
+		}
+		b.successes++
+		if b.successes >= c.config.HalfOpenRequests {
+			c.transition(key, b, breakerClosed, now)
+		}
+	}
+}
+
+func (c *circuitBreakers) transition(key breakerKey, b *breaker, state int, now time.Time) {
+	*b = breaker{state: state, windowStart: now}
+	if state == breakerOpen {
+		b.until = now.Add(c.config.OpenDuration)
+	}
+	breakerState.WithLabelValues(key.host, key.backend).Set(float64(state))
+}
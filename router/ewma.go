@@ -0,0 +1,135 @@
+package router
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ewmaFailurePenalty is the latency recorded for requests failing with a
+// network error, backends failing fast would otherwise look fast.
+const ewmaFailurePenalty = time.Second
+
+type latencyEWMA struct {
+	nanos float64
+	stamp time.Time
+}
+
+// peakEWMA tracks the latency of each backend as a moving average which
+// jumps to latency peaks and otherwise decays with time constant decay. The
+// average also decays while a backend receives no requests, so a backend
+// which was slow is eventually tried again.
+type peakEWMA struct {
+	mu      sync.Mutex
+	decay   time.Duration
+	latency map[inFlightKey]*latencyEWMA
+	swept   time.Time
+}
+
+func newPeakEWMA(decay time.Duration) *peakEWMA {
+	return &peakEWMA{
+		decay:   decay,
+		latency: make(map[inFlightKey]*latencyEWMA),
+		swept:   time.Now(),
+	}
+}
+
+func (p *peakEWMA) observe(host, backend string, rtt time.Duration, now time.Time) {
+	key := inFlightKey{host: host, backend: backend}
+	sample := float64(rtt)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(now)
+	e := p.latency[key]
+	if e == nil {
+		p.latency[key] = &latencyEWMA{nanos: sample, stamp: now}
+		return
+	}
+	if sample > e.nanos {
+		e.nanos = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(e.stamp)) / float64(p.decay))
+		e.nanos = e.nanos*w + sample*(1-w)
+	}
+	e.stamp = now
+}
+
+// sweep forgets backends without requests for a long time, usually removed
+// from their frontend, their decayed average is close to zero anyway.
+func (p *peakEWMA) sweep(now time.Time) {
+	idle := 10 * p.decay
+	if now.Sub(p.swept) < idle {
+		return
+	}
+	p.swept = now
+	for key, e := range p.latency {
+		if now.Sub(e.stamp) > idle {
+			delete(p.latency, key)
+		}
+	}
+}
+
+// latencies returns the decayed average latency of each backend. Backends
+// without samples, like newly added ones, get the mean of the others so they
+// are neither flooded nor starved.
+func (p *peakEWMA) latencies(host string, backends []string, now time.Time) []float64 {
+	latencies := make([]float64, len(backends))
+	var sum float64
+	known := 0
+	p.mu.Lock()
+	for i, backend := range backends {
+		e := p.latency[inFlightKey{host: host, backend: backend}]
+		if e == nil {
+			latencies[i] = -1
+			continue
+		}
+		latencies[i] = e.nanos * math.Exp(-float64(now.Sub(e.stamp))/float64(p.decay))
+		sum += latencies[i]
+		known++
+	}
+	p.mu.Unlock()
+	for i := range latencies {
+		if latencies[i] >= 0 {
+			continue
+		}
+		latencies[i] = 0
+		if known > 0 {
+			latencies[i] = sum / float64(known)
+		}
+	}
+	return latencies
+}
+
+// pick chooses two random alive backends and returns the one with the lowest
+// cost, its latency times its requests in flight plus one divided by its
+// weight, or -1 if every backend is dead.
+func (p *peakEWMA) pick(host string, backends []string, weights []int, dead map[int]struct{}, inFlight *inFlight, now time.Time) int {
+	alive := make([]int, 0, len(backends))
+	for i := range backends {
+		if _, isDead := dead[i]; !isDead {
+			alive = append(alive, i)
+		}
+	}
+	switch len(alive) {
+	case 0:
+		return -1
+	case 1:
+		return alive[0]
+	}
+	a := rand.Intn(len(alive))
+	b := rand.Intn(len(alive) - 1)
+	if b >= a {
+		b++
+	}
+	latencies := p.latencies(host, backends, now)
+	cost := func(i int) float64 {
+		// Without any samples the requests in flight still count.
+		latency := math.Max(latencies[i], 1)
+		return latency * float64(inFlight.count(host, backends[i])+1) / float64(weights[i])
+	}
+	if cost(alive[b]) < cost(alive[a]) {
+		return alive[b]
+	}
+	return alive[a]
+}
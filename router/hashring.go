@@ -0,0 +1,137 @@
+package router
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	hashKeyIP           = "ip"
+	hashKeyPath         = "path"
+	hashKeyHeaderPrefix = "header:"
+	hashKeyCookiePrefix = "cookie:"
+)
+
+// ringReplicas is the number of points placed on the ring for each unit of
+// backend weight, enough to spread keys evenly between a few backends.
+const ringReplicas = 160
+
+// hashRing implements consistent hashing: each backend is placed on a ring
+// at points derived from its URL and a key goes to the backend of the first
+// point after the key hash. Adding or removing a backend only moves the keys
+// falling next to its points.
+type hashRing struct {
+	mu       sync.Mutex
+	backends []string
+	weights  []int
+	points   []ringPoint
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend int
+}
+
+// next returns the index of the backend of key, walking the ring past dead
+// backends, or -1 if every backend is dead. The ring is rebuilt whenever the
+// backends or their weights change.
+func (r *hashRing) next(backends []string, weights []int, dead map[int]struct{}, key string) int {
+	r.mu.Lock()
+	if !equalStrings(r.backends, backends) || !equalInts(r.weights, weights) {
+		r.backends = backends
+		r.weights = weights
+		r.points = ringPoints(backends, weights)
+	}
+	points := r.points
+	r.mu.Unlock()
+	hash := hashString(key)
+	start := sort.Search(len(points), func(i int) bool {
+		return points[i].hash >= hash
+	})
+	for n := 0; n < len(points); n++ {
+		point := points[(start+n)%len(points)]
+		if _, isDead := dead[point.backend]; !isDead {
+			return point.backend
+		}
+	}
+	return -1
+}
+
+func ringPoints(backends []string, weights []int) []ringPoint {
+	var points []ringPoint
+	for i, backend := range backends {
+		weight := 1
+		if i < len(weights) && weights[i] > 1 {
+			weight = weights[i]
+		}
+		for n := 0; n < weight*ringReplicas; n++ {
+			points = append(points, ringPoint{
+				hash:    hashString(backend + "-" + strconv.Itoa(n)),
+				backend: i,
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].backend < points[j].backend
+	})
+	return points
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	// FNV spreads strings differing only in their last bytes poorly, the
+	// splitmix64 finalizer scatters them over the whole ring.
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func validHashKey(key string) bool {
+	switch {
+	case key == hashKeyIP, key == hashKeyPath:
+		return true
+	case strings.HasPrefix(key, hashKeyHeaderPrefix):
+		return len(key) > len(hashKeyHeaderPrefix)
+	case strings.HasPrefix(key, hashKeyCookiePrefix):
+		return len(key) > len(hashKeyCookiePrefix)
+	}
+	return false
+}
+
+// requestHashKey returns the part of req selected by key, "" if req is nil
+// or doesn't carry it.
+func requestHashKey(req *http.Request, key string) string {
+	if req == nil {
+		return ""
+	}
+	switch {
+	case key == hashKeyPath:
+		return req.URL.Path
+	case strings.HasPrefix(key, hashKeyHeaderPrefix):
+		return req.Header.Get(key[len(hashKeyHeaderPrefix):])
+	case strings.HasPrefix(key, hashKeyCookiePrefix):
+		cookie, err := req.Cookie(key[len(hashKeyCookiePrefix):])
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
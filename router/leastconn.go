@@ -0,0 +1,71 @@
+package router
+
+import "sync"
+
+// inFlight counts the requests sent to each backend of each frontend which
+// haven't ended yet. Counters are removed once they drop to zero, so backends
+// removed from a frontend don't linger.
+type inFlight struct {
+	mu     sync.Mutex
+	counts map[inFlightKey]int
+}
+
+type inFlightKey struct {
+	host    string
+	backend string
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{counts: make(map[inFlightKey]int)}
+}
+
+func (f *inFlight) inc(host, backend string) {
+	f.mu.Lock()
+	f.counts[inFlightKey{host: host, backend: backend}]++
+	f.mu.Unlock()
+}
+
+func (f *inFlight) dec(host, backend string) {
+	key := inFlightKey{host: host, backend: backend}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count, ok := f.counts[key]
+	if !ok {
+		return
+	}
+	if count <= 1 {
+		delete(f.counts, key)
+		return
+	}
+	f.counts[key] = count - 1
+}
+
+func (f *inFlight) count(host, backend string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[inFlightKey{host: host, backend: backend}]
+}
+
+// leastConn returns the index of the alive backend with the fewest requests
+// in flight relative to its weight, or -1 if every backend is dead. Ties are
+// broken by the first backend found starting at start, so callers rotate
+// start to spread requests between idle backends.
+func (f *inFlight) leastConn(host string, backends []string, weights []int, dead map[int]struct{}, start int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	best := -1
+	var bestCount, bestWeight int
+	for n := 0; n < len(backends); n++ {
+		i := (start + n) % len(backends)
+		if _, isDead := dead[i]; isDead {
+			continue
+		}
+		count := f.counts[inFlightKey{host: host, backend: backends[i]}]
+		weight := weights[i]
+		// count/weight < bestCount/bestWeight without integer division.
+		if best == -1 || count*bestWeight < bestCount*weight {
+			best, bestCount, bestWeight = i, count, weight
+		}
+	}
+	return best
+}
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// OutlierDetection configures passive health checking of backends based on
+// the results of proxied requests. A backend is marked as dead after
+// ConsecutiveFailures network errors or 5xx responses, all within Window. At
+// most MaxEjectionPercent of the backends of a frontend are marked as dead by
+// outlier detection at once, one backend can always be.
+type OutlierDetection struct {
+	ConsecutiveFailures int
+	Window              time.Duration
+	MaxEjectionPercent  int
+}
+
+func (o OutlierDetection) enabled() bool {
+	return o.ConsecutiveFailures > 0
+}
+
+type outlierFailures struct {
+	count int
+	first time.Time
+}
+
+// outlierDetector counts consecutive failures of each backend. Only backends
+// currently failing are tracked, a success forgets the backend. Backends it
+// marked as dead are kept, by host, until they are revived.
+type outlierDetector struct {
+	mu       sync.Mutex
+	config   OutlierDetection
+	failures map[string]*outlierFailures
+	ejected  map[string]map[string]time.Time
+}
+
+func newOutlierDetector(config OutlierDetection) *outlierDetector {
+	return &outlierDetector{
+		config:   config,
+		failures: make(map[string]*outlierFailures),
+		ejected:  make(map[string]map[string]time.Time),
+	}
+}
+
+// failed records a failure of backend and returns whether it reached the
+// consecutive failures threshold, the count starts over afterwards.
+func (d *outlierDetector) failed(host, backend string, now time.Time) bool {
+	key := host + ";" + backend
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	failures := d.failures[key]
+	if failures == nil || (d.config.Window > 0 && now.Sub(failures.first) > d.config.Window) {
+		failures = &outlierFailures{first: now}
+		d.failures[key] = failures
+	}
+	failures.count++
+	if failures.count < d.config.ConsecutiveFailures {
+		return false
+	}
+	delete(d.failures, key)
+	return true
+}
+
+func (d *outlierDetector) succeeded(host, backend string) {
+	key := host + ";" + backend
+	d.mu.Lock()
+	delete(d.failures, key)
+	if ejected := d.ejected[host]; ejected != nil {
+		delete(ejected, backend)
+		if len(ejected) == 0 {
+			delete(d.ejected, host)
+		}
+	}
+	d.mu.Unlock()
+}
+
+// eject records backend, one of the backends of host, as marked as dead until
+// reviveAt and returns true, unless the backends of host already marked as
+// dead by outlier detection reach the maximum ejection percent.
+func (d *outlierDetector) eject(host, backend string, backends int, now, reviveAt time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ejected := d.ejected[host]
+	active := 0
+	for b, until := range ejected {
+		if !until.After(now) {
+			delete(ejected, b)
+		} else if b != backend {
+			active++
+		}
+	}
+	if active > 0 && (active+1)*100 > d.config.MaxEjectionPercent*backends {
+		return false
+	}
+	if ejected == nil {
+		ejected = make(map[string]time.Time)
+		d.ejected[host] = ejected
+	}
+	ejected[backend] = reviveAt
+	return true
+}
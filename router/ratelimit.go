@@ -0,0 +1,161 @@
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aaqaishtyaq/roxxy/backend"
+	"github.com/aaqaishtyaq/roxxy/log"
+	"github.com/aaqaishtyaq/roxxy/reverseproxy"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rateLimitBuckets is the number of clients whose local token buckets are
+// kept, the least recently seen ones start over with a full bucket.
+const rateLimitBuckets = 65536
+
+// RateLimit configures the default rate limit of frontends: Rate requests
+// per second from each client, told apart by Key, with bursts of up to Burst
+// requests. Key is ip, path, header:<name> or cookie:<name>, requests without
+// the key are limited by client IP. With Distributed the rate limits are
+// shared by every roxxy instance through the backend, falling back to local
+// ones while it fails.
+type RateLimit struct {
+	Rate        float64
+	Burst       int
+	Key         string
+	Distributed bool
+}
+
+var rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "roxxy",
+	Subsystem: "router",
+	Name:      "rate_limited_total",
+	Help:      "The total requests rejected by rate limits.",
+}, []string{"frontend"})
+
+func init() {
+	prometheus.MustRegister(rateLimited)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBuckets holds the local rate limits of clients.
+type tokenBuckets struct {
+	mu      sync.Mutex
+	buckets *lru.Cache
+}
+
+func newTokenBuckets() (*tokenBuckets, error) {
+	buckets, err := lru.New(rateLimitBuckets)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenBuckets{buckets: buckets}, nil
+}
+
+// take takes a token from the bucket of key, refilled with rate tokens per
+// second up to burst tokens.
+func (b *tokenBuckets) take(key string, rate float64, burst int, now time.Time) backend.RateLimitResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var bucket *tokenBucket
+	if value, ok := b.buckets.Get(key); ok {
+		bucket = value.(*tokenBucket)
+	} else {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		b.buckets.Add(key, bucket)
+	}
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens = math.Min(float64(burst), bucket.tokens+elapsed.Seconds()*rate)
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		return backend.RateLimitResult{
+			RetryAfter: secondsDuration((1 - bucket.tokens) / rate),
+			Reset:      secondsDuration((float64(burst) - bucket.tokens) / rate),
+		}
+	}
+	bucket.tokens--
+	return backend.RateLimitResult{
+		Allowed:   true,
+		Remaining: int(bucket.tokens),
+		Reset:     secondsDuration((float64(burst) - bucket.tokens) / rate),
+	}
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// rateLimit returns the rate limit of frontend, a rate of zero if it has
+// none. A negative rate in the frontend options disables the default one.
+func (router *Router) rateLimit(frontend *backend.Frontend) (rate float64, burst int, key string) {
+	rate, burst, key = router.RateLimit.Rate, router.RateLimit.Burst, router.RateLimit.Key
+	if frontend.Options.RateLimit != 0 {
+		rate = frontend.Options.RateLimit
+	}
+	if frontend.Options.RateLimitBurst > 0 {
+		burst = frontend.Options.RateLimitBurst
+	}
+	if validHashKey(frontend.Options.RateLimitKey) {
+		key = frontend.Options.RateLimitKey
+	}
+	if rate <= 0 {
+		return 0, 0, ""
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return rate, burst, key
+}
+
+// takeRateLimit takes a request of the client of req from the rate limit of
+// host, returning nil if the request isn't rate limited.
+func (router *Router) takeRateLimit(ctx context.Context, req *http.Request, host string, set *backendSet, now time.Time) *reverseproxy.RateLimit {
+	rate, burst, key := router.rateLimit(set.frontend)
+	if rate <= 0 || req == nil {
+		return nil
+	}
+	value := requestHashKey(req, key)
+	if value == "" {
+		key = hashKeyIP
+		value = requestHashKey(req, key)
+	}
+	// Client keys may be credentials, they are only kept hashed.
+	sum := sha256.Sum256([]byte(key + "\x00" + value))
+	clientKey := hex.EncodeToString(sum[:16])
+	var result backend.RateLimitResult
+	var err error
+	if router.limiter != nil {
+		result, err = router.limiter.RateLimit(ctx, host, clientKey, rate, burst, now)
+		if err != nil {
+			log.ErrorLogger.MessageRaw(&log.LogEntry{
+				Err: &log.ErrEntry{
+					Host: host,
+					Err:  fmt.Sprintf("distributed rate limit failed, using local one: %s", err),
+				},
+			})
+		}
+	}
+	if router.limiter == nil || err != nil {
+		result = router.buckets.take(host+"\x00"+clientKey, rate, burst, now)
+	}
+	return &reverseproxy.RateLimit{
+		Limit:      burst,
+		Remaining:  result.Remaining,
+		Reset:      result.Reset,
+		RetryAfter: result.RetryAfter,
+		Exceeded:   !result.Allowed,
+	}
+}
@@ -2,7 +2,12 @@ package router
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"regexp"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,23 +18,62 @@ import (
 	lru "github.com/hashicorp/golang-lru"
 )
 
-var cacheTTLExpires = 2 * time.Second
+var (
+	cacheTTLExpires = 2 * time.Second
+	cacheSize       = 100
+	ewmaDecay       = 10 * time.Second
+)
 
 type Router struct {
-	LogPath        string
-	DeadBackendTTL int
-	Backend        backend.RoutesBackend
-	CacheEnabled   bool
-	logger         *log.Logger
-	rrMutex        sync.RWMutex
-	roundRobin     map[string]*uint32
-	cache          *lru.Cache
+	LogPath           string
+	DeadBackendTTL    int
+	Backend           backend.RoutesBackend
+	CacheEnabled      bool
+	CacheSize         int
+	CacheTTL          time.Duration
+	CacheInvalidation bool
+	PathPrefixDepth   int
+	StripPathPrefix   bool
+	OutlierDetection  OutlierDetection
+	CircuitBreaker    CircuitBreaker
+	RateLimit         RateLimit
+	LoadBalancer      string
+	HashKey           string
+	EWMADecay         time.Duration
+	StickyCookie      string
+	StickyTTL         time.Duration
+	StickyKey         string
+	logger            *log.Logger
+	rrMutex           sync.RWMutex
+	roundRobin        map[string]*uint32
+	weighted          map[string]*weightedRoundRobin
+	rings             map[string]*hashRing
+	inFlight          *inFlight
+	latencies         *peakEWMA
+	stickyKey         []byte
+	cache             *lru.Cache
+	watching          bool
+	regexMu           sync.Mutex
+	regexFrontends    []regexFrontend
+	regexExpires      time.Time
+	outliers          *outlierDetector
+	breakers          *circuitBreakers
+	buckets           *tokenBuckets
+	limiter           backend.RateLimiter
+}
+
+type regexFrontend struct {
+	pattern string
+	re      *regexp.Regexp
 }
 
+// backendSet is a cached frontend, its backend URLs and weights are kept
+// apart so round robin state can compare them cheaply on every request.
 type backendSet struct {
-	id       string
+	notFound bool
+	frontend *backend.Frontend
 	backends []string
-	dead     map[int]struct{}
+	weights  []int
 	expires  time.Time
 }
 
@@ -42,7 +86,7 @@ func (router *Router) Init(ctx context.Context) error {
 
 	if router.Backend == nil {
 		var be backend.RoutesBackend
-		be, err = backend.NewRedisBackend(ctx, backend.RedisOptions{}, backend.RedisOptions{})
+		be, err = backend.NewRedisBackend(ctx, backend.RedisOptions{}, backend.RedisOptions{}, backend.EventOptions{})
 		if err != nil {
 			return err
 		}
@@ -64,37 +108,412 @@ func (router *Router) Init(ctx context.Context) error {
 		router.DeadBackendTTL = 30
 	}
 
+	if router.CacheSize == 0 {
+		router.CacheSize = cacheSize
+	}
+
+	if router.CacheTTL == 0 {
+		router.CacheTTL = cacheTTLExpires
+	}
+
 	if router.CacheEnabled && router.cache == nil {
-		router.cache, err = lru.New(100)
+		router.cache, err = lru.New(router.CacheSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	if router.CacheEnabled && router.CacheInvalidation && !router.watching {
+		err = router.Backend.StartRoutesWatcher(ctx, router.invalidate)
+		if err != nil {
+			return err
+		}
+		router.watching = true
+	}
+
+	if router.OutlierDetection.enabled() {
+		if router.OutlierDetection.MaxEjectionPercent <= 0 {
+			router.OutlierDetection.MaxEjectionPercent = 100
+		}
+		router.outliers = newOutlierDetector(router.OutlierDetection)
+	}
+
+	if router.CircuitBreaker.enabled() {
+		if router.CircuitBreaker.MinRequests <= 0 {
+			router.CircuitBreaker.MinRequests = 20
+		}
+		if router.CircuitBreaker.Window <= 0 {
+			router.CircuitBreaker.Window = 10 * time.Second
+		}
+		if router.CircuitBreaker.OpenDuration <= 0 {
+			router.CircuitBreaker.OpenDuration = 30 * time.Second
+		}
+		if router.CircuitBreaker.HalfOpenRequests <= 0 {
+			router.CircuitBreaker.HalfOpenRequests = 5
+		}
+		router.breakers = newCircuitBreakers(router.CircuitBreaker)
+	}
+
+	if router.LoadBalancer == "" {
+		router.LoadBalancer = backend.LoadBalancerWeighted
+	}
+	if !validLoadBalancer(router.LoadBalancer) {
+		return fmt.Errorf("invalid load balancer %q", router.LoadBalancer)
+	}
+
+	if router.EWMADecay <= 0 {
+		router.EWMADecay = ewmaDecay
+	}
+
+	if router.StickyCookie == "" {
+		router.StickyCookie = defaultStickyCookie
+	}
+	if router.StickyKey != "" {
+		router.stickyKey = []byte(router.StickyKey)
+	} else if router.stickyKey == nil {
+		// Cookies are only honored by the instance which set them.
+		router.stickyKey, err = randomStickyKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	if router.HashKey == "" {
+		router.HashKey = hashKeyIP
+	}
+	if !validHashKey(router.HashKey) {
+		return fmt.Errorf("invalid hash key %q", router.HashKey)
+	}
+
+	if router.RateLimit.Key == "" {
+		router.RateLimit.Key = hashKeyIP
+	}
+	if !validHashKey(router.RateLimit.Key) {
+		return fmt.Errorf("invalid rate limit key %q", router.RateLimit.Key)
+	}
+	if router.RateLimit.Distributed {
+		limiter, ok := router.Backend.(backend.RateLimiter)
+		if !ok {
+			return errors.New("distributed rate limits require the redis backend")
+		}
+		router.limiter = limiter
+	}
+	if router.buckets == nil {
+		router.buckets, err = newTokenBuckets()
 		if err != nil {
 			return err
 		}
 	}
 
 	router.roundRobin = make(map[string]*uint32)
+	router.weighted = make(map[string]*weightedRoundRobin)
+	router.rings = make(map[string]*hashRing)
+	router.inFlight = newInFlight()
+	router.latencies = newPeakEWMA(router.EWMADecay)
 	return nil
 }
 
-func (router *Router) ChooseBackend(ctx context.Context, host string) (*reverseproxy.RequestData, error) {
+func (router *Router) ChooseBackend(ctx context.Context, host, path string) (*reverseproxy.RequestData, error) {
 	reqData := &reverseproxy.RequestData{
 		StartTime: time.Now(),
-		Host:      host,
 	}
-	set, err := router.getBackends(ctx, host)
-	if err == reverseproxy.ErrNoRegisteredBackends {
-		noPortHost, _, _ := net.SplitHostPort(host)
-		if noPortHost != "" {
-			reqData.Host = noPortHost
-			set, err = router.getBackends(ctx, noPortHost)
+	set, key, prefix, err := router.findFrontend(ctx, host, path)
+	reqData.Host = key + prefix
+	if err != nil {
+		return reqData, err
+	}
+
+	if router.StripPathPrefix {
+		reqData.StripPrefix = prefix
+	}
+	reqData.Frontend = set.frontend
+	reqData.BackendKey = set.frontend.ID
+	reqData.BackendLen = len(set.backends)
+	now := reqData.StartTime
+	req := reverseproxy.RequestFromContext(ctx)
+	excluded := reverseproxy.ExcludedBackends(ctx)
+	reqData.Retry = len(excluded) > 0
+	// Retries were already counted by the rate limit of the first attempt.
+	if !reqData.Retry {
+		reqData.RateLimit = router.takeRateLimit(ctx, req, reqData.Host, set, now)
+		if reqData.RateLimit != nil && reqData.RateLimit.Exceeded {
+			rateLimited.WithLabelValues(reqData.Host).Inc()
+			return reqData, reverseproxy.ErrRateLimited
+		}
+	}
+	if router.breakers != nil && reqData.Retry {
+		// Retries belong to a request the breaker already admitted.
+		reqData.CircuitState = router.breakers.state(breakerKey{host: reqData.Host})
+	} else if router.breakers != nil {
+		var allowed bool
+		reqData.CircuitState, allowed = router.breakers.allow(breakerKey{host: reqData.Host}, now)
+		if !allowed {
+			breakerRejected.WithLabelValues(reqData.Host).Inc()
+			return reqData, reverseproxy.ErrCircuitOpen
+		}
+	}
+	dead, tripped := router.unavailableBackends(reqData.Host, set, excluded, now)
+	toUseNumber, stickyNumber := -1, -1
+	var stickyExpires time.Time
+	if set.frontend.Options.Sticky {
+		stickyNumber, stickyExpires = router.stickyBackend(req, reqData.Host, set, dead, now)
+		toUseNumber = stickyNumber
+	}
+	for {
+		if toUseNumber == -1 {
+			toUseNumber = router.balance(req, reqData, set, dead)
+		}
+		if toUseNumber == -1 || router.admitBackend(reqData.Host, set.backends[toUseNumber], now) {
+			break
+		}
+		// Other requests took the half-open probes of the backend since it
+		// was found available, another one is chosen.
+		dead[toUseNumber] = struct{}{}
+		tripped = true
+		toUseNumber = -1
+	}
+	if toUseNumber == -1 {
+		if router.breakers != nil && !reqData.Retry {
+			router.breakers.record(breakerKey{host: reqData.Host}, true, now)
+		}
+		if tripped {
+			return reqData, reverseproxy.ErrCircuitOpen
+		}
+		return reqData, reverseproxy.ErrAllBackendsDead
+	}
+	reqData.BackendIdx = toUseNumber
+	reqData.Backend = set.backends[toUseNumber]
+	if set.frontend.Options.Sticky && (toUseNumber != stickyNumber || router.renewSticky(set.frontend, stickyExpires, now)) {
+		reqData.StickyCookie = router.stickyCookie(reqData.Host, prefix, set.frontend, reqData.Backend, now)
+	}
+	router.inFlight.inc(reqData.Host, reqData.Backend)
+	return reqData, nil
+}
+
+// admitBackend returns whether the circuit breaker of backend admits a
+// request, always true without per backend breakers.
+func (router *Router) admitBackend(host, backend string, now time.Time) bool {
+	if router.breakers == nil || !router.CircuitBreaker.PerBackend {
+		return true
+	}
+	_, allowed := router.breakers.allow(breakerKey{host: host, backend: backend}, now)
+	return allowed
+}
+
+// balance returns the index of the backend chosen by the load balancer of
+// the frontend, or -1 if every backend is dead.
+func (router *Router) balance(req *http.Request, reqData *reverseproxy.RequestData, set *backendSet, dead map[int]struct{}) int {
+	var toUseNumber int
+	switch router.loadBalancer(set.frontend) {
+	case backend.LoadBalancerLeastConn:
+		toUseNumber = router.nextRoundRobin(reqData.Host, reqData.BackendLen, dead)
+		if toUseNumber != -1 {
+			toUseNumber = router.inFlight.leastConn(reqData.Host, set.backends, set.weights, dead, toUseNumber)
+		}
+	case backend.LoadBalancerRoundRobin:
+		toUseNumber = router.nextRoundRobin(reqData.Host, reqData.BackendLen, dead)
+	case backend.LoadBalancerP2C:
+		toUseNumber = router.latencies.pick(reqData.Host, set.backends, set.weights, dead, router.inFlight, time.Now())
+	case backend.LoadBalancerConsistentHash:
+		// Requests without a hash key have no affinity to keep.
+		key := requestHashKey(req, router.hashKey(set.frontend))
+		if key == "" {
+			toUseNumber = router.nextRoundRobin(reqData.Host, reqData.BackendLen, dead)
+		} else {
+			toUseNumber = router.getRing(reqData.Host).next(set.backends, set.weights, dead, key)
+		}
+	default:
+		if isWeighted(set.weights) {
+			toUseNumber = router.getWeighted(reqData.Host).next(set.backends, set.weights, dead)
+		} else {
+			toUseNumber = router.nextRoundRobin(reqData.Host, reqData.BackendLen, dead)
+		}
+	}
+	return toUseNumber
+}
+
+// unavailableBackends returns the dead backends of set along with the
+// backends in exclude, already tried by a retried request, and the backends
+// with an open circuit breaker. tripped is set if any backend was left out by
+// its circuit breaker.
+func (router *Router) unavailableBackends(host string, set *backendSet, exclude []string, now time.Time) (dead map[int]struct{}, tripped bool) {
+	perBackend := router.breakers != nil && router.CircuitBreaker.PerBackend
+	if len(exclude) == 0 && !perBackend {
+		return set.frontend.Dead, false
+	}
+	dead = make(map[int]struct{}, len(set.frontend.Dead)+len(exclude))
+	for i := range set.frontend.Dead {
+		dead[i] = struct{}{}
+	}
+	for i, backend := range set.backends {
+		for _, excluded := range exclude {
+			if backend == excluded {
+				dead[i] = struct{}{}
+			}
+		}
+		if _, isDead := dead[i]; isDead || !perBackend {
+			continue
+		}
+		if !router.breakers.available(breakerKey{host: host, backend: backend}, now) {
+			dead[i] = struct{}{}
+			tripped = true
 		}
 	}
+	return dead, tripped
+}
+
+// loadBalancer returns the algorithm used for frontend, its own option or the
+// router default when unset or unknown.
+func (router *Router) loadBalancer(frontend *backend.Frontend) string {
+	if frontend == nil {
+		return router.LoadBalancer
+	}
+	if lb := frontend.Options.LoadBalancer; validLoadBalancer(lb) {
+		return lb
+	}
+	return router.LoadBalancer
+}
+
+// hashKey returns the hash key used for frontend, its own option or the
+// router default when unset or invalid.
+func (router *Router) hashKey(frontend *backend.Frontend) string {
+	if key := frontend.Options.HashKey; validHashKey(key) {
+		return key
+	}
+	return router.HashKey
+}
+
+func validLoadBalancer(lb string) bool {
+	switch lb {
+	case backend.LoadBalancerWeighted, backend.LoadBalancerRoundRobin,
+		backend.LoadBalancerLeastConn, backend.LoadBalancerConsistentHash, backend.LoadBalancerP2C:
+		return true
+	}
+	return false
+}
 
+// findFrontend looks up the frontend matching host trying, in order, the host
+// itself, the host without the port, the wildcard frontend of the host and
+// the regex frontends in priority order. The key of the matched frontend is
+// returned with the backends and the matched path prefix.
+func (router *Router) findFrontend(ctx context.Context, host, path string) (*backendSet, string, string, error) {
+	set, prefix, err := router.findBackends(ctx, host, path)
+	if err != reverseproxy.ErrNoRegisteredBackends {
+		return set, host, prefix, err
+	}
+	noPortHost, _, _ := net.SplitHostPort(host)
+	if noPortHost != "" {
+		host = noPortHost
+		set, prefix, err = router.findBackends(ctx, host, path)
+		if err != reverseproxy.ErrNoRegisteredBackends {
+			return set, host, prefix, err
+		}
+	}
+	if wildcard := getWildCard(host); wildcard != host {
+		set, prefix, err = router.findBackends(ctx, wildcard, path)
+		if err != reverseproxy.ErrNoRegisteredBackends {
+			return set, wildcard, prefix, err
+		}
+	}
+	regexFrontends, err := router.getRegexFrontends(ctx)
 	if err != nil {
-		return reqData, err
+		return nil, host, "", err
 	}
+	for _, frontend := range regexFrontends {
+		if !frontend.re.MatchString(host) {
+			continue
+		}
+		set, prefix, err = router.findBackends(ctx, frontend.pattern, path)
+		if err != reverseproxy.ErrNoRegisteredBackends {
+			return set, frontend.pattern, prefix, err
+		}
+	}
+	return nil, host, "", reverseproxy.ErrNoRegisteredBackends
+}
 
-	reqData.BackendKey = set.id
-	reqData.BackendLen = len(set.backends)
+// getWildCard returns the wildcard frontend matching one level of subdomain
+// of domain, "*.example.com" for "app.example.com".
+func getWildCard(domain string) string {
+	idx := strings.IndexByte(domain, '.')
+	if idx == -1 {
+		return domain
+	}
+	return "*" + domain[idx:]
+}
+
+// getRegexFrontends returns the compiled regex frontends, refreshed from the
+// backend every CacheTTL. Invalid expressions are logged and ignored.
+func (router *Router) getRegexFrontends(ctx context.Context) ([]regexFrontend, error) {
+	router.regexMu.Lock()
+	defer router.regexMu.Unlock()
+	if time.Now().Before(router.regexExpires) {
+		return router.regexFrontends, nil
+	}
+	patterns, err := router.Backend.RegexFrontends(ctx)
+	if err != nil {
+		return nil, err
+	}
+	regexFrontends := make([]regexFrontend, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.ErrorLogger.MessageRaw(&log.LogEntry{
+				Err: &log.ErrEntry{
+					Host: pattern,
+					Err:  fmt.Sprintf("invalid regex frontend: %s", err),
+				},
+			})
+			continue
+		}
+		regexFrontends = append(regexFrontends, regexFrontend{pattern: pattern, re: re})
+	}
+	router.regexFrontends = regexFrontends
+	router.regexExpires = time.Now().Add(router.CacheTTL)
+	return regexFrontends, nil
+}
+
+// findBackends looks up the frontend for host with the longest path prefix
+// matching path, up to PathPrefixDepth segments, falling back to the frontend
+// of the host itself. The matched prefix is returned with the backends.
+func (router *Router) findBackends(ctx context.Context, host, path string) (*backendSet, string, error) {
+	for _, prefix := range pathPrefixes(path, router.PathPrefixDepth) {
+		set, err := router.getBackends(ctx, host+prefix)
+		if err != reverseproxy.ErrNoRegisteredBackends {
+			return set, prefix, err
+		}
+	}
+	set, err := router.getBackends(ctx, host)
+	return set, "", err
+}
+
+// pathPrefixes returns the prefixes of path made of up to depth segments,
+// longest first: "/api/v1/users" with depth 2 returns "/api/v1" and "/api".
+func pathPrefixes(path string, depth int) []string {
+	if depth <= 0 {
+		return nil
+	}
+	var prefixes []string
+	end := 0
+	for len(prefixes) < depth && end < len(path) && path[end] == '/' {
+		next := strings.IndexByte(path[end+1:], '/')
+		if next == -1 {
+			next = len(path)
+		} else {
+			next += end + 1
+		}
+		if next == end+1 {
+			break
+		}
+		prefixes = append(prefixes, path[:next])
+		end = next
+	}
+	for i, j := 0, len(prefixes)-1; i < j; i, j = i+1, j-1 {
+		prefixes[i], prefixes[j] = prefixes[j], prefixes[i]
+	}
+	return prefixes
+}
+
+func (router *Router) nextRoundRobin(host string, backendLen int, dead map[int]struct{}) int {
 	router.rrMutex.RLock()
 	roundRobin := router.roundRobin[host]
 	if roundRobin == nil {
@@ -112,31 +531,76 @@ func (router *Router) ChooseBackend(ctx context.Context, host string) (*reversep
 
 	// We always add, it will eventually overflow to zero which is fine.
 	initialNumber := atomic.AddUint32(roundRobin, 1)
-	initialNumber = (initialNumber - 1) % uint32(reqData.BackendLen)
+	initialNumber = (initialNumber - 1) % uint32(backendLen)
 	toUseNumber := -1
 	for chosenNumber := initialNumber; ; {
-		_, isDead := set.dead[int(chosenNumber)]
+		_, isDead := dead[int(chosenNumber)]
 		if !isDead {
 			toUseNumber = int(chosenNumber)
 			break
 		}
-		chosenNumber = (chosenNumber + 1) % uint32(reqData.BackendLen)
+		chosenNumber = (chosenNumber + 1) % uint32(backendLen)
 		if chosenNumber == initialNumber {
 			break
 		}
 	}
-	if toUseNumber == -1 {
-		return reqData, reverseproxy.ErrAllBackendsDead
+	return toUseNumber
+}
+
+func (router *Router) getWeighted(host string) *weightedRoundRobin {
+	router.rrMutex.RLock()
+	weighted := router.weighted[host]
+	router.rrMutex.RUnlock()
+	if weighted != nil {
+		return weighted
 	}
-	reqData.BackendIdx = toUseNumber
-	reqData.Backend = set.backends[toUseNumber]
-	return reqData, nil
+	router.rrMutex.Lock()
+	defer router.rrMutex.Unlock()
+	weighted = router.weighted[host]
+	if weighted == nil {
+		weighted = &weightedRoundRobin{}
+		router.weighted[host] = weighted
+	}
+	return weighted
+}
+
+func (router *Router) getRing(host string) *hashRing {
+	router.rrMutex.RLock()
+	ring := router.rings[host]
+	router.rrMutex.RUnlock()
+	if ring != nil {
+		return ring
+	}
+	router.rrMutex.Lock()
+	defer router.rrMutex.Unlock()
+	ring = router.rings[host]
+	if ring == nil {
+		ring = &hashRing{}
+		router.rings[host] = ring
+	}
+	return ring
 }
 
 func (router *Router) EndRequest(ctx context.Context, reqData *reverseproxy.RequestData, isDead bool, fn func() *log.LogEntry) error {
 	var markErr error
+	if reqData.Backend != "" {
+		router.inFlight.dec(reqData.Host, reqData.Backend)
+	}
+	if reqData.BackendDuration > 0 && router.loadBalancer(reqData.Frontend) == backend.LoadBalancerP2C {
+		rtt := reqData.BackendDuration
+		if isDead && rtt < ewmaFailurePenalty {
+			rtt = ewmaFailurePenalty
+		}
+		router.latencies.observe(reqData.Host, reqData.Backend, rtt, time.Now())
+	}
+	if router.breakers != nil && reqData.Backend != "" {
+		router.recordBreakers(reqData, isDead)
+	}
+	if router.outliers != nil && reqData.Backend != "" {
+		isDead = router.isOutlier(ctx, reqData, isDead)
+	}
 	if isDead {
-		markErr = router.Backend.MarkDead(ctx, reqData.Host, reqData.Backend, reqData.BackendIdx, reqData.BackendLen, router.DeadBackendTTL)
+		markErr = router.Backend.MarkDead(ctx, reqData.Host, reqData.Backend, router.DeadBackendTTL)
 	}
 	if router.logger != nil && fn != nil {
 		router.logger.MessageRaw(fn())
@@ -144,7 +608,46 @@ func (router *Router) EndRequest(ctx context.Context, reqData *reverseproxy.Requ
 	return markErr
 }
 
+// recordBreakers counts the outcome of a request in the circuit breakers of
+// its frontend and backend. Only first attempts are counted by the frontend
+// breaker, retries belong to a request it already admitted.
+func (router *Router) recordBreakers(reqData *reverseproxy.RequestData, isDead bool) {
+	now := time.Now()
+	failed := isDead || reqData.StatusCode >= 500 ||
+		(router.CircuitBreaker.Latency > 0 && reqData.BackendDuration > router.CircuitBreaker.Latency)
+	if !reqData.Retry {
+		router.breakers.record(breakerKey{host: reqData.Host}, failed, now)
+	}
+	if router.CircuitBreaker.PerBackend {
+		router.breakers.record(breakerKey{host: reqData.Host, backend: reqData.Backend}, failed, now)
+	}
+}
+
+// isOutlier returns whether the backend of reqData must be marked as dead,
+// with outlier detection enabled network errors and 5xx responses only mark
+// a backend as dead after reaching the consecutive failures threshold.
+func (router *Router) isOutlier(ctx context.Context, reqData *reverseproxy.RequestData, isDead bool) bool {
+	if !isDead && reqData.StatusCode < 500 {
+		router.outliers.succeeded(reqData.Host, reqData.Backend)
+		return false
+	}
+	now := time.Now()
+	if !router.outliers.failed(reqData.Host, reqData.Backend, now) {
+		return false
+	}
+	set, err := router.getBackends(ctx, reqData.Host)
+	if err != nil {
+		return false
+	}
+	reviveAt := now.Add(time.Duration(router.DeadBackendTTL) * time.Second)
+	return router.outliers.eject(reqData.Host, reqData.Backend, len(set.backends), now, reviveAt)
+}
+
 func (router *Router) Stop() {
+	if router.watching {
+		router.Backend.StopRoutesWatcher()
+		router.watching = false
+	}
 	if router.logger != nil {
 		router.logger.Stop()
 	}
@@ -159,22 +662,55 @@ func (router *Router) getBackends(ctx context.Context, host string) (*backendSet
 		if data, ok := router.cache.Get(host); ok {
 			set := data.(backendSet)
 			if !set.Expired() {
+				if set.notFound {
+					return nil, reverseproxy.ErrNoRegisteredBackends
+				}
 				return &set, nil
 			}
 		}
 	}
-	var set backendSet
-	var err error
-	set.id, set.backends, set.dead, err = router.Backend.Backends(ctx, host)
+	frontend, err := router.Backend.Frontend(ctx, host)
 	if err != nil {
 		if err == backend.ErrNoBackends {
+			// Path-prefix, wildcard and regex frontends are looked up after
+			// missing ones, those are cached to avoid a backend round-trip per
+			// candidate.
+			if router.cache != nil {
+				router.cache.Add(host, backendSet{
+					notFound: true,
+					expires:  time.Now().Add(router.CacheTTL),
+				})
+			}
 			return nil, reverseproxy.ErrNoRegisteredBackends
 		}
 		return nil, err
 	}
-	set.expires = time.Now().Add(cacheTTLExpires)
+	set := backendSet{
+		frontend: frontend,
+		backends: frontend.URLs(),
+		weights:  frontend.Weights(),
+		expires:  time.Now().Add(router.CacheTTL),
+	}
+	// Nothing is published when a dead backend is revived.
+	if !frontend.DeadUntil.IsZero() && frontend.DeadUntil.Before(set.expires) {
+		set.expires = frontend.DeadUntil
+	}
 	if router.cache != nil {
 		router.cache.Add(host, set)
 	}
 	return &set, nil
 }
+
+func (router *Router) invalidate(host string) {
+	if router.cache == nil {
+		return
+	}
+	if host == "" {
+		router.cache.Purge()
+		router.regexMu.Lock()
+		router.regexExpires = time.Time{}
+		router.regexMu.Unlock()
+		return
+	}
+	router.cache.Remove(host)
+}
@@ -3,10 +3,16 @@ package router
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/aaqaishtyaq/roxxy/backend"
 	"github.com/aaqaishtyaq/roxxy/log"
 	"github.com/aaqaishtyaq/roxxy/reverseproxy"
 	"github.com/go-redis/redis/v8"
@@ -27,6 +33,11 @@ func clearKeys(r *redis.Client) error {
 	ctx := context.Background()
 	val := r.Keys(ctx, "frontend:*").Val()
 	val = append(val, r.Keys(ctx, "dead:*").Val()...)
+	val = append(val, r.Keys(ctx, "dead-backends:*").Val()...)
+	val = append(val, r.Keys(ctx, "weight:*").Val()...)
+	val = append(val, r.Keys(ctx, "options:*").Val()...)
+	val = append(val, r.Keys(ctx, "ratelimit:*").Val()...)
+	val = append(val, "frontends:regex")
 	if len(val) > 0 {
 		return r.Del(ctx, val...).Err()
 	}
@@ -69,6 +80,8 @@ func (s *S) TestInitCacheEnabled(c *check.C) {
 	c.Assert(router.logger, check.IsNil)
 	c.Assert(router.cache, check.NotNil)
 	c.Assert(router.Backend, check.NotNil)
+	c.Assert(router.CacheTTL, check.Equals, 2*time.Second)
+	c.Assert(router.CacheSize, check.Equals, 100)
 }
 
 func (s *S) TestChooseBackend(c *check.C) {
@@ -78,10 +91,12 @@ func (s *S) TestChooseBackend(c *check.C) {
 	c.Assert(err, check.IsNil)
 	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
 	c.Assert(err, check.IsNil)
-	reqData, err := router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.StartTime.IsZero(), check.Equals, false)
+	c.Assert(reqData.Frontend.URLs(), check.DeepEquals, []string{"http://url1:123"})
 	reqData.StartTime = time.Time{}
+	reqData.Frontend = nil
 	c.Assert(reqData, check.DeepEquals, &reverseproxy.RequestData{
 		Backend:    "http://url1:123",
 		BackendIdx: 0,
@@ -100,10 +115,11 @@ func (s *S) TestChooseBackendConsiderPort(c *check.C) {
 	c.Assert(err, check.IsNil)
 	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url2:123").Err()
 	c.Assert(err, check.IsNil)
-	reqData, err := router.ChooseBackend(ctx, "myfrontend.com:1234")
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com:1234", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.StartTime.IsZero(), check.Equals, false)
 	reqData.StartTime = time.Time{}
+	reqData.Frontend = nil
 	c.Assert(reqData, check.DeepEquals, &reverseproxy.RequestData{
 		Backend:    "http://url1:123",
 		BackendIdx: 0,
@@ -111,10 +127,11 @@ func (s *S) TestChooseBackendConsiderPort(c *check.C) {
 		BackendLen: 1,
 		Host:       "myfrontend.com:1234",
 	})
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com:9999")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com:9999", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.StartTime.IsZero(), check.Equals, false)
 	reqData.StartTime = time.Time{}
+	reqData.Frontend = nil
 	c.Assert(reqData, check.DeepEquals, &reverseproxy.RequestData{
 		Backend:    "http://url2:123",
 		BackendIdx: 0,
@@ -131,10 +148,11 @@ func (s *S) TestChooseBackendIgnorePort(c *check.C) {
 	c.Assert(err, check.IsNil)
 	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
 	c.Assert(err, check.IsNil)
-	reqData, err := router.ChooseBackend(ctx, "myfrontend.com:80")
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com:80", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.StartTime.IsZero(), check.Equals, false)
 	reqData.StartTime = time.Time{}
+	reqData.Frontend = nil
 	c.Assert(reqData, check.DeepEquals, &reverseproxy.RequestData{
 		Backend:    "http://url1:123",
 		BackendIdx: 0,
@@ -144,15 +162,246 @@ func (s *S) TestChooseBackendIgnorePort(c *check.C) {
 	})
 }
 
+func (s *S) TestChooseBackendPathPrefix(c *check.C) {
+	ctx := context.Background()
+	router := Router{PathPrefixDepth: 2}
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com/api", "api", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com/api/v2", "apiv2", "http://url3:123").Err()
+	c.Assert(err, check.IsNil)
+	tests := []struct {
+		host, path, backend, key string
+	}{
+		{"myfrontend.com", "/", "http://url1:123", "myfrontend.com"},
+		{"myfrontend.com", "/apis", "http://url1:123", "myfrontend.com"},
+		{"myfrontend.com", "/api", "http://url2:123", "myfrontend.com/api"},
+		{"myfrontend.com", "/api/v1/users", "http://url2:123", "myfrontend.com/api"},
+		{"myfrontend.com", "/api/v2/users", "http://url3:123", "myfrontend.com/api/v2"},
+		{"myfrontend.com:8080", "/api/v2", "http://url3:123", "myfrontend.com/api/v2"},
+	}
+	for _, tt := range tests {
+		reqData, err := router.ChooseBackend(ctx, tt.host, tt.path)
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Backend, check.Equals, tt.backend)
+		c.Assert(reqData.Host, check.Equals, tt.key)
+		c.Assert(reqData.StripPrefix, check.Equals, "")
+	}
+}
+
+func (s *S) TestChooseBackendPathPrefixDepth(c *check.C) {
+	ctx := context.Background()
+	router := Router{PathPrefixDepth: 1}
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com/api/v2", "apiv2", "http://url3:123").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/api/v2")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+}
+
+func (s *S) TestChooseBackendStripPathPrefix(c *check.C) {
+	ctx := context.Background()
+	router := Router{PathPrefixDepth: 2, StripPathPrefix: true}
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com/api", "api", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/api/users")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.StripPrefix, check.Equals, "/api")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/users")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.StripPrefix, check.Equals, "")
+}
+
+func (s *S) TestChooseBackendPathPrefixWithCache(c *check.C) {
+	ctx := context.Background()
+	router := Router{PathPrefixDepth: 1, CacheEnabled: true, CacheTTL: time.Minute}
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/api")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+	data, ok := router.cache.Get("myfrontend.com/api")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(data.(backendSet).notFound, check.Equals, true)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com/api", "api", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/api")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+	router.invalidate("myfrontend.com/api")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/api")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+}
+
+func (s *S) TestChooseBackendCacheExpiresWithDeadBackend(c *check.C) {
+	ctx := context.Background()
+	router := Router{CacheEnabled: true, CacheTTL: time.Hour}
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = router.Backend.MarkDead(ctx, "myfrontend.com", "http://url1:123", 30)
+	c.Assert(err, check.IsNil)
+	_, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	data, ok := router.cache.Get("myfrontend.com")
+	c.Assert(ok, check.Equals, true)
+	expiresIn := time.Until(data.(backendSet).expires)
+	c.Assert(expiresIn <= 30*time.Second, check.Equals, true)
+	c.Assert(expiresIn > 25*time.Second, check.Equals, true)
+}
+
+func (s *S) TestInvalidateAll(c *check.C) {
+	ctx := context.Background()
+	router := Router{CacheEnabled: true, CacheTTL: time.Minute}
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	_, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(router.cache.Len(), check.Equals, 1)
+	router.regexExpires = time.Now().Add(time.Minute)
+	router.invalidate("")
+	c.Assert(router.cache.Len(), check.Equals, 0)
+	c.Assert(router.regexExpires.IsZero(), check.Equals, true)
+}
+
+func (s *S) TestPathPrefixes(c *check.C) {
+	tests := []struct {
+		path     string
+		depth    int
+		expected []string
+	}{
+		{"/api/v1/users", 0, nil},
+		{"/api/v1/users", 2, []string{"/api/v1", "/api"}},
+		{"/api/v1/users", 5, []string{"/api/v1/users", "/api/v1", "/api"}},
+		{"/api/", 3, []string{"/api"}},
+		{"/", 3, nil},
+		{"//api", 3, nil},
+		{"", 3, nil},
+	}
+	for _, tt := range tests {
+		c.Check(pathPrefixes(tt.path, tt.depth), check.DeepEquals, tt.expected, check.Commentf("path %q", tt.path))
+	}
+}
+
+func (s *S) TestChooseBackendWildcard(c *check.C) {
+	ctx := context.Background()
+	router := Router{}
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:*.myfrontend.com", "wildcard", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:b.myfrontend.com", "b", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err := router.ChooseBackend(ctx, "a.myfrontend.com:8080", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+	c.Assert(reqData.Host, check.Equals, "*.myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "b.myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+	c.Assert(reqData.Host, check.Equals, "b.myfrontend.com")
+	_, err = router.ChooseBackend(ctx, "x.a.myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrNoRegisteredBackends)
+	_, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrNoRegisteredBackends)
+}
+
+func (s *S) TestChooseBackendRegex(c *check.C) {
+	ctx := context.Background()
+	router := Router{}
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, `frontend:^tenant-\d+\.myfrontend\.com$`, "tenants", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, `frontend:^tenant-1\d*\.myfrontend\.com$`, "tenants1", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.ZAdd(ctx, "frontends:regex",
+		&redis.Z{Score: 20, Member: `^tenant-\d+\.myfrontend\.com$`},
+		&redis.Z{Score: 10, Member: `^tenant-1\d*\.myfrontend\.com$`},
+		&redis.Z{Score: 0, Member: `^tenant-(\.myfrontend\.com$`},
+	).Err()
+	c.Assert(err, check.IsNil)
+	reqData, err := router.ChooseBackend(ctx, "tenant-12.myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+	c.Assert(reqData.Host, check.Equals, `^tenant-1\d*\.myfrontend\.com$`)
+	reqData, err = router.ChooseBackend(ctx, "tenant-22.myfrontend.com:8080", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+	c.Assert(reqData.Host, check.Equals, `^tenant-\d+\.myfrontend\.com$`)
+	_, err = router.ChooseBackend(ctx, "tenant-a.myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrNoRegisteredBackends)
+	c.Assert(router.regexFrontends, check.HasLen, 2)
+}
+
+func (s *S) TestChooseBackendRegexRefresh(c *check.C) {
+	ctx := context.Background()
+	router := Router{CacheEnabled: true, CacheTTL: 100 * time.Millisecond}
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:^tenant", "tenants", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	_, err = router.ChooseBackend(ctx, "tenant-1.myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrNoRegisteredBackends)
+	err = s.redis.ZAdd(ctx, "frontends:regex", &redis.Z{Member: "^tenant"}).Err()
+	c.Assert(err, check.IsNil)
+	time.Sleep(router.CacheTTL)
+	reqData, err := router.ChooseBackend(ctx, "tenant-1.myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+	c.Assert(reqData.Host, check.Equals, "^tenant")
+}
+
+func (s *S) TestChooseBackendNotFoundWithCache(c *check.C) {
+	ctx := context.Background()
+	router := Router{CacheEnabled: true, CacheTTL: time.Minute}
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	_, err = router.ChooseBackend(ctx, "a.myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrNoRegisteredBackends)
+	err = s.redis.RPush(ctx, "frontend:*.myfrontend.com", "wildcard", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	_, err = router.ChooseBackend(ctx, "a.myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrNoRegisteredBackends)
+	router.invalidate("*.myfrontend.com")
+	reqData, err := router.ChooseBackend(ctx, "a.myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+}
+
+func (s *S) TestGetWildCard(c *check.C) {
+	c.Assert(getWildCard("a.myfrontend.com"), check.Equals, "*.myfrontend.com")
+	c.Assert(getWildCard("myfrontend.com"), check.Equals, "*.com")
+	c.Assert(getWildCard("localhost"), check.Equals, "localhost")
+}
+
 func (s *S) TestChooseBackendNotFound(c *check.C) {
 	router := Router{}
 	ctx := context.Background()
 	err := router.Init(ctx)
 	c.Assert(err, check.IsNil)
-	reqData, err := router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.Equals, reverseproxy.ErrNoRegisteredBackends)
 	c.Assert(reqData.StartTime.IsZero(), check.Equals, false)
 	reqData.StartTime = time.Time{}
+	reqData.Frontend = nil
 	c.Assert(reqData, check.DeepEquals, &reverseproxy.RequestData{
 		Backend:    "",
 		BackendIdx: 0,
@@ -169,10 +418,11 @@ func (s *S) TestChooseBackendNoBackends(c *check.C) {
 	c.Assert(err, check.IsNil)
 	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend").Err()
 	c.Assert(err, check.IsNil)
-	reqData, err := router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.Equals, reverseproxy.ErrNoRegisteredBackends)
 	c.Assert(reqData.StartTime.IsZero(), check.Equals, false)
 	reqData.StartTime = time.Time{}
+	reqData.Frontend = nil
 	c.Assert(reqData, check.DeepEquals, &reverseproxy.RequestData{
 		Backend:    "",
 		BackendIdx: 0,
@@ -189,12 +439,13 @@ func (s *S) TestChooseBackendAllDead(c *check.C) {
 	c.Assert(err, check.IsNil)
 	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
 	c.Assert(err, check.IsNil)
-	err = s.redis.SAdd(ctx, "dead:myfrontend.com", "0").Err()
+	err = s.redis.SAdd(ctx, "dead:myfrontend.com", "http://url1:123").Err()
 	c.Assert(err, check.IsNil)
-	reqData, err := router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.Equals, reverseproxy.ErrAllBackendsDead)
 	c.Assert(reqData.StartTime.IsZero(), check.Equals, false)
 	reqData.StartTime = time.Time{}
+	reqData.Frontend = nil
 	c.Assert(reqData, check.DeepEquals, &reverseproxy.RequestData{
 		Backend:    "",
 		BackendIdx: 0,
@@ -211,10 +462,11 @@ func (s *S) TestChooseBackendRoundRobin(c *check.C) {
 	c.Assert(err, check.IsNil)
 	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123", "http://url3:123").Err()
 	c.Assert(err, check.IsNil)
-	reqData, err := router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.StartTime.IsZero(), check.Equals, false)
 	reqData.StartTime = time.Time{}
+	reqData.Frontend = nil
 	c.Assert(reqData, check.DeepEquals, &reverseproxy.RequestData{
 		Backend:    "http://url1:123",
 		BackendIdx: 0,
@@ -224,20 +476,779 @@ func (s *S) TestChooseBackendRoundRobin(c *check.C) {
 	})
 	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "http://url4:123").Err()
 	c.Assert(err, check.IsNil)
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url2:123")
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url3:123")
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url4:123")
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
 }
 
+func (s *S) TestChooseBackendWeighted(c *check.C) {
+	router := Router{}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "weight:myfrontend.com", "http://url1:123", "3").Err()
+	c.Assert(err, check.IsNil)
+	var chosen []string
+	for i := 0; i < 8; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		chosen = append(chosen, reqData.Backend)
+	}
+	c.Assert(chosen, check.DeepEquals, []string{
+		"http://url1:123", "http://url1:123", "http://url2:123", "http://url1:123",
+		"http://url1:123", "http://url1:123", "http://url2:123", "http://url1:123",
+	})
+}
+
+func (s *S) TestChooseBackendRoundRobinOption(c *check.C) {
+	router := Router{}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "weight:myfrontend.com", "http://url1:123", "3").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "lb", "round-robin", "header:X-Tenant", "t1").Err()
+	c.Assert(err, check.IsNil)
+	var chosen []string
+	for i := 0; i < 4; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Frontend.Options.RequestHeaders, check.DeepEquals, map[string]string{"X-Tenant": "t1"})
+		chosen = append(chosen, reqData.Backend)
+	}
+	c.Assert(chosen, check.DeepEquals, []string{
+		"http://url1:123", "http://url2:123", "http://url1:123", "http://url2:123",
+	})
+}
+
+func (s *S) TestChooseBackendLeastConn(c *check.C) {
+	router := Router{LoadBalancer: "least-conn"}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	first, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(first.Backend, check.Equals, "http://url1:123")
+	var chosen []string
+	for i := 0; i < 2; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		chosen = append(chosen, reqData.Backend)
+		err = router.EndRequest(ctx, reqData, false, nil)
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(chosen, check.DeepEquals, []string{"http://url2:123", "http://url2:123"})
+	err = router.EndRequest(ctx, first, false, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(router.inFlight.count("myfrontend.com", "http://url1:123"), check.Equals, 0)
+	c.Assert(router.inFlight.counts, check.HasLen, 0)
+}
+
+func (s *S) TestChooseBackendLeastConnWeighted(c *check.C) {
+	router := Router{LoadBalancer: "least-conn"}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "weight:myfrontend.com", "http://url1:123", "3").Err()
+	c.Assert(err, check.IsNil)
+	var chosen []string
+	for i := 0; i < 4; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		chosen = append(chosen, reqData.Backend)
+	}
+	c.Assert(chosen, check.DeepEquals, []string{
+		"http://url1:123", "http://url2:123", "http://url1:123", "http://url1:123",
+	})
+}
+
+func (s *S) TestChooseBackendLeastConnOption(c *check.C) {
+	router := Router{LoadBalancer: "round-robin"}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "lb", "least-conn").Err()
+	c.Assert(err, check.IsNil)
+	first, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(first.Backend, check.Equals, "http://url1:123")
+	for i := 0; i < 2; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+		err = router.EndRequest(ctx, reqData, false, nil)
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) TestChooseBackendLeastConnIgnoreDead(c *check.C) {
+	router := Router{LoadBalancer: "least-conn"}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.SAdd(ctx, "dead:myfrontend.com", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 2; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+	}
+}
+
+func (s *S) TestChooseBackendConsistentHash(c *check.C) {
+	router := Router{}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123", "http://url3:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "lb", "consistent-hash", "hash-key", "header:X-User").Err()
+	c.Assert(err, check.IsNil)
+	chosen := map[string]string{}
+	for i := 0; i < 3; i++ {
+		for _, user := range []string{"u1", "u2", "u3", "u4", "u5", "u6"} {
+			req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+			req.Header.Set("X-User", user)
+			reqData, err := router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+			c.Assert(err, check.IsNil)
+			if i > 0 {
+				c.Assert(reqData.Backend, check.Equals, chosen[user])
+			}
+			chosen[user] = reqData.Backend
+		}
+	}
+	var withoutKey []string
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+		reqData, err := router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		withoutKey = append(withoutKey, reqData.Backend)
+	}
+	c.Assert(withoutKey, check.DeepEquals, []string{"http://url1:123", "http://url2:123", "http://url3:123"})
+}
+
+func (s *S) TestChooseBackendConsistentHashClientIP(c *check.C) {
+	router := Router{LoadBalancer: "consistent-hash"}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123", "http://url3:123").Err()
+	c.Assert(err, check.IsNil)
+	req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+	req.RemoteAddr = "10.0.0.1:4000"
+	first, err := router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	req.RemoteAddr = "10.0.0.1:4001"
+	second, err := router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(second.Backend, check.Equals, first.Backend)
+}
+
+func (s *S) TestHashRingMinimalRemap(c *check.C) {
+	ring := &hashRing{}
+	backends := []string{"http://url1:123", "http://url2:123", "http://url3:123"}
+	weights := []int{1, 1, 1}
+	before := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before[key] = ring.next(backends, weights, nil, key)
+	}
+	added := append(backends, "http://url4:123")
+	moved := 0
+	for key, idx := range before {
+		chosen := ring.next(added, append(weights, 1), nil, key)
+		if chosen != idx {
+			c.Assert(chosen, check.Equals, 3)
+			moved++
+		}
+	}
+	c.Assert(moved > 500 && moved < 1000, check.Equals, true, check.Commentf("moved %d keys", moved))
+	dead := map[int]struct{}{1: {}}
+	for key, idx := range before {
+		chosen := ring.next(backends, weights, dead, key)
+		if idx != 1 {
+			c.Assert(chosen, check.Equals, idx)
+		} else {
+			c.Assert(chosen, check.Not(check.Equals), 1)
+		}
+	}
+	c.Assert(ring.next(backends, weights, map[int]struct{}{0: {}, 1: {}, 2: {}}, "key0"), check.Equals, -1)
+}
+
+func (s *S) TestChooseBackendP2C(c *check.C) {
+	router := Router{LoadBalancer: "p2c"}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	now := time.Now()
+	router.latencies.observe("myfrontend.com", "http://url1:123", 500*time.Millisecond, now)
+	router.latencies.observe("myfrontend.com", "http://url2:123", 10*time.Millisecond, now)
+	for i := 0; i < 10; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+		err = router.EndRequest(ctx, reqData, false, nil)
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) TestChooseBackendP2COption(c *check.C) {
+	router := Router{}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "lb", "p2c").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	reqData.BackendDuration = time.Millisecond
+	err = router.EndRequest(ctx, reqData, true, nil)
+	c.Assert(err, check.IsNil)
+	latency := router.latencies.latencies("myfrontend.com", []string{reqData.Backend}, time.Now())
+	c.Assert(latency[0] > float64(ewmaFailurePenalty-time.Millisecond), check.Equals, true)
+}
+
+func (s *S) TestPeakEWMA(c *check.C) {
+	p := newPeakEWMA(10 * time.Second)
+	now := time.Now()
+	backends := []string{"b1", "b2", "b3"}
+	p.observe("h", "b1", 100*time.Millisecond, now)
+	p.observe("h", "b2", 300*time.Millisecond, now)
+	c.Assert(p.latencies("h", backends, now), check.DeepEquals, []float64{
+		float64(100 * time.Millisecond), float64(300 * time.Millisecond), float64(200 * time.Millisecond),
+	})
+	p.observe("h", "b1", 400*time.Millisecond, now.Add(time.Second))
+	latencies := p.latencies("h", backends, now.Add(time.Second))
+	c.Assert(latencies[0], check.Equals, float64(400*time.Millisecond))
+	p.observe("h", "b1", 0, now.Add(11*time.Second))
+	latencies = p.latencies("h", backends, now.Add(11*time.Second))
+	c.Assert(latencies[0] < float64(200*time.Millisecond), check.Equals, true)
+	latencies = p.latencies("h", backends, now.Add(time.Minute))
+	c.Assert(latencies[1] < float64(time.Millisecond), check.Equals, true)
+	p.observe("h", "b1", time.Millisecond, now.Add(2*time.Minute))
+	c.Assert(p.latency, check.HasLen, 1)
+}
+
+func (s *S) TestPeakEWMAPickAllDead(c *check.C) {
+	p := newPeakEWMA(10 * time.Second)
+	dead := map[int]struct{}{0: {}, 1: {}}
+	c.Assert(p.pick("h", []string{"b1", "b2"}, []int{1, 1}, dead, newInFlight(), time.Now()), check.Equals, -1)
+	dead = map[int]struct{}{0: {}}
+	c.Assert(p.pick("h", []string{"b1", "b2"}, []int{1, 1}, dead, newInFlight(), time.Now()), check.Equals, 1)
+}
+
+func (s *S) TestChooseBackendSticky(c *check.C) {
+	router := Router{LoadBalancer: "round-robin", StickyKey: "secret", StickyTTL: time.Hour}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "sticky", "true").Err()
+	c.Assert(err, check.IsNil)
+	req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+	reqData, err := router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+	cookie := reqData.StickyCookie
+	c.Assert(cookie, check.NotNil)
+	c.Assert(cookie.Name, check.Equals, "ROXXY_BACKEND")
+	c.Assert(cookie.MaxAge, check.Equals, 3600)
+	req.AddCookie(cookie)
+	for i := 0; i < 3; i++ {
+		reqData, err = router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+		c.Assert(reqData.StickyCookie, check.IsNil)
+	}
+	other := Router{LoadBalancer: "round-robin", StickyKey: "other"}
+	err = other.Init(ctx)
+	c.Assert(err, check.IsNil)
+	other.nextRoundRobin("myfrontend.com", 2, nil)
+	reqData, err = other.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+	c.Assert(reqData.StickyCookie, check.NotNil)
+}
+
+func (s *S) TestChooseBackendStickyDeadBackend(c *check.C) {
+	router := Router{LoadBalancer: "round-robin", StickyKey: "secret"}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "sticky", "true", "sticky-cookie", "srv").Err()
+	c.Assert(err, check.IsNil)
+	req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+	req.AddCookie(router.stickyCookie("myfrontend.com", "", &backend.Frontend{}, "http://url1:123", time.Now()))
+	reqData, err := router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.StickyCookie, check.NotNil)
+	c.Assert(reqData.StickyCookie.Name, check.Equals, "srv")
+	c.Assert(reqData.StickyCookie.MaxAge, check.Equals, 0)
+	req, _ = http.NewRequest("GET", "http://myfrontend.com/", nil)
+	req.AddCookie(reqData.StickyCookie)
+	err = s.redis.SAdd(ctx, "dead:myfrontend.com", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err = router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+	c.Assert(reqData.StickyCookie, check.NotNil)
+	c.Assert(reqData.StickyCookie.Value, check.Not(check.Equals), req.Cookies()[0].Value)
+}
+
+func (s *S) TestChooseBackendStickyExpired(c *check.C) {
+	router := Router{LoadBalancer: "round-robin", StickyKey: "secret", StickyTTL: time.Hour}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "sticky", "true").Err()
+	c.Assert(err, check.IsNil)
+	router.nextRoundRobin("myfrontend.com", 2, nil)
+	expired := router.stickyCookie("myfrontend.com", "", &backend.Frontend{}, "http://url1:123", time.Now().Add(-2*time.Hour))
+	req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+	req.AddCookie(expired)
+	reqData, err := router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+	c.Assert(reqData.StickyCookie, check.NotNil)
+	parts := strings.SplitN(expired.Value, ".", 3)
+	extended := *expired
+	extended.Value = parts[0] + "." + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + "." + parts[2]
+	req, _ = http.NewRequest("GET", "http://myfrontend.com/", nil)
+	req.AddCookie(&extended)
+	reqData, err = router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.StickyCookie, check.NotNil)
+}
+
+func (s *S) TestChooseBackendStickyRenewed(c *check.C) {
+	router := Router{LoadBalancer: "round-robin", StickyKey: "secret", StickyTTL: time.Hour}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "sticky", "true").Err()
+	c.Assert(err, check.IsNil)
+	router.nextRoundRobin("myfrontend.com", 2, nil)
+	req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+	req.AddCookie(router.stickyCookie("myfrontend.com", "", &backend.Frontend{}, "http://url1:123", time.Now().Add(-40*time.Minute)))
+	reqData, err := router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+	c.Assert(reqData.StickyCookie, check.NotNil)
+	c.Assert(reqData.StickyCookie.MaxAge, check.Equals, 3600)
+	req, _ = http.NewRequest("GET", "http://myfrontend.com/", nil)
+	req.AddCookie(reqData.StickyCookie)
+	reqData, err = router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+	c.Assert(reqData.StickyCookie, check.IsNil)
+}
+
+func (s *S) TestChooseBackendStickyPathPrefix(c *check.C) {
+	router := Router{LoadBalancer: "round-robin", PathPrefixDepth: 1, StickyKey: "secret"}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	router.nextRoundRobin("myfrontend.com/static", 2, nil)
+	for _, prefix := range []string{"/api", "/static"} {
+		err = s.redis.RPush(ctx, "frontend:myfrontend.com"+prefix, "myfrontend", "http://url1:123", "http://url2:123").Err()
+		c.Assert(err, check.IsNil)
+		err = s.redis.HSet(ctx, "options:myfrontend.com"+prefix, "sticky", "true").Err()
+		c.Assert(err, check.IsNil)
+	}
+	cookies := map[string]*http.Cookie{}
+	backends := map[string]string{}
+	for _, prefix := range []string{"/api", "/static"} {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", prefix+"/index")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.StickyCookie, check.NotNil)
+		c.Assert(reqData.StickyCookie.Path, check.Equals, prefix)
+		cookies[prefix] = reqData.StickyCookie
+		backends[prefix] = reqData.Backend
+	}
+	c.Assert(backends["/api"], check.Not(check.Equals), backends["/static"])
+	for _, prefix := range []string{"/api", "/static"} {
+		req, _ := http.NewRequest("GET", "http://myfrontend.com"+prefix+"/index", nil)
+		req.AddCookie(cookies["/static"])
+		req.AddCookie(cookies["/api"])
+		reqData, err := router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", prefix+"/index")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Backend, check.Equals, backends[prefix])
+		c.Assert(reqData.StickyCookie, check.IsNil)
+	}
+}
+
+func (s *S) TestChooseBackendExcludedBackends(c *check.C) {
+	router := Router{StickyKey: "secret"}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123", "http://url3:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "sticky", "true").Err()
+	c.Assert(err, check.IsNil)
+	req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+	req.AddCookie(router.stickyCookie("myfrontend.com", "", &backend.Frontend{}, "http://url1:123", time.Now()))
+	ctx = reverseproxy.WithExcludedBackends(reverseproxy.WithRequest(ctx, req), []string{"http://url1:123", "http://url2:123"})
+	for i := 0; i < 2; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Backend, check.Equals, "http://url3:123")
+		c.Assert(reqData.StickyCookie, check.NotNil)
+	}
+	ctx = reverseproxy.WithExcludedBackends(ctx, []string{"http://url1:123", "http://url2:123", "http://url3:123"})
+	_, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrAllBackendsDead)
+}
+
+func (s *S) TestCircuitBreakers(c *check.C) {
+	breakers := newCircuitBreakers(CircuitBreaker{
+		ErrorRate:        0.5,
+		MinRequests:      4,
+		Window:           time.Minute,
+		OpenDuration:     time.Minute,
+		HalfOpenRequests: 2,
+	})
+	key := breakerKey{host: "myfe.com"}
+	now := time.Now()
+	for _, failed := range []bool{true, false, true} {
+		state, ok := breakers.allow(key, now)
+		c.Assert(state, check.Equals, "closed")
+		c.Assert(ok, check.Equals, true)
+		breakers.record(key, failed, now)
+	}
+	breakers.record(key, false, now)
+	state, ok := breakers.allow(key, now)
+	c.Assert(state, check.Equals, "open")
+	c.Assert(ok, check.Equals, false)
+	c.Assert(breakers.available(key, now.Add(time.Minute)), check.Equals, true)
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		state, ok = breakers.allow(key, now)
+		c.Assert(state, check.Equals, "half-open")
+		c.Assert(ok, check.Equals, true)
+	}
+	_, ok = breakers.allow(key, now)
+	c.Assert(ok, check.Equals, false)
+	c.Assert(breakers.available(key, now), check.Equals, false)
+	breakers.record(key, false, now)
+	breakers.record(key, true, now)
+	state, ok = breakers.allow(key, now)
+	c.Assert(state, check.Equals, "open")
+	c.Assert(ok, check.Equals, false)
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		_, ok = breakers.allow(key, now)
+		c.Assert(ok, check.Equals, true)
+		breakers.record(key, false, now)
+	}
+	state, ok = breakers.allow(key, now)
+	c.Assert(state, check.Equals, "closed")
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *S) TestCircuitBreakerWindow(c *check.C) {
+	breakers := newCircuitBreakers(CircuitBreaker{ErrorRate: 0.5, MinRequests: 2, Window: time.Second})
+	key := breakerKey{host: "myfe.com"}
+	now := time.Now()
+	breakers.record(key, true, now)
+	breakers.record(key, true, now.Add(2*time.Second))
+	state, ok := breakers.allow(key, now.Add(2*time.Second))
+	c.Assert(state, check.Equals, "closed")
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *S) TestChooseBackendCircuitBreaker(c *check.C) {
+	router := Router{CircuitBreaker: CircuitBreaker{ErrorRate: 0.5, MinRequests: 2, Latency: time.Second}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(router.CircuitBreaker.OpenDuration, check.Equals, 30*time.Second)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.CircuitState, check.Equals, "closed")
+	reqData.StatusCode = http.StatusInternalServerError
+	err = router.EndRequest(ctx, reqData, false, nil)
+	c.Assert(err, check.IsNil)
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	reqData.StatusCode = http.StatusOK
+	reqData.BackendDuration = 2 * time.Second
+	err = router.EndRequest(ctx, reqData, false, nil)
+	c.Assert(err, check.IsNil)
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrCircuitOpen)
+	c.Assert(reqData.CircuitState, check.Equals, "open")
+	c.Assert(reqData.Backend, check.Equals, "")
+	err = router.EndRequest(ctx, reqData, false, nil)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestChooseBackendCircuitBreakerRetry(c *check.C) {
+	router := Router{CircuitBreaker: CircuitBreaker{ErrorRate: 0.5, MinRequests: 1, HalfOpenRequests: 1}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	key := breakerKey{host: "myfrontend.com"}
+	router.breakers.record(key, true, time.Now())
+	router.breakers.breakers[key].until = time.Now()
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.CircuitState, check.Equals, "half-open")
+	c.Assert(reqData.Retry, check.Equals, false)
+	first := reqData
+	retryCtx := reverseproxy.WithExcludedBackends(ctx, []string{reqData.Backend})
+	reqData, err = router.ChooseBackend(retryCtx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.CircuitState, check.Equals, "half-open")
+	c.Assert(reqData.Retry, check.Equals, true)
+	_, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrCircuitOpen)
+	err = router.EndRequest(ctx, reqData, false, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(router.breakers.state(key), check.Equals, "half-open")
+	first.StatusCode = http.StatusOK
+	err = router.EndRequest(ctx, first, false, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(router.breakers.state(key), check.Equals, "closed")
+}
+
+func (s *S) TestChooseBackendCircuitBreakerPerBackendRejected(c *check.C) {
+	router := Router{CircuitBreaker: CircuitBreaker{ErrorRate: 0.5, MinRequests: 1, HalfOpenRequests: 1, PerBackend: true}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	key := breakerKey{host: "myfrontend.com", backend: "http://url1:123"}
+	router.breakers.record(key, true, time.Now())
+	router.breakers.breakers[key].until = time.Now()
+	c.Assert(router.admitBackend("myfrontend.com", "http://url1:123", time.Now()), check.Equals, true)
+	c.Assert(router.admitBackend("myfrontend.com", "http://url1:123", time.Now()), check.Equals, false)
+	c.Assert(router.admitBackend("myfrontend.com", "http://url2:123", time.Now()), check.Equals, true)
+	for i := 0; i < 3; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+	}
+	c.Assert(router.breakers.breakers[key].probes, check.Equals, 1)
+}
+
+func (s *S) TestChooseBackendCircuitBreakerPerBackend(c *check.C) {
+	router := Router{CircuitBreaker: CircuitBreaker{ErrorRate: 0.5, MinRequests: 1, PerBackend: true}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	router.breakers.record(breakerKey{host: "myfrontend.com", backend: "http://url1:123"}, true, time.Now())
+	for i := 0; i < 3; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Backend, check.Equals, "http://url2:123")
+	}
+	router.breakers.record(breakerKey{host: "myfrontend.com", backend: "http://url2:123"}, true, time.Now())
+	_, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrCircuitOpen)
+}
+
+func (s *S) TestTokenBuckets(c *check.C) {
+	buckets, err := newTokenBuckets()
+	c.Assert(err, check.IsNil)
+	now := time.Now()
+	for i := 2; i >= 0; i-- {
+		result := buckets.take("client1", 2, 3, now)
+		c.Assert(result.Allowed, check.Equals, true)
+		c.Assert(result.Remaining, check.Equals, i)
+	}
+	result := buckets.take("client1", 2, 3, now.Add(100*time.Millisecond))
+	c.Assert(result, check.DeepEquals, backend.RateLimitResult{
+		RetryAfter: 400 * time.Millisecond,
+		Reset:      1400 * time.Millisecond,
+	})
+	c.Assert(buckets.take("client2", 2, 3, now).Allowed, check.Equals, true)
+	result = buckets.take("client1", 2, 3, now.Add(500*time.Millisecond))
+	c.Assert(result, check.DeepEquals, backend.RateLimitResult{Allowed: true, Reset: 1500 * time.Millisecond})
+}
+
+func (s *S) TestChooseBackendRateLimit(c *check.C) {
+	router := Router{RateLimit: RateLimit{Rate: 1, Burst: 5}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "rate-limit-burst", "2", "rate-limit-key", "header:X-Api-Key").Err()
+	c.Assert(err, check.IsNil)
+	choose := func(apiKey string) (*reverseproxy.RequestData, error) {
+		req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+		req.RemoteAddr = "10.0.0.1:4000"
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		return router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+	}
+	for i := 1; i >= 0; i-- {
+		reqData, err := choose("k1")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.Backend, check.Equals, "http://url1:123")
+		c.Assert(reqData.RateLimit.Limit, check.Equals, 2)
+		c.Assert(reqData.RateLimit.Remaining, check.Equals, i)
+	}
+	reqData, err := choose("k1")
+	c.Assert(err, check.Equals, reverseproxy.ErrRateLimited)
+	c.Assert(reqData.Backend, check.Equals, "")
+	c.Assert(reqData.RateLimit.Exceeded, check.Equals, true)
+	c.Assert(reqData.RateLimit.RetryAfter > 0, check.Equals, true)
+	_, err = choose("k2")
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 2; i++ {
+		_, err = choose("")
+		c.Assert(err, check.IsNil)
+	}
+	_, err = choose("")
+	c.Assert(err, check.Equals, reverseproxy.ErrRateLimited)
+}
+
+func (s *S) TestChooseBackendRateLimitRetry(c *check.C) {
+	router := Router{RateLimit: RateLimit{Rate: 1, Burst: 1}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+	req.RemoteAddr = "10.0.0.1:4000"
+	ctx = reverseproxy.WithRequest(ctx, req)
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.RateLimit, check.NotNil)
+	reqData, err = router.ChooseBackend(reverseproxy.WithExcludedBackends(ctx, []string{reqData.Backend}), "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.RateLimit, check.IsNil)
+	_, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrRateLimited)
+}
+
+func (s *S) TestChooseBackendRateLimitDisabled(c *check.C) {
+	router := Router{RateLimit: RateLimit{Rate: 1}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "rate-limit", "-1").Err()
+	c.Assert(err, check.IsNil)
+	req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+	for i := 0; i < 3; i++ {
+		reqData, err := router.ChooseBackend(reverseproxy.WithRequest(ctx, req), "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		c.Assert(reqData.RateLimit, check.IsNil)
+	}
+}
+
+func (s *S) TestChooseBackendRateLimitDistributed(c *check.C) {
+	ctx := context.Background()
+	router1 := Router{RateLimit: RateLimit{Distributed: true}}
+	err := router1.Init(ctx)
+	c.Assert(err, check.IsNil)
+	router2 := Router{RateLimit: RateLimit{Distributed: true}}
+	err = router2.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "options:myfrontend.com", "rate-limit", "0.1", "rate-limit-burst", "2").Err()
+	c.Assert(err, check.IsNil)
+	req, _ := http.NewRequest("GET", "http://myfrontend.com/", nil)
+	req.RemoteAddr = "10.0.0.1:4000"
+	reqCtx := reverseproxy.WithRequest(ctx, req)
+	_, err = router1.ChooseBackend(reqCtx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	reqData, err := router2.ChooseBackend(reqCtx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.RateLimit.Remaining, check.Equals, 0)
+	_, err = router1.ChooseBackend(reqCtx, "myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrRateLimited)
+	keys, err := s.redis.Keys(ctx, "ratelimit:myfrontend.com:*").Result()
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	c.Assert(strings.Contains(keys[0], "10.0.0.1"), check.Equals, false)
+}
+
+func (s *S) TestInitInvalidRateLimitKey(c *check.C) {
+	router := Router{RateLimit: RateLimit{Key: "query"}}
+	err := router.Init(context.Background())
+	c.Assert(err, check.ErrorMatches, `invalid rate limit key "query"`)
+}
+
+func (s *S) TestInitInvalidLoadBalancer(c *check.C) {
+	router := Router{LoadBalancer: "bogus"}
+	err := router.Init(context.Background())
+	c.Assert(err, check.ErrorMatches, `invalid load balancer "bogus"`)
+	router = Router{HashKey: "header:"}
+	err = router.Init(context.Background())
+	c.Assert(err, check.ErrorMatches, `invalid hash key "header:"`)
+}
+
+func (s *S) TestChooseBackendWeightedIgnoreDead(c *check.C) {
+	router := Router{}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123", "http://url3:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.HSet(ctx, "weight:myfrontend.com", "http://url1:123", "5", "http://url2:123", "2").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.SAdd(ctx, "dead:myfrontend.com", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	var chosen []string
+	for i := 0; i < 3; i++ {
+		reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+		chosen = append(chosen, reqData.Backend)
+	}
+	c.Assert(chosen, check.DeepEquals, []string{"http://url2:123", "http://url3:123", "http://url2:123"})
+	err = s.redis.SAdd(ctx, "dead:myfrontend.com", "http://url2:123", "http://url3:123").Err()
+	c.Assert(err, check.IsNil)
+	_, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.Equals, reverseproxy.ErrAllBackendsDead)
+}
+
 func (s *S) TestChooseBackendRoundRobinWithCache(c *check.C) {
 	router := Router{CacheEnabled: true}
 	ctx := context.Background()
@@ -245,35 +1256,88 @@ func (s *S) TestChooseBackendRoundRobinWithCache(c *check.C) {
 	c.Assert(err, check.IsNil)
 	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123", "http://url2:123", "http://url3:123").Err()
 	c.Assert(err, check.IsNil)
-	reqData, err := router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
 	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "http://url4:123").Err()
 	c.Assert(err, check.IsNil)
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url2:123")
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url3:123")
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
-	time.Sleep(cacheTTLExpires)
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	time.Sleep(router.CacheTTL)
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url1:123")
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url2:123")
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url3:123")
-	reqData, err = router.ChooseBackend(ctx, "myfrontend.com")
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
 	c.Assert(err, check.IsNil)
 	c.Assert(reqData.Backend, check.Equals, "http://url4:123")
 }
 
+func (s *S) TestChooseBackendCacheInvalidation(c *check.C) {
+	router := Router{CacheEnabled: true, CacheTTL: time.Hour, CacheInvalidation: true}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	defer router.Stop()
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.BackendLen, check.Equals, 1)
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	c.Assert(reqData.BackendLen, check.Equals, 1)
+	err = s.redis.Publish(ctx, "routes", "myfrontend.com").Err()
+	c.Assert(err, check.IsNil)
+	timeout := time.After(5 * time.Second)
+	for reqData.BackendLen != 2 {
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for cache invalidation")
+		case <-time.After(20 * time.Millisecond):
+		}
+		reqData, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) TestChooseBackendCacheInvalidationMarkDead(c *check.C) {
+	router := Router{CacheEnabled: true, CacheTTL: time.Hour, CacheInvalidation: true}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	defer router.Stop()
+	err = s.redis.RPush(ctx, "frontend:myfrontend.com", "myfrontend", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
+	c.Assert(err, check.IsNil)
+	err = router.EndRequest(ctx, reqData, true, nil)
+	c.Assert(err, check.IsNil)
+	timeout := time.After(5 * time.Second)
+	for err != reverseproxy.ErrAllBackendsDead {
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for cache invalidation")
+		case <-time.After(20 * time.Millisecond):
+		}
+		_, err = router.ChooseBackend(ctx, "myfrontend.com", "/")
+	}
+}
+
 func (s *S) TestChooseBackendRoundRobinStress(c *check.C) {
 	router := Router{}
 	ctx := context.Background()
@@ -301,9 +1365,9 @@ func (s *S) TestChooseBackendRoundRobinStress(c *check.C) {
 		go func() {
 			defer wg.Done()
 			for j := 0; j < nSeq; j++ {
-				reqData1, err := router.ChooseBackend(ctx, "myfrontend.com")
+				reqData1, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
 				c.Assert(err, check.IsNil)
-				reqData2, err := router.ChooseBackend(ctx, "myfrontend2.com")
+				reqData2, err := router.ChooseBackend(ctx, "myfrontend2.com", "/")
 				c.Assert(err, check.IsNil)
 				mu.Lock()
 				freq1[reqData1.BackendIdx]++
@@ -352,7 +1416,7 @@ func (s *S) TestChooseBackendRoundRobinStressOverflow(c *check.C) {
 		go func() {
 			defer wg.Done()
 			for j := 0; j < nSeq; j++ {
-				reqData, err := router.ChooseBackend(ctx, "myfrontend.com")
+				reqData, err := router.ChooseBackend(ctx, "myfrontend.com", "/")
 				c.Assert(err, check.IsNil)
 				mu.Lock()
 				freq[reqData.BackendIdx]++
@@ -421,12 +1485,13 @@ func (s *S) TestEndRequestWithError(c *check.C) {
 	err := router.Init(ctx)
 	c.Assert(err, check.IsNil)
 	data := &reverseproxy.RequestData{
-		Host: "myfe.com",
+		Host:    "myfe.com",
+		Backend: "http://url1:123",
 	}
 	err = router.EndRequest(ctx, data, true, nil)
 	c.Assert(err, check.IsNil)
-	members := s.redis.SMembers(ctx, "dead:myfe.com").Val()
-	c.Assert(members, check.DeepEquals, []string{"0"})
+	members := s.redis.ZRange(ctx, "dead-backends:myfe.com", 0, -1).Val()
+	c.Assert(members, check.DeepEquals, []string{"http://url1:123"})
 }
 
 func BenchmarkChooseBackend(b *testing.B) {
@@ -450,7 +1515,7 @@ func BenchmarkChooseBackend(b *testing.B) {
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			router.ChooseBackend(ctx, "myfrontend.com")
+			router.ChooseBackend(ctx, "myfrontend.com", "/")
 		}
 	})
 	b.StopTimer()
@@ -475,7 +1540,7 @@ func BenchmarkChooseBackendNoCache(b *testing.B) {
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			router.ChooseBackend(ctx, "myfrontend.com")
+			router.ChooseBackend(ctx, "myfrontend.com", "/")
 		}
 	})
 	b.StopTimer()
@@ -505,8 +1570,115 @@ func BenchmarkChooseBackendManyNoCache(b *testing.B) {
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			router.ChooseBackend(ctx, "myfrontend.com")
+			router.ChooseBackend(ctx, "myfrontend.com", "/")
 		}
 	})
 	b.StopTimer()
 }
+
+func (s *S) TestEndRequestOutlierDetection(c *check.C) {
+	router := Router{OutlierDetection: OutlierDetection{ConsecutiveFailures: 3}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(router.OutlierDetection.MaxEjectionPercent, check.Equals, 100)
+	err = s.redis.RPush(ctx, "frontend:myfe.com", "myfe", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	endRequest := func(isDead bool, status int) []string {
+		data := &reverseproxy.RequestData{
+			Host:       "myfe.com",
+			Backend:    "http://url1:123",
+			StatusCode: status,
+		}
+		err := router.EndRequest(ctx, data, isDead, nil)
+		c.Assert(err, check.IsNil)
+		return s.redis.ZRange(ctx, "dead-backends:myfe.com", 0, -1).Val()
+	}
+	c.Assert(endRequest(true, 503), check.HasLen, 0)
+	c.Assert(endRequest(false, 502), check.HasLen, 0)
+	c.Assert(endRequest(false, 200), check.HasLen, 0)
+	c.Assert(endRequest(false, 500), check.HasLen, 0)
+	c.Assert(endRequest(false, 404), check.HasLen, 0)
+	c.Assert(endRequest(false, 500), check.HasLen, 0)
+	c.Assert(endRequest(true, 503), check.HasLen, 0)
+	c.Assert(endRequest(false, 504), check.DeepEquals, []string{"http://url1:123"})
+}
+
+func (s *S) TestEndRequestOutlierDetectionWindow(c *check.C) {
+	router := Router{OutlierDetection: OutlierDetection{ConsecutiveFailures: 2, Window: 100 * time.Millisecond}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfe.com", "myfe", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	data := &reverseproxy.RequestData{
+		Host:       "myfe.com",
+		Backend:    "http://url1:123",
+		StatusCode: 502,
+	}
+	err = router.EndRequest(ctx, data, false, nil)
+	c.Assert(err, check.IsNil)
+	time.Sleep(150 * time.Millisecond)
+	err = router.EndRequest(ctx, data, false, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.redis.ZRange(ctx, "dead-backends:myfe.com", 0, -1).Val(), check.HasLen, 0)
+	err = router.EndRequest(ctx, data, false, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.redis.ZRange(ctx, "dead-backends:myfe.com", 0, -1).Val(), check.DeepEquals, []string{"http://url1:123"})
+}
+
+func (s *S) TestEndRequestOutlierDetectionMaxEjectionPercent(c *check.C) {
+	router := Router{OutlierDetection: OutlierDetection{ConsecutiveFailures: 1, MaxEjectionPercent: 50}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfe.com", "myfe", "http://url1:123", "http://url2:123", "http://url3:123", "http://url4:123").Err()
+	c.Assert(err, check.IsNil)
+	for _, backend := range []string{"http://url1:123", "http://url2:123", "http://url3:123"} {
+		data := &reverseproxy.RequestData{
+			Host:    "myfe.com",
+			Backend: backend,
+		}
+		err = router.EndRequest(ctx, data, true, nil)
+		c.Assert(err, check.IsNil)
+	}
+	members := s.redis.ZRange(ctx, "dead-backends:myfe.com", 0, -1).Val()
+	sort.Strings(members)
+	c.Assert(members, check.DeepEquals, []string{"http://url1:123", "http://url2:123"})
+}
+
+func (s *S) TestEndRequestOutlierDetectionIgnoresOtherDeadBackends(c *check.C) {
+	router := Router{OutlierDetection: OutlierDetection{ConsecutiveFailures: 1, MaxEjectionPercent: 50}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:myfe.com", "myfe", "http://url1:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.RPush(ctx, "frontend:other.com", "other", "http://url1:123", "http://url2:123").Err()
+	c.Assert(err, check.IsNil)
+	err = s.redis.SAdd(ctx, "dead:other.com", "1").Err()
+	c.Assert(err, check.IsNil)
+	for _, host := range []string{"myfe.com", "other.com"} {
+		data := &reverseproxy.RequestData{
+			Host:    host,
+			Backend: "http://url1:123",
+		}
+		err = router.EndRequest(ctx, data, true, nil)
+		c.Assert(err, check.IsNil)
+		c.Assert(s.redis.ZRange(ctx, "dead-backends:"+host, 0, -1).Val(), check.DeepEquals, []string{"http://url1:123"})
+	}
+}
+
+func (s *S) TestEndRequestOutlierDetectionNoBackend(c *check.C) {
+	router := Router{OutlierDetection: OutlierDetection{ConsecutiveFailures: 1}}
+	ctx := context.Background()
+	err := router.Init(ctx)
+	c.Assert(err, check.IsNil)
+	data := &reverseproxy.RequestData{
+		Host:       "myfe.com",
+		StatusCode: 503,
+	}
+	err = router.EndRequest(ctx, data, false, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(router.outliers.failures, check.HasLen, 0)
+}
@@ -0,0 +1,154 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aaqaishtyaq/roxxy/backend"
+)
+
+const (
+	defaultStickyCookie = "ROXXY_BACKEND"
+
+	// stickySessionTTL limits how long session sticky cookies are honored,
+	// browsers may keep sessions open for much longer.
+	stickySessionTTL = 24 * time.Hour
+)
+
+// stickyBackend returns the index of the alive backend named by the sticky
+// cookie of req, or -1 if the cookie is missing, forged, expired or names a
+// backend which is dead or no longer part of the frontend, along with the
+// expiry of the cookie. Path prefix frontends of the same domain share the
+// cookie name, requests may carry one cookie for each, the one signed for
+// host is used.
+func (router *Router) stickyBackend(req *http.Request, host string, set *backendSet, dead map[int]struct{}, now time.Time) (int, time.Time) {
+	if req == nil {
+		return -1, time.Time{}
+	}
+	name := router.stickyCookieName(set.frontend)
+	var id string
+	var expires time.Time
+	for _, cookie := range req.Cookies() {
+		if cookie.Name != name {
+			continue
+		}
+		if id, expires = router.verifyStickyCookie(cookie.Value, host, now); id != "" {
+			break
+		}
+	}
+	if id == "" {
+		return -1, time.Time{}
+	}
+	for i, url := range set.backends {
+		if stickyID(url) != id {
+			continue
+		}
+		if _, isDead := dead[i]; isDead {
+			return -1, time.Time{}
+		}
+		return i, expires
+	}
+	return -1, time.Time{}
+}
+
+// verifyStickyCookie returns the backend id held by the sticky cookie value
+// and its expiry, or an empty id if it's forged, expired or signed for another
+// frontend.
+func (router *Router) verifyStickyCookie(value, host string, now time.Time) (string, time.Time) {
+	parts := strings.SplitN(value, ".", 3)
+	if len(parts) != 3 {
+		return "", time.Time{}
+	}
+	id, expires, sig := parts[0], parts[1], parts[2]
+	if !hmac.Equal([]byte(sig), []byte(router.stickySignature(host, id, expires))) {
+		return "", time.Time{}
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() >= expiresAt {
+		return "", time.Time{}
+	}
+	return id, time.Unix(expiresAt, 0)
+}
+
+// renewSticky reports whether a sticky cookie honored until expires is past
+// half of its lifetime, it's issued again so active clients aren't load
+// balanced again once it expires.
+func (router *Router) renewSticky(frontend *backend.Frontend, expires, now time.Time) bool {
+	_, expiresIn := router.stickyTTL(frontend)
+	return expires.Sub(now) < expiresIn/2
+}
+
+// stickyTTL returns the lifetime of the sticky cookies of frontend, 0 for
+// session cookies, and how long their value is honored.
+func (router *Router) stickyTTL(frontend *backend.Frontend) (ttl, expiresIn time.Duration) {
+	ttl = frontend.Options.StickyTTL
+	if ttl <= 0 {
+		ttl = router.StickyTTL
+	}
+	expiresIn = ttl
+	if expiresIn <= 0 {
+		expiresIn = stickySessionTTL
+	}
+	return ttl, expiresIn
+}
+
+// stickyCookie returns the cookie sending later requests to backend. The
+// cookie holds a hash of the backend URL and its expiry, signed along with the
+// frontend key so it can't be forged, extended nor reused for other frontends.
+// Its path is the path prefix of the frontend, if any, so frontends of the same
+// domain don't overwrite each other's cookie.
+func (router *Router) stickyCookie(host, prefix string, frontend *backend.Frontend, url string, now time.Time) *http.Cookie {
+	ttl, expiresIn := router.stickyTTL(frontend)
+	id := stickyID(url)
+	expires := strconv.FormatInt(now.Add(expiresIn).Unix(), 10)
+	path := prefix
+	if path == "" {
+		path = "/"
+	}
+	cookie := &http.Cookie{
+		Name:     router.stickyCookieName(frontend),
+		Value:    id + "." + expires + "." + router.stickySignature(host, id, expires),
+		Path:     path,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if ttl > 0 {
+		cookie.MaxAge = int(ttl.Seconds())
+	}
+	return cookie
+}
+
+func (router *Router) stickyCookieName(frontend *backend.Frontend) string {
+	if frontend.Options.StickyCookie != "" {
+		return frontend.Options.StickyCookie
+	}
+	return router.StickyCookie
+}
+
+func (router *Router) stickySignature(host, id, expires string) string {
+	mac := hmac.New(sha256.New, router.stickyKey)
+	mac.Write([]byte(host))
+	mac.Write([]byte{0})
+	mac.Write([]byte(id))
+	mac.Write([]byte{0})
+	mac.Write([]byte(expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func stickyID(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8])
+}
+
+func randomStickyKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
@@ -0,0 +1,78 @@
+package router
+
+import "sync"
+
+// weightedRoundRobin implements the smooth weighted round robin used by
+// nginx: every pick adds each backend's weight to its current value, chooses
+// the highest and subtracts the total weight from it. Backends with weights
+// 3 and 1 are chosen as a, a, b, a instead of a, a, a, b.
+type weightedRoundRobin struct {
+	mu       sync.Mutex
+	backends []string
+	weights  []int
+	current  []int
+}
+
+// next returns the index of the next backend, skipping dead ones, or -1 if
+// every backend is dead. The current values are reset whenever the backends
+// or their weights change.
+func (w *weightedRoundRobin) next(backends []string, weights []int, dead map[int]struct{}) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !equalStrings(w.backends, backends) || !equalInts(w.weights, weights) {
+		w.backends = backends
+		w.weights = weights
+		w.current = make([]int, len(backends))
+	}
+	best := -1
+	total := 0
+	for i, weight := range weights {
+		if _, isDead := dead[i]; isDead {
+			continue
+		}
+		w.current[i] += weight
+		total += weight
+		if best == -1 || w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	if best != -1 {
+		w.current[best] -= total
+	}
+	return best
+}
+
+// isWeighted returns whether weights differ between backends, uniform weights
+// are served by the plain round robin.
+func isWeighted(weights []int) bool {
+	for i := 1; i < len(weights); i++ {
+		if weights[i] != weights[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
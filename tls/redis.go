@@ -10,15 +10,19 @@ import (
 )
 
 type RedisCertificateLoader struct {
-	*redis.Client
-	cache *lru.Cache
+	redis.UniversalClient
+	cache     *lru.Cache
+	keyPrefix string
 }
 
-func NewRedisCertificateLoader(client *redis.Client) *RedisCertificateLoader {
+// NewRedisCertificateLoader loads certificates from the tls:<server name>
+// hashes, keyPrefix is prepended to every key.
+func NewRedisCertificateLoader(client redis.UniversalClient, keyPrefix string) *RedisCertificateLoader {
 	cache, _ := lru.New(100)
 	return &RedisCertificateLoader{
-		Client: client,
-		cache:  cache,
+		UniversalClient: client,
+		cache:           cache,
+		keyPrefix:       keyPrefix,
 	}
 }
 
@@ -44,7 +48,7 @@ func (r *RedisCertificateLoader) getCertificateByCNAME(serverName string) (*tls.
 
 func (r *RedisCertificateLoader) getCertificateFromRedis(serverName string) (*tls.Certificate, error) {
 	ctx := context.Background()
-	data, err := r.Client.HMGet(ctx, "tls:"+serverName, "certificate", "key").Result()
+	data, err := r.HMGet(ctx, r.keyPrefix+"tls:"+serverName, "certificate", "key").Result()
 	if err != nil {
 		return nil, err
 	}
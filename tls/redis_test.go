@@ -49,7 +49,7 @@ func Test(t *testing.T) {
 
 func (s *S) SetUpTest(c *check.C) {
 	s.redisClient = redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 1})
-	s.be = NewRedisCertificateLoader(s.redisClient)
+	s.be = NewRedisCertificateLoader(s.redisClient, "")
 }
 
 func (s *S) TestRedisCertificateNotFound(c *check.C) {
@@ -108,3 +108,19 @@ func (s *S) TestRedisCertificateCached(c *check.C) {
 	_, err = s.be.GetCertificate(clientHello)
 	c.Assert(err, check.IsNil)
 }
+
+func (s *S) TestRedisCertificateKeyPrefix(c *check.C) {
+	err := s.redisClient.HMSet(ctx, "staging:tls:prefixed.com", map[string]interface{}{
+		"certificate": rsaCertPEM,
+		"key":         rsaKeyPEM,
+	}).Err()
+	c.Assert(err, check.IsNil)
+	defer s.redisClient.Del(ctx, "staging:tls:prefixed.com")
+	clientHello := &tls.ClientHelloInfo{
+		ServerName: "prefixed.com",
+	}
+	_, err = s.be.GetCertificate(clientHello)
+	c.Assert(err, check.ErrorMatches, `Certificate for \"prefixed.com\" not is found`)
+	_, err = NewRedisCertificateLoader(s.redisClient, "staging:").GetCertificate(clientHello)
+	c.Assert(err, check.IsNil)
+}